@@ -0,0 +1,268 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/Golang-Tanzania/tra-vfd/internal/models"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+var (
+	// ErrDuplicateReceipt is returned when a receipt with the same GC has
+	// already been added to a DailyAggregator.
+	ErrDuplicateReceipt = errors.New("duplicate receipt")
+
+	// ErrUnknownVATRate is returned when a signed receipt has a VATRATE that is
+	// not one of A, B, C, D or E.
+	ErrUnknownVATRate = errors.New("unknown VAT rate")
+
+	// ErrUnknownPaymentType is returned when a receipt has a payment type other
+	// than CASH, CHEQUE, CCARD, EMONEY or INVOICE.
+	ErrUnknownPaymentType = errors.New("unknown payment type")
+)
+
+// paymentTypes lists the PaymentTypes in the order they appear in Z reports
+var paymentTypes = []PaymentType{
+	CashPaymentType, ChequePaymentType, CreditCardPaymentType,
+	ElectronicPaymentType, InvoicePaymentType,
+}
+
+type (
+	// DailyAggregator sums the receipts issued during a day so that the Z report of
+	// the day matches them. Add every receipt as it is issued, then call Report at
+	// the close of the day and Reset before the next one.
+	//
+	// Gross is the running total of all the sales of the device, it starts at the
+	// gross of the last Z report and grows with every receipt. It is safe for
+	// concurrent use.
+	DailyAggregator struct {
+		mu        sync.Mutex
+		table     *VATTable
+		gross     money.Money
+		total     money.Money
+		discounts money.Money
+		tickets   int64
+		vats      map[string]*VATTOTAL
+		payments  map[PaymentType]money.Money
+		seen      map[int64]bool
+	}
+
+	// DailyAggregatorOption configures a DailyAggregator.
+	DailyAggregatorOption func(*DailyAggregator)
+)
+
+// WithAggregatorVATTable sets the rates of the VAT groups of signed receipts
+// and of receipts without a VATTable in their options, the built-in rates of
+// NewVATTable by default.
+func WithAggregatorVATTable(table *VATTable) DailyAggregatorOption {
+	return func(a *DailyAggregator) {
+		if table != nil {
+			a.table = table
+		}
+	}
+}
+
+// NewDailyAggregator returns an aggregator for a day, gross is the Gross of the
+// last Z report or zero for a new device.
+func NewDailyAggregator(gross money.Money, options ...DailyAggregatorOption) *DailyAggregator {
+	a := &DailyAggregator{table: baseVATTable}
+	for _, option := range options {
+		option(a)
+	}
+	a.reset(gross)
+	return a
+}
+
+// Add adds a receipt, the amounts are computed the same way ReceiptBytes
+// computes them for the payload, with the VATTable of the receipt options if
+// it has one.
+func (a *DailyAggregator) Add(receipt *ReceiptRequest) error {
+	opts := receipt.Options
+	if opts.VATTable == nil {
+		opts.VATTable = a.table
+	}
+	result, err := processItems(receipt.Items, receipt.Params.Date, opts, false)
+	if err != nil {
+		return err
+	}
+
+	payments := make([]*models.PAYMENT, len(receipt.Payments))
+	for i, payment := range receipt.Payments {
+		payments[i] = &models.PAYMENT{PMTTYPE: string(payment.Type), PMTAMOUNT: payment.Amount}
+	}
+
+	return a.add(receipt.Params.GlobalCounter, receipt.Params.Date, opts.VATTable, result.TOTALS,
+		result.VATTOTALS, payments)
+}
+
+// AddSigned adds a receipt read back with ParseReceipt, for example from an
+// outbox or the files of a day that has to be reported again. The rates of its
+// VAT groups are taken from the VATTable of the aggregator.
+func (a *DailyAggregator) AddSigned(receipt *SignedReceipt) error {
+	return a.AddSignedWithOptions(receipt, ReceiptOptions{})
+}
+
+// AddSignedWithOptions is like AddSigned for a receipt signed with opts, the
+// rates of its VAT groups are taken from opts.VATTable if it is set so that
+// they match the rates the receipt was computed with.
+func (a *DailyAggregator) AddSignedWithOptions(receipt *SignedReceipt, opts ReceiptOptions) error {
+	table := opts.VATTable
+	if table == nil {
+		table = a.table
+	}
+	rct := receipt.Receipt
+	return a.add(rct.GC, rct.DATE, table, rct.TOTALS, rct.VATTOTALS.VATTOTAL, rct.PAYMENTS.PAYMENT)
+}
+
+func (a *DailyAggregator) add(gc int64, date string, table *VATTable, totals models.TOTALS,
+	vats []*models.VATTOTAL, payments []*models.PAYMENT,
+) error {
+	// resolve the rates and payment types before changing anything so that a
+	// bad receipt is not partly added
+	rates := make([]VATRate, len(vats))
+	for i, vat := range vats {
+		rate, ok := table.Rate(vat.VATRATE, date)
+		if !ok {
+			return fmt.Errorf("%w: %q in receipt %d", ErrUnknownVATRate, vat.VATRATE, gc)
+		}
+		rates[i] = rate
+	}
+	for _, payment := range payments {
+		if !slices.Contains(paymentTypes, PaymentType(payment.PMTTYPE)) {
+			return fmt.Errorf("%w: %q in receipt %d", ErrUnknownPaymentType, payment.PMTTYPE, gc)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.seen[gc] {
+		return fmt.Errorf("%w: GC %d", ErrDuplicateReceipt, gc)
+	}
+	a.seen[gc] = true
+
+	a.total = a.total.Add(totals.TOTALTAXINCL)
+	a.gross = a.gross.Add(totals.TOTALTAXINCL)
+	a.discounts = a.discounts.Add(totals.DISCOUNT)
+	a.tickets++
+
+	for i, vat := range vats {
+		id := reportTaxRateID(rates[i].ID, rates[i].Percentage)
+		sum, ok := a.vats[id]
+		if !ok {
+			sum = &VATTOTAL{ID: rates[i].ID, Rate: rates[i].Percentage}
+			a.vats[id] = sum
+		}
+		sum.NetAmount = sum.NetAmount.Add(vat.NETTAMOUNT)
+		sum.TaxAmount = sum.TaxAmount.Add(vat.TAXAMOUNT)
+	}
+
+	for _, payment := range payments {
+		pType := PaymentType(payment.PMTTYPE)
+		a.payments[pType] = a.payments[pType].Add(payment.PMTAMOUNT)
+	}
+
+	return nil
+}
+
+// Report returns the Z report of the receipts added so far. VATS and Payment
+// only have the groups and payment types that were used, in the order they
+// appear in the report. A group taxed at two rates during the day, because its
+// rate changed, is listed once per rate.
+func (a *DailyAggregator) Report(params *ReportParams, address *Address) *ReportRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	vats := make([]VATTOTAL, 0, len(a.vats))
+	for _, sum := range a.vats {
+		vats = append(vats, *sum)
+	}
+	sortVATTotals(vats)
+
+	var payments []Payment
+	for _, pType := range paymentTypes {
+		if amount, ok := a.payments[pType]; ok {
+			payments = append(payments, Payment{Type: pType, Amount: amount})
+		}
+	}
+
+	return &ReportRequest{
+		Params:  params,
+		Address: address,
+		Totals: &ReportTotals{
+			DailyTotalAmount: a.total,
+			Gross:            a.gross,
+			Discounts:        a.discounts,
+			TicketsFiscal:    a.tickets,
+		},
+		VATS:    vats,
+		Payment: payments,
+	}
+}
+
+// Gross returns the running total of the sales including the receipts added so far.
+func (a *DailyAggregator) Gross() money.Money {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.gross
+}
+
+// Reset starts a new day, the Gross is carried over.
+func (a *DailyAggregator) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reset(a.gross)
+}
+
+func (a *DailyAggregator) reset(gross money.Money) {
+	a.gross = gross
+	a.total = money.Zero
+	a.discounts = money.Zero
+	a.tickets = 0
+	a.vats = make(map[string]*VATTOTAL)
+	a.payments = make(map[PaymentType]money.Money)
+	a.seen = make(map[int64]bool)
+}
+
+// sortVATTotals sorts VAT totals by group in the order A, B, C, D, E and then by rate.
+func sortVATTotals(vats []VATTOTAL) {
+	order := func(id string) int {
+		for i, vatID := range vatIDs {
+			if vatID == id {
+				return i
+			}
+		}
+		return len(vatIDs)
+	}
+	sort.Slice(vats, func(i, j int) bool {
+		if vats[i].ID != vats[j].ID {
+			return order(vats[i].ID) < order(vats[j].ID)
+		}
+		return vats[i].Rate < vats[j].Rate
+	})
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+func TestDailyAggregator(t *testing.T) {
+	t.Parallel()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipts := []*ReceiptRequest{
+		{
+			Params:   ReceiptParams{GlobalCounter: 101, DailyCounter: 1},
+			Customer: Customer{Type: NonCustomerID},
+			Items: []Item{
+				NewItem("1", "Sugar", StandardVATCODE, 2, 5900, 0),
+				NewItem("2", "Bread", ExemptedVATCODE, 1, 2000, 0),
+			},
+			Payments: []Payment{NewPayment(CashPaymentType, 13800)},
+		},
+		{
+			Params:   ReceiptParams{GlobalCounter: 102, DailyCounter: 2},
+			Customer: Customer{Type: NonCustomerID},
+			Items: []Item{
+				NewItem("1", "Sugar", StandardVATCODE, 1, 5900, 900),
+			},
+			Payments: []Payment{
+				NewPayment(ElectronicPaymentType, 3000),
+				NewPayment(CashPaymentType, 2000),
+			},
+		},
+	}
+
+	want := &ReportRequest{
+		Totals: &ReportTotals{
+			DailyTotalAmount: money.MustParse("18800.00"),
+			Gross:            money.MustParse("1018800.00"),
+			Discounts:        money.MustParse("900.00"),
+			TicketsFiscal:    2,
+		},
+		VATS: []VATTOTAL{
+			{ID: "A", Rate: 18, NetAmount: money.MustParse("14237.29"), TaxAmount: money.MustParse("2562.71")},
+			{ID: "E", Rate: 0, NetAmount: money.MustParse("2000.00"), TaxAmount: money.Zero},
+		},
+		Payment: []Payment{
+			NewPayment(CashPaymentType, 15800),
+			NewPayment(ElectronicPaymentType, 3000),
+		},
+	}
+
+	// the same receipts added as requests and as signed payloads give the same report
+	fromRequests := NewDailyAggregator(money.MustParse("1000000.00"))
+	fromSigned := NewDailyAggregator(money.MustParse("1000000.00"))
+	for _, receipt := range receipts {
+		if err := fromRequests.Add(receipt); err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := ReceiptBytesWithOptions(privateKey, receipt.Params, receipt.Customer,
+			receipt.Items, receipt.Payments, receipt.Options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := ParseReceipt(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fromSigned.AddSigned(signed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, aggregator := range map[string]*DailyAggregator{"requests": fromRequests, "signed": fromSigned} {
+		if got := aggregator.Report(nil, nil); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Report() = %+v, want %+v", name, got, want)
+		}
+	}
+
+	if err := fromRequests.Add(receipts[0]); !errors.Is(err, ErrDuplicateReceipt) {
+		t.Errorf("Add() duplicate error = %v, want %v", err, ErrDuplicateReceipt)
+	}
+
+	fromRequests.Reset()
+	got := fromRequests.Report(nil, nil)
+	if got.Totals.Gross != want.Totals.Gross || !got.Totals.DailyTotalAmount.IsZero() ||
+		got.Totals.TicketsFiscal != 0 || len(got.VATS) != 0 || len(got.Payment) != 0 {
+		t.Errorf("Report() after Reset() = %+v, want only the gross carried over", got.Totals)
+	}
+	if err := fromRequests.Add(receipts[0]); err != nil {
+		t.Errorf("Add() after Reset() error = %v", err)
+	}
+}
+
+func TestDailyAggregator_ReceiptVATTable(t *testing.T) {
+	t.Parallel()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := NewVATTable()
+	if err := table.Set(VATRate{ID: StandardVATID, Percentage: 16}); err != nil {
+		t.Fatal(err)
+	}
+	receipt := &ReceiptRequest{
+		Params:   ReceiptParams{GlobalCounter: 101, DailyCounter: 1, Date: "2025-07-01"},
+		Customer: Customer{Type: NonCustomerID},
+		Items:    []Item{NewItem("1", "Sugar", StandardVATCODE, 2, 5800, 0)},
+		Payments: []Payment{NewPayment(CashPaymentType, 11600)},
+		Options:  ReceiptOptions{VATTable: table},
+	}
+	want := []VATTOTAL{
+		{ID: "A", Rate: 16, NetAmount: money.MustParse("10000.00"), TaxAmount: money.MustParse("1600.00")},
+	}
+
+	fromRequest := NewDailyAggregator(money.Zero)
+	if err := fromRequest.Add(receipt); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := ReceiptBytesWithOptions(privateKey, receipt.Params, receipt.Customer,
+		receipt.Items, receipt.Payments, receipt.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ParseReceipt(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromSigned := NewDailyAggregator(money.Zero)
+	if err := fromSigned.AddSignedWithOptions(signed, receipt.Options); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, aggregator := range map[string]*DailyAggregator{"request": fromRequest, "signed": fromSigned} {
+		if got := aggregator.Report(nil, nil).VATS; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Report() VATS = %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+func TestDailyAggregator_UnknownPaymentType(t *testing.T) {
+	t.Parallel()
+	aggregator := NewDailyAggregator(money.Zero)
+	receipt := &ReceiptRequest{
+		Params:   ReceiptParams{GlobalCounter: 101, DailyCounter: 1},
+		Items:    []Item{NewItem("1", "Sugar", StandardVATCODE, 1, 5900, 0)},
+		Payments: []Payment{NewPayment("MPESA", 5900)},
+	}
+
+	if err := aggregator.Add(receipt); !errors.Is(err, ErrUnknownPaymentType) {
+		t.Fatalf("Add() error = %v, want %v", err, ErrUnknownPaymentType)
+	}
+	// the receipt is not partly added and can be added once corrected
+	if got := aggregator.Report(nil, nil); got.Totals.TicketsFiscal != 0 || !got.Totals.DailyTotalAmount.IsZero() {
+		t.Errorf("Report() after a rejected receipt = %+v, want nothing added", got.Totals)
+	}
+	receipt.Payments = []Payment{NewPayment(ElectronicPaymentType, 5900)}
+	if err := aggregator.Add(receipt); err != nil {
+		t.Errorf("Add() corrected receipt error = %v", err)
+	}
+}
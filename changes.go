@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/Golang-Tanzania/tra-vfd/internal/fileutil"
+)
+
+// ErrChangesNotFound is returned by a ChangeStore when nothing has been saved.
+var ErrChangesNotFound = errors.New("changes not found")
+
+type (
+	// ChangeState is the persisted state of a ChangeTracker, the change counters
+	// and the header lines and VRN of the last Z report.
+	ChangeState struct {
+		VATChangeNum    int64    `json:"vat_change_num"`
+		HeaderChangeNum int64    `json:"header_change_num"`
+		Header          []string `json:"header"`
+		VRN             string   `json:"vrn"`
+	}
+
+	// ChangeStore persists ChangeState. LoadChanges returns ErrChangesNotFound
+	// when nothing has been saved yet.
+	ChangeStore interface {
+		LoadChanges(ctx context.Context) (*ChangeState, error)
+		SaveChanges(ctx context.Context, state *ChangeState) error
+	}
+
+	// ChangeTracker keeps the VATCHANGENUM and HEADCHANGENUM of the Z reports.
+	// The VAT counter goes up when the VRN changes, for example when the business
+	// registers for VAT, and the header counter when the header lines change. It
+	// is safe for concurrent use.
+	ChangeTracker struct {
+		mu    sync.Mutex
+		store ChangeStore
+	}
+
+	// FileChangeStore saves the ChangeState as JSON in a file. The file is
+	// replaced atomically on every save.
+	FileChangeStore struct {
+		Path string
+	}
+)
+
+// NewChangeTracker creates a ChangeTracker that saves the counters in store.
+func NewChangeTracker(store ChangeStore) *ChangeTracker {
+	return &ChangeTracker{store: store}
+}
+
+// Apply compares the VRN and the header of the report with the ones of the
+// previous report, counts the changes and sets the counters in report.Options.
+// The header is only compared when the report has an Address or header lines.
+// Applying the same report again does not count its changes twice, so it can
+// be called again when a submission is retried.
+func (t *ChangeTracker) Apply(ctx context.Context, report *ReportRequest) error {
+	if report.Params == nil {
+		return ErrZReportNotBuilt
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, err := t.store.LoadChanges(ctx)
+	if err != nil && !errors.Is(err, ErrChangesNotFound) {
+		return fmt.Errorf("could not load changes: %w", err)
+	}
+
+	var header []string
+	if report.Address != nil || len(report.Options.Header) > 0 {
+		var address Address
+		if report.Address != nil {
+			address = *report.Address
+		}
+		header = report.Options.header(address)
+	}
+
+	next := &ChangeState{VRN: report.Params.VRN, Header: header}
+	if state != nil {
+		next.VATChangeNum = state.VATChangeNum
+		next.HeaderChangeNum = state.HeaderChangeNum
+		if state.VRN != next.VRN {
+			next.VATChangeNum++
+		}
+		switch {
+		case header == nil:
+			next.Header = state.Header
+		case state.Header != nil && !slices.Equal(state.Header, header):
+			next.HeaderChangeNum++
+		}
+	}
+
+	if state == nil || !equalChanges(state, next) {
+		if err := t.store.SaveChanges(ctx, next); err != nil {
+			return fmt.Errorf("could not save changes: %w", err)
+		}
+	}
+
+	report.Options.VATChangeNum = next.VATChangeNum
+	report.Options.HeaderChangeNum = next.HeaderChangeNum
+
+	return nil
+}
+
+func equalChanges(a, b *ChangeState) bool {
+	return a.VATChangeNum == b.VATChangeNum && a.HeaderChangeNum == b.HeaderChangeNum &&
+		a.VRN == b.VRN && slices.Equal(a.Header, b.Header)
+}
+
+// NewFileChangeStore creates a FileChangeStore that saves the state in path.
+func NewFileChangeStore(path string) *FileChangeStore {
+	return &FileChangeStore{Path: path}
+}
+
+func (f *FileChangeStore) LoadChanges(_ context.Context) (*ChangeState, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrChangesNotFound
+		}
+		return nil, fmt.Errorf("could not read changes file: %w", err)
+	}
+
+	state := new(ChangeState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not decode changes file: %w", err)
+	}
+
+	return state, nil
+}
+
+func (f *FileChangeStore) SaveChanges(_ context.Context, state *ChangeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not encode changes: %w", err)
+	}
+	return fileutil.WriteAtomic(f.Path, data, 0o600)
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChangeTracker(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tracker := NewChangeTracker(NewFileChangeStore(filepath.Join(t.TempDir(), "changes.json")))
+
+	shop := &Address{Name: "Baba Edgar", Street: "Mwenge", Mobile: "0713000000", City: "Dar es Salaam", Country: "Tanzania"}
+	moved := &Address{Name: "Baba Edgar", Street: "Kariakoo", Mobile: "0713000000", City: "Dar es Salaam", Country: "Tanzania"}
+
+	steps := []struct {
+		name       string
+		vrn        string
+		address    *Address
+		header     []string
+		wantVAT    int64
+		wantHeader int64
+	}{
+		{name: "first report", vrn: "NOT REGISTERED", address: shop},
+		{name: "no changes", vrn: "NOT REGISTERED", address: shop},
+		{name: "registered for VAT", vrn: "40-005000-Z", address: shop, wantVAT: 1},
+		{name: "retried", vrn: "40-005000-Z", address: shop, wantVAT: 1},
+		{name: "moved", vrn: "40-005000-Z", address: moved, wantVAT: 1, wantHeader: 1},
+		{name: "without a header", vrn: "40-005000-Z", wantVAT: 1, wantHeader: 1},
+		{name: "custom header", vrn: "40-005000-Z", address: moved, header: []string{"BABA EDGAR"}, wantVAT: 1, wantHeader: 2},
+	}
+
+	for _, step := range steps {
+		report := &ReportRequest{
+			Params:  &ReportParams{VRN: step.vrn},
+			Address: step.address,
+			Options: ReportOptions{Header: step.header},
+		}
+		if err := tracker.Apply(ctx, report); err != nil {
+			t.Fatalf("%s: Apply() error = %v", step.name, err)
+		}
+		if report.Options.VATChangeNum != step.wantVAT || report.Options.HeaderChangeNum != step.wantHeader {
+			t.Errorf("%s: VATChangeNum, HeaderChangeNum = %d, %d, want %d, %d", step.name,
+				report.Options.VATChangeNum, report.Options.HeaderChangeNum, step.wantVAT, step.wantHeader)
+		}
+	}
+}
+
+func TestReportBytesWithOptions(t *testing.T) {
+	t.Parallel()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, address, vats, payments, totals := goldenReport()
+	tests := []struct {
+		name       string
+		opts       ReportOptions
+		wantHeader []string
+		wantValues []string
+	}{
+		{
+			name:       "defaults",
+			wantHeader: address.AsList(),
+			wantValues: []string{"WEBAPI", "3.0", "WEBAPI", "0", "0", ""},
+		},
+		{
+			name: "options",
+			opts: ReportOptions{
+				SIMIMSI:          "640040000000000",
+				FirmwareVersion:  "3.1",
+				FirmwareChecksum: "5f2b",
+				Header:           []string{"BABA EDGAR", "KARIAKOO"},
+				VATChangeNum:     1,
+				HeaderChangeNum:  2,
+				Errors:           "PRINTER",
+			},
+			wantHeader: []string{"BABA EDGAR", "KARIAKOO"},
+			wantValues: []string{"640040000000000", "3.1", "5f2b", "1", "2", "PRINTER"},
+		},
+	}
+
+	for _, tt := range tests {
+		payload, err := ReportBytesWithOptions(privateKey, params, address, vats, payments, totals, tt.opts)
+		if err != nil {
+			t.Fatalf("%s: ReportBytesWithOptions() error = %v", tt.name, err)
+		}
+		signed, err := ParseReport(payload)
+		if err != nil {
+			t.Fatalf("%s: ParseReport() error = %v", tt.name, err)
+		}
+
+		report := signed.Report
+		got := []string{
+			report.SIMIMSI, report.FWVERSION, report.FWCHECKSUM,
+			report.CHANGES.VATCHANGENUM, report.CHANGES.HEADCHANGENUM, report.ERRORS,
+		}
+		if !reflect.DeepEqual(got, tt.wantValues) {
+			t.Errorf("%s: SIMIMSI, FWVERSION, FWCHECKSUM, CHANGES, ERRORS = %q, want %q", tt.name, got, tt.wantValues)
+		}
+		if !reflect.DeepEqual(report.HEADER.LINE, tt.wantHeader) {
+			t.Errorf("%s: HEADER = %q, want %q", tt.name, report.HEADER.LINE, tt.wantHeader)
+		}
+	}
+}
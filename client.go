@@ -24,12 +24,48 @@ package vfd
 import (
 	"context"
 	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+
+	xhttp "github.com/Golang-Tanzania/tra-vfd/internal/http"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/env"
 )
 
+// ErrClientNotConfigured is returned by RegisterDevice, Receipt and Report when
+// an option they depend on was not given to NewClient.
+var ErrClientNotConfigured = errors.New("client is not configured")
+
 type (
+	// Client sends requests to the VFD server. The methods that take a url, a
+	// private key and headers can be used with any configuration. RegisterDevice,
+	// Receipt and Report use the environment, certificate, credentials and
+	// device profile given to NewClient instead.
 	Client struct {
-		http *http.Client
+		http       *http.Client
+		serverKey  *rsa.PublicKey
+		validation ValidationMode
+		retry      RetryPolicy
+		tokenCodes []int64
+
+		env         env.Env
+		urls        *URL
+		privateKey  *rsa.PrivateKey
+		certificate *x509.Certificate
+		certErr     error
+		certSerial  string
+		tin         string
+		certKey     string
+		tokenOpts   []TokenManagerOption
+		vatTable    *VATTable
+
+		// mu guards the fields that change after registration
+		mu        sync.Mutex
+		profile   *DeviceProfile
+		tokens    TokenSource
+		ownTokens bool
 	}
 
 	Option func(*Client)
@@ -41,6 +77,139 @@ func WithHttpClient(http *http.Client) Option {
 	}
 }
 
+// WithServerPublicKey enables verification of the EFDMSSIGNATURE of every
+// response from the VFD server using the given public key. Responses with a
+// missing or wrong signature are rejected with ErrInvalidServerSignature.
+func WithServerPublicKey(key *rsa.PublicKey) Option {
+	return func(c *Client) {
+		c.serverKey = key
+	}
+}
+
+// WithServerCertificate is like WithServerPublicKey but takes the public key
+// from the certificate issued by TRA. Certificates that do not hold an RSA
+// public key are ignored.
+func WithServerCertificate(cert *x509.Certificate) Option {
+	return func(c *Client) {
+		if cert == nil {
+			return
+		}
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			c.serverKey = key
+		}
+	}
+}
+
+// WithValidationMode sets how receipts are validated before they are submitted.
+// The default is ValidationLenient.
+func WithValidationMode(mode ValidationMode) Option {
+	return func(c *Client) {
+		c.validation = mode
+	}
+}
+
+// WithRetryPolicy makes the client repeat requests that fail in a way that is
+// safe to retry, see RetryPolicy. By default requests are not retried.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// WithTokenAckCodes lists the ACK codes with which the VFD server rejects the
+// bearer token in an otherwise successful response. They are handled like the
+// 401 and 403 statuses: a new token is fetched and the request is sent once
+// more. The ACK code table published by TRA has no such code, so there are none
+// by default.
+func WithTokenAckCodes(codes ...int64) Option {
+	return func(c *Client) {
+		c.tokenCodes = append(c.tokenCodes, codes...)
+	}
+}
+
+// WithEnv selects the VFD server environment, env.PROD for production and the
+// testing server otherwise.
+func WithEnv(e env.Env) Option {
+	return func(c *Client) {
+		c.env = e
+	}
+}
+
+// WithURLs replaces the URLs chosen by WithEnv, for example to use a fake server.
+func WithURLs(urls URL) Option {
+	return func(c *Client) {
+		c.urls = &urls
+	}
+}
+
+// WithCertificate loads the PKCS#12 certificate issued by TRA, its private key
+// signs every request and its serial number is sent in the Cert-Serial header
+// unless WithCertSerial or the device profile sets one. The file is read right
+// away, an error is reported by the first method that needs the key.
+func WithCertificate(path, password string) Option {
+	return func(c *Client) {
+		c.privateKey, c.certificate, c.certErr = LoadCert(path, password)
+	}
+}
+
+// WithPrivateKey sets the key used to sign requests, instead of WithCertificate.
+func WithPrivateKey(key *rsa.PrivateKey) Option {
+	return func(c *Client) {
+		c.privateKey, c.certErr = key, nil
+	}
+}
+
+// WithCertSerial sets the serial of the certificate sent in the Cert-Serial
+// header. It defaults to the CertSerial of the device profile and then to the
+// serial number of the certificate given to WithCertificate.
+func WithCertSerial(serial string) Option {
+	return func(c *Client) {
+		c.certSerial = serial
+	}
+}
+
+// WithVATTable sets the rates Receipt and Report use for requests without a
+// VATTable in their options. By default, the built-in rates of NewVATTable are
+// used.
+func WithVATTable(table *VATTable) Option {
+	return func(c *Client) {
+		c.vatTable = table
+	}
+}
+
+// WithCredentials sets the TIN and CERTKEY used by RegisterDevice.
+func WithCredentials(tin, certKey string) Option {
+	return func(c *Client) {
+		c.tin = tin
+		c.certKey = certKey
+	}
+}
+
+// WithDeviceProfile sets the registration details of the device. The username
+// and password in it are used to fetch tokens. RegisterDevice replaces it.
+func WithDeviceProfile(profile *DeviceProfile) Option {
+	return func(c *Client) {
+		c.profile = profile
+	}
+}
+
+// WithTokenSource sets where the bearer tokens come from. By default a
+// TokenManager is created from the credentials in the device profile.
+func WithTokenSource(source TokenSource) Option {
+	return func(c *Client) {
+		c.tokens = source
+		c.ownTokens = false
+	}
+}
+
+// WithTokenManagerOptions sets options of the TokenManager created from the
+// device profile, for example WithTokenStore to keep tokens across restarts.
+func WithTokenManagerOptions(options ...TokenManagerOption) Option {
+	return func(c *Client) {
+		c.tokenOpts = append(c.tokenOpts, options...)
+	}
+}
+
 // SetHttpClient sets the http client
 func (c *Client) SetHttpClient(http *http.Client) {
 	if http != nil {
@@ -58,16 +227,18 @@ func NewClient(options ...Option) *Client {
 	return client
 }
 
+// defaultClient returns the Client used by the package level functions.
+func defaultClient() *Client {
+	return &Client{
+		http: xhttp.Instance(),
+	}
+}
+
 func (c *Client) Register(ctx context.Context,
 	url string, privateKey *rsa.PrivateKey,
 	request *RegistrationRequest,
 ) (*RegistrationResponse, error) {
-	response, err := register(ctx, c.http, url, privateKey, request)
-	if err != nil {
-		return nil, err
-	}
-
-	return response, nil
+	return register(ctx, c, url, privateKey, request)
 }
 
 func (c *Client) FetchToken(ctx context.Context, url string,
@@ -99,7 +270,15 @@ func (c *Client) SubmitReceipt(
 	privateKey *rsa.PrivateKey,
 	receipt *ReceiptRequest,
 ) (*Response, error) {
-	return submitReceipt(ctx, c.http, url, headers, privateKey, receipt)
+	return submitReceipt(ctx, c, url, headers, privateKey, receipt)
+}
+
+// SubmitPayload submits a receipt or a Z report that is already signed,
+// see SubmitPayload.
+func (c *Client) SubmitPayload(ctx context.Context, url string, headers *RequestHeaders,
+	action Action, payload []byte,
+) (*Response, error) {
+	return submitPayload(ctx, c, url, headers, action, payload, "payload submit")
 }
 
 func (c *Client) SubmitReport(
@@ -109,5 +288,187 @@ func (c *Client) SubmitReport(
 	privateKey *rsa.PrivateKey,
 	report *ReportRequest,
 ) (*Response, error) {
-	return submitReport(ctx, c.http, url, headers, privateKey, report)
+	return submitReport(ctx, c, url, headers, privateKey, report)
+}
+
+// Profile returns the device profile, as given by WithDeviceProfile or as
+// received by RegisterDevice.
+func (c *Client) Profile() *DeviceProfile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.profile
+}
+
+// RegisterDevice registers the device using the credentials given by
+// WithCredentials and keeps the response as the device profile used by
+// Receipt and Report.
+func (c *Client) RegisterDevice(ctx context.Context) (*RegistrationResponse, error) {
+	key, err := c.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	if c.tin == "" || c.certKey == "" {
+		return nil, fmt.Errorf("%w: WithCredentials is required to register", ErrClientNotConfigured)
+	}
+
+	c.mu.Lock()
+	certSerial := c.certSerialLocked()
+	c.mu.Unlock()
+	if certSerial == "" {
+		return nil, fmt.Errorf("%w: WithCertSerial or WithCertificate is required to register",
+			ErrClientNotConfigured)
+	}
+
+	response, err := register(ctx, c, c.requestURL(RegisterClientAction), key, &RegistrationRequest{
+		ContentType: ContentTypeXML,
+		CertSerial:  certSerial,
+		Tin:         c.tin,
+		CertKey:     c.certKey,
+	})
+	if err != nil {
+		return response, err
+	}
+
+	profile := NewDeviceProfile(response)
+	profile.CertSerial = certSerial
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.profile = profile
+	if c.ownTokens {
+		// the credentials may have changed
+		c.tokens = nil
+	}
+
+	return response, nil
+}
+
+// Receipt signs and submits a receipt, see SubmitReceipt.
+func (c *Client) Receipt(ctx context.Context, receipt *ReceiptRequest) (*Response, error) {
+	key, err := c.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	headers, err := c.headers()
+	if err != nil {
+		return nil, err
+	}
+
+	if receipt.Options.VATTable == nil && c.vatTable != nil {
+		withTable := *receipt
+		withTable.Options.VATTable = c.vatTable
+		receipt = &withTable
+	}
+
+	return submitReceipt(ctx, c, c.requestURL(SubmitReceiptAction), headers, key, receipt)
+}
+
+// Report signs and submits a Z report, see SubmitReport. The address of the
+// device profile is used when the report has none.
+func (c *Client) Report(ctx context.Context, report *ReportRequest) (*Response, error) {
+	key, err := c.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	headers, err := c.headers()
+	if err != nil {
+		return nil, err
+	}
+
+	if report.Address == nil {
+		profile := c.Profile()
+		if profile == nil {
+			return nil, fmt.Errorf("%w: the report has no address and there is no device profile",
+				ErrClientNotConfigured)
+		}
+		withAddress := *report
+		withAddress.Address = profile.NewAddress()
+		report = &withAddress
+	}
+	if report.Options.VATTable == nil && c.vatTable != nil {
+		withTable := *report
+		withTable.Options.VATTable = c.vatTable
+		report = &withTable
+	}
+
+	return submitReport(ctx, c, c.requestURL(SubmitReportAction), headers, key, report)
+}
+
+// requestURL returns the URL of the action for the configured environment.
+func (c *Client) requestURL(action Action) string {
+	if c.urls == nil {
+		return RequestURL(c.env, action)
+	}
+
+	switch action {
+	case RegisterClientAction:
+		return c.urls.Registration
+	case FetchTokenAction:
+		return c.urls.FetchToken
+	case SubmitReceiptAction:
+		return c.urls.SubmitReceipt
+	case SubmitReportAction:
+		return c.urls.SubmitReport
+	case ReceiptVerificationAction:
+		return c.urls.VerifyReceipt
+	default:
+		return ""
+	}
+}
+
+func (c *Client) signingKey() (*rsa.PrivateKey, error) {
+	if c.certErr != nil {
+		return nil, fmt.Errorf("could not load the certificate: %w", c.certErr)
+	}
+	if c.privateKey == nil {
+		return nil, fmt.Errorf("%w: WithCertificate is required to sign requests", ErrClientNotConfigured)
+	}
+	return c.privateKey, nil
+}
+
+// headers returns the headers for receipt and report submissions, creating
+// the TokenManager from the device profile the first time.
+func (c *Client) headers() (*RequestHeaders, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokens == nil {
+		if c.profile == nil {
+			return nil, fmt.Errorf("%w: WithDeviceProfile or RegisterDevice is required to fetch tokens",
+				ErrClientNotConfigured)
+		}
+		options := append([]TokenManagerOption{
+			WithTokenFetcher(func(ctx context.Context, url string, request *TokenRequest) (*TokenResponse, error) {
+				return fetchToken(ctx, c.http, url, request)
+			}),
+		}, c.tokenOpts...)
+		c.tokens = NewTokenManager(c.requestURL(FetchTokenAction), c.profile.NewTokenRequest(), options...)
+		c.ownTokens = true
+	}
+
+	certSerial := c.certSerialLocked()
+	if certSerial == "" {
+		return nil, fmt.Errorf("%w: WithCertSerial or WithCertificate is required", ErrClientNotConfigured)
+	}
+
+	return &RequestHeaders{
+		CertSerial:  certSerial,
+		TokenSource: c.tokens,
+	}, nil
+}
+
+// certSerialLocked returns the serial set with WithCertSerial, the one of the
+// device profile or the one of the certificate, in that order. Callers must
+// hold c.mu.
+func (c *Client) certSerialLocked() string {
+	switch {
+	case c.certSerial != "":
+		return c.certSerial
+	case c.profile != nil && c.profile.CertSerial != "":
+		return c.profile.CertSerial
+	case c.certificate != nil:
+		return CertSerial(c.certificate)
+	default:
+		return ""
+	}
 }
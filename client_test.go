@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/testcert"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/vfdtest"
+)
+
+func TestClient_Configured(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cert-Serial") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`<EFDMS><EFDMSRESP><ACKCODE>0</ACKCODE><ACKMSG>Registration Successful</ACKMSG>` +
+			`<REGID>TZ0100553997</REGID><SERIAL>10TZ101807</SERIAL><TIN>100553997</TIN>` +
+			`<STREET>MAGOMENI</STREET><CITY>DAR ES SALAAM</CITY><COUNTRY>TANZANIA</COUNTRY><NAME>XYZ LTD</NAME>` +
+			`<RECEIPTCODE>55B8C5</RECEIPTCODE><ROUTINGKEY>vfdrct</ROUTINGKEY><GC>100</GC>` +
+			`<USERNAME>babaEdgar</USERNAME><PASSWORD>SuperSecret</PASSWORD></EFDMSRESP>` +
+			`<EFDMSSIGNATURE>x</EFDMSSIGNATURE></EFDMS>`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("username") != "babaEdgar" || r.FormValue("password") != "SuperSecret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		atomic.AddInt64(&tokens, 1)
+		_, _ = w.Write([]byte(`{"access_token":"token-1","token_type":"bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("/receipt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "bearer token-1" || r.Header.Get("Cert-Serial") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`<EFDMS><RCTACK><RCTNUM>101</RCTNUM><DATE>2023-01-01</DATE><TIME>08:00:00</TIME>` +
+			`<ACKCODE>0</ACKCODE><ACKMSG>Success</ACKMSG></RCTACK><EFDMSSIGNATURE>x</EFDMSSIGNATURE></EFDMS>`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	urls := vfd.URL{
+		Registration:  server.URL + "/register",
+		FetchToken:    server.URL + "/token",
+		SubmitReceipt: server.URL + "/receipt",
+		SubmitReport:  server.URL + "/report",
+	}
+
+	ctx := context.Background()
+
+	unconfigured := vfd.NewClient(vfd.WithHttpClient(server.Client()), vfd.WithURLs(urls))
+	if _, err := unconfigured.Receipt(ctx, validReceipt()); !errors.Is(err, vfd.ErrClientNotConfigured) {
+		t.Errorf("Receipt() without a certificate error = %v, want %v", err, vfd.ErrClientNotConfigured)
+	}
+
+	client := vfd.NewClient(
+		vfd.WithHttpClient(server.Client()),
+		vfd.WithURLs(urls),
+		vfd.WithPrivateKey(key),
+		vfd.WithCertSerial("7d2a0f1c"),
+		vfd.WithCredentials("100553997", "10TZ101807"),
+	)
+	if _, err := client.Receipt(ctx, validReceipt()); !errors.Is(err, vfd.ErrClientNotConfigured) {
+		t.Errorf("Receipt() before registration error = %v, want %v", err, vfd.ErrClientNotConfigured)
+	}
+
+	registration, err := client.RegisterDevice(ctx)
+	if err != nil {
+		t.Fatalf("RegisterDevice() error = %v", err)
+	}
+	profile := client.Profile()
+	if profile == nil || profile.RegistrationID != registration.REGID || profile.CertSerial != "7d2a0f1c" {
+		t.Fatalf("Profile() = %+v", profile)
+	}
+
+	for i := 0; i < 2; i++ {
+		response, err := client.Receipt(ctx, validReceipt())
+		if err != nil {
+			t.Fatalf("Receipt() error = %v", err)
+		}
+		if response.Code != vfd.SuccessCode || response.Number != 101 {
+			t.Errorf("Receipt() = %+v", response)
+		}
+	}
+	if n := atomic.LoadInt64(&tokens); n != 1 {
+		t.Errorf("fetched %d tokens, want 1", n)
+	}
+}
+
+func TestClient_CertSerialFromCertificate(t *testing.T) {
+	t.Parallel()
+	cert, err := testcert.SelfSigned("VFD device", testcert.WithSerialNumber(big.NewInt(0x7d2a0f1c58e64b3a)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cert.pfx")
+	if err := cert.WritePFX(path, "secret", false); err != nil {
+		t.Fatal(err)
+	}
+
+	var serial string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decoded, _ := base64.StdEncoding.DecodeString(r.Header.Get("Cert-Serial"))
+		serial = string(decoded)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client := vfd.NewClient(
+		vfd.WithHttpClient(server.Client()),
+		vfd.WithURLs(vfd.URL{Registration: server.URL}),
+		vfd.WithCertificate(path, "secret"),
+		vfd.WithCredentials("100553997", "10TZ101807"),
+		vfd.WithRetryPolicy(vfd.RetryPolicy{}),
+	)
+	if _, err := client.RegisterDevice(context.Background()); errors.Is(err, vfd.ErrClientNotConfigured) {
+		t.Fatalf("RegisterDevice() error = %v, want the serial of the certificate to be used", err)
+	}
+	if serial != "7d2a0f1c58e64b3a" {
+		t.Errorf("Cert-Serial = %q, want the serial number of the certificate", serial)
+	}
+}
+
+func TestClient_VATTable(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := vfdtest.NewServer(vfdtest.WithClientKey(&key.PublicKey))
+	defer server.Close()
+
+	table := vfd.NewVATTable()
+	if err := table.Set(vfd.VATRate{ID: vfd.StandardVATID, Percentage: 16}); err != nil {
+		t.Fatal(err)
+	}
+	client := vfd.NewClient(
+		vfd.WithHttpClient(server.Client()),
+		vfd.WithURLs(server.URLs()),
+		vfd.WithRetryPolicy(vfd.RetryPolicy{}),
+		vfd.WithPrivateKey(key),
+		vfd.WithCertSerial(vfdtest.DefaultCertSerial),
+		vfd.WithCredentials(vfdtest.DefaultTIN, vfdtest.DefaultCertKey),
+		vfd.WithVATTable(table),
+	)
+
+	ctx := context.Background()
+	if _, err := client.RegisterDevice(ctx); err != nil {
+		t.Fatalf("RegisterDevice() error = %v", err)
+	}
+	receipt := validReceipt()
+	receipt.Items = []vfd.Item{vfd.NewItem("1", "Sugar", vfd.StandardVATCODE, 2, 5800, 0)}
+	receipt.Payments = []vfd.Payment{vfd.NewPayment(vfd.CashPaymentType, 11600)}
+	if _, err := client.Receipt(ctx, receipt); err != nil {
+		t.Fatalf("Receipt() error = %v", err)
+	}
+
+	receipts := server.Receipts()
+	if len(receipts) != 1 {
+		t.Fatalf("Receipts() = %d, want 1", len(receipts))
+	}
+	if vat := receipts[0].Receipt.VATTOTALS.VATTOTAL[0]; vat.TAXAMOUNT.String() != "1600.00" {
+		t.Errorf("TAXAMOUNT = %s, want 1600.00 at the rate of the client table", vat.TAXAMOUNT)
+	}
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+)
+
+const redacted = "********"
+
+type (
+	signResult struct {
+		Element   string `json:"element,omitempty"`
+		Signature string `json:"signature"`
+	}
+
+	verifyResult struct {
+		Type    string `json:"type"`
+		GC      int64  `json:"gc,omitempty"`
+		DC      int64  `json:"dc,omitempty"`
+		ZNumber string `json:"znumber,omitempty"`
+		Valid   bool   `json:"valid"`
+	}
+
+	linkResult struct {
+		Link string `json:"link"`
+	}
+)
+
+func register(ctx context.Context, c *cli, args []string) (any, error) {
+	fs, load := c.flags()
+	save := fs.String("save", "", "write the device profile to this path, encrypted with -profile-key")
+	cfg, err := c.parse(fs, load, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CertPath == "" || cfg.CertSerial == "" || cfg.TIN == "" || cfg.CertKey == "" {
+		return nil, errors.New("-cert, -cert-serial, -tin and -cert-key are required to register")
+	}
+
+	client := vfd.NewClient(
+		vfd.WithURLs(cfg.urls()),
+		vfd.WithRetryPolicy(vfd.DefaultRetryPolicy),
+		vfd.WithCertificate(cfg.CertPath, cfg.CertPassword),
+		vfd.WithCertSerial(cfg.CertSerial),
+		vfd.WithCredentials(cfg.TIN, cfg.CertKey),
+	)
+	response, err := client.RegisterDevice(ctx)
+	if response == nil {
+		return nil, err
+	}
+
+	output := *response
+	output.PASSWORD = redacted
+	if err != nil {
+		return &output, err
+	}
+
+	if *save != "" {
+		key, err := cfg.profileKey()
+		if err != nil {
+			return &output, err
+		}
+		if err := vfd.SaveDeviceProfile(*save, client.Profile(), key); err != nil {
+			return &output, fmt.Errorf("registered but could not save the device profile: %w", err)
+		}
+	}
+
+	return &output, nil
+}
+
+func token(ctx context.Context, c *cli, args []string) (any, error) {
+	fs, load := c.flags()
+	cfg, err := c.parse(fs, load, args)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := cfg.profile()
+	if err != nil {
+		return nil, err
+	}
+	request, err := cfg.tokenRequest(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := vfd.NewClient().FetchToken(ctx, cfg.urls().FetchToken, request)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func submitReceipt(ctx context.Context, c *cli, args []string) (any, error) {
+	return submit(ctx, c, args, vfd.SubmitReceiptAction)
+}
+
+func submitReport(ctx context.Context, c *cli, args []string) (any, error) {
+	return submit(ctx, c, args, vfd.SubmitReportAction)
+}
+
+// submit pushes a signed receipt or Z report file to the VFD server as is.
+func submit(ctx context.Context, c *cli, args []string, action vfd.Action) (any, error) {
+	fs, load := c.flags()
+	file := fs.String("file", "", "signed XML file to submit")
+	cfg, err := c.parse(fs, load, args)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := readFile(*file)
+	if err != nil {
+		return nil, err
+	}
+
+	// refuse to send a file of the wrong kind
+	url := cfg.urls().SubmitReceipt
+	if action == vfd.SubmitReportAction {
+		url = cfg.urls().SubmitReport
+		_, err = vfd.ParseReport(payload)
+	} else {
+		_, err = vfd.ParseReceipt(payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := cfg.profile()
+	if err != nil {
+		return nil, err
+	}
+	request, err := cfg.tokenRequest(profile)
+	if err != nil {
+		return nil, err
+	}
+	certSerial := cfg.certSerial(profile)
+	if certSerial == "" {
+		return nil, errors.New("-cert-serial or a -profile with a certificate serial is required")
+	}
+
+	client := vfd.NewClient(vfd.WithRetryPolicy(vfd.DefaultRetryPolicy))
+	headers := &vfd.RequestHeaders{
+		CertSerial:  certSerial,
+		TokenSource: vfd.NewTokenManager(cfg.urls().FetchToken, request, vfd.WithTokenFetcher(client.FetchToken)),
+	}
+
+	response, err := client.SubmitPayload(ctx, url, headers, action, payload)
+	if response == nil {
+		return nil, err
+	}
+	return response, err
+}
+
+func sign(_ context.Context, c *cli, args []string) (any, error) {
+	fs, load := c.flags()
+	file := fs.String("file", "", "file to sign, white space around it is not signed")
+	element := fs.String("element", "", "sign only this element of the file, for example RCT or ZREPORT")
+	cfg, err := c.parse(fs, load, args)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := readFile(*file)
+	if err != nil {
+		return nil, err
+	}
+	if *element != "" {
+		if payload, err = vfd.SignedElement(payload, *element); err != nil {
+			return nil, err
+		}
+	}
+
+	key, _, err := loadCert(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := vfd.Sign(key, bytes.TrimSpace(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	return &signResult{
+		Element:   *element,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	}, nil
+}
+
+func verify(_ context.Context, c *cli, args []string) (any, error) {
+	fs, load := c.flags()
+	file := fs.String("file", "", "signed receipt or Z report file")
+	cfg, err := c.parse(fs, load, args)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := readFile(*file)
+	if err != nil {
+		return nil, err
+	}
+
+	_, cert, err := loadCert(cfg)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("the certificate does not have an RSA public key")
+	}
+
+	var result *verifyResult
+	if _, err := vfd.SignedElement(payload, "ZREPORT"); err == nil {
+		report, err := vfd.ParseReport(payload)
+		if err != nil {
+			return nil, err
+		}
+		result = &verifyResult{Type: "report", ZNumber: report.Report.ZNUMBER}
+		err = report.Verify(publicKey)
+		result.Valid = err == nil
+		return result, err
+	}
+
+	receipt, err := vfd.ParseReceipt(payload)
+	if err != nil {
+		return nil, err
+	}
+	result = &verifyResult{
+		Type:    "receipt",
+		GC:      receipt.Receipt.GC,
+		DC:      receipt.Receipt.DC,
+		ZNumber: receipt.Receipt.ZNUM,
+	}
+	err = receipt.Verify(publicKey)
+	result.Valid = err == nil
+	return result, err
+}
+
+func link(_ context.Context, c *cli, args []string) (any, error) {
+	fs, load := c.flags()
+	file := fs.String("file", "", "signed receipt to link to, instead of -gc and -time")
+	receiptCode := fs.String("receipt-code", "", "receipt code, defaults to the one in the device profile")
+	gc := fs.Int64("gc", 0, "global counter of the receipt")
+	receiptTime := fs.String("time", "", "time of the receipt, HH:MM:SS")
+	cfg, err := c.parse(fs, load, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if *file != "" {
+		payload, err := readFile(*file)
+		if err != nil {
+			return nil, err
+		}
+		receipt, err := vfd.ParseReceipt(payload)
+		if err != nil {
+			return nil, err
+		}
+		*gc = receipt.Receipt.GC
+		*receiptTime = receipt.Receipt.TIME
+		if *receiptCode == "" {
+			// RCTVNUM is the receipt code followed by the GC
+			*receiptCode = strings.TrimSuffix(receipt.Receipt.RCTVNUM, strconv.FormatInt(*gc, 10))
+		}
+	}
+
+	if *receiptCode == "" {
+		profile, err := cfg.profile()
+		if err != nil {
+			return nil, err
+		}
+		if profile != nil {
+			*receiptCode = profile.ReceiptCode
+		}
+	}
+
+	if *receiptCode == "" || *gc == 0 || *receiptTime == "" {
+		return nil, errors.New("-receipt-code, -gc and -time, or -file, are required")
+	}
+
+	return &linkResult{Link: vfd.ReceiptLink(cfg.env(), *receiptCode, *gc, *receiptTime)}, nil
+}
+
+func readFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("-file is required")
+	}
+	return os.ReadFile(path)
+}
+
+func loadCert(cfg *config) (*rsa.PrivateKey, *x509.Certificate, error) {
+	if cfg.CertPath == "" {
+		return nil, nil, errors.New("-cert is required")
+	}
+	return vfd.LoadCert(cfg.CertPath, cfg.CertPassword)
+}
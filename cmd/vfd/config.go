@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/env"
+)
+
+type (
+	// config holds the settings shared by all commands. A setting is taken from
+	// its flag, then from its environment variable and then from the JSON file
+	// given by -config or VFD_CONFIG.
+	config struct {
+		Env             string `json:"env,omitempty"`
+		CertPath        string `json:"cert_path,omitempty"`
+		CertPassword    string `json:"cert_password,omitempty"`
+		CertSerial      string `json:"cert_serial,omitempty"`
+		TIN             string `json:"tin,omitempty"`
+		CertKey         string `json:"cert_key,omitempty"`
+		ProfilePath     string `json:"profile,omitempty"`
+		ProfileKey      string `json:"profile_key,omitempty"`
+		Username        string `json:"username,omitempty"`
+		Password        string `json:"password,omitempty"`
+		RegistrationURL string `json:"registration_url,omitempty"`
+		TokenURL        string `json:"token_url,omitempty"`
+		ReceiptURL      string `json:"receipt_url,omitempty"`
+		ReportURL       string `json:"report_url,omitempty"`
+	}
+
+	setting struct {
+		name  string
+		env   string
+		usage string
+		field func(*config) *string
+	}
+)
+
+var settings = []setting{
+	{"env", "VFD_ENV", "VFD server environment: development, test, staging or production",
+		func(c *config) *string { return &c.Env }},
+	{"cert", "VFD_CERT", "path of the PKCS#12 certificate issued by TRA",
+		func(c *config) *string { return &c.CertPath }},
+	{"cert-password", "VFD_CERT_PASSWORD", "password of the certificate",
+		func(c *config) *string { return &c.CertPassword }},
+	{"cert-serial", "VFD_CERT_SERIAL", "certificate serial sent in the Cert-Serial header",
+		func(c *config) *string { return &c.CertSerial }},
+	{"tin", "VFD_TIN", "TIN of the taxpayer, used to register",
+		func(c *config) *string { return &c.TIN }},
+	{"cert-key", "VFD_CERT_KEY", "CERTKEY issued with the certificate, used to register",
+		func(c *config) *string { return &c.CertKey }},
+	{"profile", "VFD_PROFILE", "path of the saved device profile",
+		func(c *config) *string { return &c.ProfilePath }},
+	{"profile-key", "VFD_PROFILE_KEY", "base64 key that encrypts the password in the device profile",
+		func(c *config) *string { return &c.ProfileKey }},
+	{"username", "VFD_USERNAME", "token username, defaults to the one in the device profile",
+		func(c *config) *string { return &c.Username }},
+	{"password", "VFD_PASSWORD", "token password, defaults to the one in the device profile",
+		func(c *config) *string { return &c.Password }},
+	{"registration-url", "VFD_REGISTRATION_URL", "overrides the registration URL of the environment",
+		func(c *config) *string { return &c.RegistrationURL }},
+	{"token-url", "VFD_TOKEN_URL", "overrides the token URL of the environment",
+		func(c *config) *string { return &c.TokenURL }},
+	{"receipt-url", "VFD_RECEIPT_URL", "overrides the receipt URL of the environment",
+		func(c *config) *string { return &c.ReceiptURL }},
+	{"report-url", "VFD_REPORT_URL", "overrides the Z report URL of the environment",
+		func(c *config) *string { return &c.ReportURL }},
+}
+
+// configFlags registers the -config flag and a flag for every setting. The
+// returned function loads the configuration once the flags are parsed.
+func configFlags(fs *flag.FlagSet, getenv func(string) string) func() (*config, error) {
+	var (
+		path  = fs.String("config", "", "path of a JSON config file, defaults to $VFD_CONFIG")
+		flags = &config{}
+	)
+	for _, s := range settings {
+		fs.StringVar(s.field(flags), s.name, "", s.usage+" ($"+s.env+")")
+	}
+
+	return func() (*config, error) {
+		cfg := &config{}
+
+		file := *path
+		if file == "" {
+			file = getenv("VFD_CONFIG")
+		}
+		if file != "" {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("could not read config file: %w", err)
+			}
+			if err := json.Unmarshal(data, cfg); err != nil {
+				return nil, fmt.Errorf("invalid config file %s: %w", file, err)
+			}
+		}
+
+		for _, s := range settings {
+			if value := getenv(s.env); value != "" {
+				*s.field(cfg) = value
+			}
+		}
+
+		fs.Visit(func(f *flag.Flag) {
+			for _, s := range settings {
+				if s.name == f.Name {
+					*s.field(cfg) = *s.field(flags)
+				}
+			}
+		})
+
+		return cfg, nil
+	}
+}
+
+func (c *config) env() env.Env {
+	return env.Parse(c.Env)
+}
+
+// urls returns the URLs of the environment with the configured overrides.
+func (c *config) urls() vfd.URL {
+	e := c.env()
+	urls := vfd.URL{
+		Registration:  vfd.RequestURL(e, vfd.RegisterClientAction),
+		FetchToken:    vfd.RequestURL(e, vfd.FetchTokenAction),
+		SubmitReceipt: vfd.RequestURL(e, vfd.SubmitReceiptAction),
+		SubmitReport:  vfd.RequestURL(e, vfd.SubmitReportAction),
+		VerifyReceipt: vfd.RequestURL(e, vfd.ReceiptVerificationAction),
+	}
+
+	for _, override := range []struct{ value, url *string }{
+		{&c.RegistrationURL, &urls.Registration},
+		{&c.TokenURL, &urls.FetchToken},
+		{&c.ReceiptURL, &urls.SubmitReceipt},
+		{&c.ReportURL, &urls.SubmitReport},
+	} {
+		if *override.value != "" {
+			*override.url = *override.value
+		}
+	}
+
+	return urls
+}
+
+func (c *config) profileKey() ([]byte, error) {
+	if c.ProfileKey == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(c.ProfileKey)
+	if err != nil {
+		return nil, fmt.Errorf("profile key is not valid base64: %w", err)
+	}
+	return key, nil
+}
+
+// profile loads the device profile, it returns nil when no profile is configured.
+func (c *config) profile() (*vfd.DeviceProfile, error) {
+	if c.ProfilePath == "" {
+		return nil, nil
+	}
+
+	key, err := c.profileKey()
+	if err != nil {
+		return nil, err
+	}
+	return vfd.LoadDeviceProfile(c.ProfilePath, key)
+}
+
+// tokenRequest returns the token credentials from the settings or the profile.
+func (c *config) tokenRequest(profile *vfd.DeviceProfile) (*vfd.TokenRequest, error) {
+	request := &vfd.TokenRequest{GrantType: vfd.PasswordGrantType}
+	if profile != nil {
+		request = profile.NewTokenRequest()
+	}
+	if c.Username != "" {
+		request.Username = c.Username
+	}
+	if c.Password != "" {
+		request.Password = c.Password
+	}
+
+	if request.Username == "" || request.Password == "" {
+		return nil, errors.New("token credentials are required: set -username and -password or -profile")
+	}
+	return request, nil
+}
+
+// certSerial returns the configured serial or the one saved in the profile.
+func (c *config) certSerial(profile *vfd.DeviceProfile) string {
+	if c.CertSerial == "" && profile != nil {
+		return profile.CertSerial
+	}
+	return c.CertSerial
+}
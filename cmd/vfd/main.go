@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Command vfd registers devices, fetches tokens, submits signed receipt and
+// Z report files, signs and verifies payloads and prints receipt links.
+//
+// Usage:
+//
+//	vfd register [flags]
+//	vfd token [flags]
+//	vfd receipt submit -file receipt.xml [flags]
+//	vfd report submit -file report.xml [flags]
+//	vfd sign -file payload.xml [-element RCT] [flags]
+//	vfd verify -file payload.xml [flags]
+//	vfd link [-file receipt.xml | -gc N -time HH:MM:SS] [flags]
+//
+// Settings are read from flags, then from VFD_* environment variables and then
+// from the JSON file given by -config or VFD_CONFIG. Run a command with -h to
+// list them. Results are printed as JSON, errors as {"error": "..."} together
+// with the response of the VFD server when there is one, and exit with status 1.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+)
+
+const usage = `usage: vfd <command> [flags]
+
+commands:
+  register          register the device and optionally save its profile
+  token             fetch an access token
+  receipt submit    submit a signed receipt file
+  report submit     submit a signed Z report file
+  sign              sign a file or an element of it
+  verify            verify the signature of a signed receipt or Z report file
+  link              print the verification link of a receipt
+
+Run "vfd <command> -h" for the flags of a command.
+`
+
+type (
+	// command runs a subcommand. The returned value is printed as JSON, also
+	// together with the error when there is one.
+	command func(ctx context.Context, cmd *cli, args []string) (any, error)
+
+	cli struct {
+		name   string
+		stdout io.Writer
+		stderr io.Writer
+		getenv func(string) string
+	}
+
+	failure struct {
+		Error    string `json:"error"`
+		Response any    `json:"response,omitempty"`
+	}
+)
+
+var commands = map[string]command{
+	"register":       register,
+	"token":          token,
+	"receipt submit": submitReceipt,
+	"report submit":  submitReport,
+	"sign":           sign,
+	"verify":         verify,
+	"link":           link,
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr, os.Getenv)
+	stop()
+	os.Exit(code)
+}
+
+// run runs the command in args and returns the exit status.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer, getenv func(string) string) int {
+	if len(args) == 0 {
+		_, _ = fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	name, rest := args[0], args[1:]
+	if name == "receipt" || name == "report" {
+		if len(rest) == 0 || rest[0] != "submit" {
+			_, _ = fmt.Fprintf(stderr, "vfd: unknown command %q, did you mean \"%s submit\"?\n", name, name)
+			return 2
+		}
+		name, rest = name+" submit", rest[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		if name != "help" && name != "-h" && name != "--help" {
+			_, _ = fmt.Fprintf(stderr, "vfd: unknown command %q\n", name)
+		}
+		_, _ = fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	c := &cli{name: "vfd " + name, stdout: stdout, stderr: stderr, getenv: getenv}
+	result, err := cmd(ctx, c, rest)
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	case err != nil:
+		c.print(&failure{Error: err.Error(), Response: result})
+		return 1
+	default:
+		c.print(result)
+		return 0
+	}
+}
+
+// errUsage is returned when the flags of a command can not be parsed, the flag
+// package has already printed the reason.
+var errUsage = errors.New("usage")
+
+// flags returns the flag set of the command with the config flags registered.
+func (c *cli) flags() (*flag.FlagSet, func() (*config, error)) {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	return fs, configFlags(fs, c.getenv)
+}
+
+// parse parses args and loads the configuration.
+func (c *cli) parse(fs *flag.FlagSet, load func() (*config, error), args []string) (*config, error) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, errUsage
+	}
+	if fs.NArg() > 0 {
+		_, _ = fmt.Fprintf(c.stderr, "%s: unexpected arguments %v\n", c.name, fs.Args())
+		return nil, errUsage
+	}
+	return load()
+}
+
+func (c *cli) print(v any) {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		_, _ = fmt.Fprintf(c.stderr, "%s: could not encode output: %v\n", c.name, err)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/testcert"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/vfdtest"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+	cert, err := testcert.SelfSigned(vfdtest.DefaultCertKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := vfdtest.NewServer(vfdtest.WithClientKey(&cert.Key.PublicKey))
+	defer server.Close()
+
+	var (
+		dir     = t.TempDir()
+		pfx     = filepath.Join(dir, "cert.pfx")
+		profile = filepath.Join(dir, "profile.json")
+		cfgFile = filepath.Join(dir, "config.json")
+		receipt = filepath.Join(dir, "receipt.xml")
+		report  = filepath.Join(dir, "report.xml")
+		urls    = server.URLs()
+	)
+	if err := cert.WritePFX(pfx, "secret", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the config file is overridden by the environment, which is overridden by flags
+	writeJSON(t, cfgFile, &config{
+		CertPath:        pfx,
+		CertPassword:    "wrong",
+		TIN:             "100000000",
+		RegistrationURL: urls.Registration,
+		TokenURL:        urls.FetchToken,
+		ReceiptURL:      urls.SubmitReceipt,
+		ReportURL:       urls.SubmitReport,
+	})
+	environment := map[string]string{
+		"VFD_CONFIG":        cfgFile,
+		"VFD_CERT_PASSWORD": "secret",
+		"VFD_PROFILE":       profile,
+		"VFD_PROFILE_KEY":   base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)),
+	}
+	getenv := func(key string) string { return environment[key] }
+
+	var registration vfd.RegistrationResponse
+	mustRun(t, getenv, &registration, "register", "-cert-serial", vfdtest.DefaultCertSerial,
+		"-tin", vfdtest.DefaultTIN, "-cert-key", vfdtest.DefaultCertKey, "-save", profile)
+	if registration.REGID != "TZ0100553997" || registration.PASSWORD != redacted {
+		t.Errorf("register = %+v", registration)
+	}
+
+	var token vfd.TokenResponse
+	mustRun(t, getenv, &token, "token")
+	if token.AccessToken == "" || token.TokenType != "bearer" {
+		t.Errorf("token = %+v", token)
+	}
+
+	saved, err := vfd.LoadDeviceProfile(profile, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := saved.NewReceiptParams()
+	params.Date, params.Time, params.ReceiptNum = "2023-01-01", "08:15:30", "101"
+	params.DailyCounter, params.GlobalCounter, params.ZNum = 1, 101, "20230101"
+	params.ReceiptVNum = saved.ReceiptCode + "101"
+	payload, err := vfd.ReceiptBytes(cert.Key, params, vfd.Customer{Type: vfd.NonCustomerID},
+		[]vfd.Item{vfd.NewItem("1", "Item 1", vfd.TaxableItemCode, 1, 1000, 0)},
+		[]vfd.Payment{vfd.NewPayment(vfd.CashPaymentType, 1000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, receipt, payload)
+
+	var response vfd.Response
+	mustRun(t, getenv, &response, "receipt", "submit", "-file", receipt)
+	if response.Number != 101 || response.Code != vfd.SuccessCode {
+		t.Errorf("receipt submit = %+v", response)
+	}
+
+	var verified verifyResult
+	mustRun(t, getenv, &verified, "verify", "-file", receipt)
+	if !verified.Valid || verified.Type != "receipt" || verified.GC != 101 {
+		t.Errorf("verify = %+v", verified)
+	}
+
+	var signed signResult
+	mustRun(t, getenv, &signed, "sign", "-file", receipt, "-element", "RCT")
+	receiptPayload, err := vfd.ParseReceipt(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vfd.VerifySignature(&cert.Key.PublicKey, receiptPayload.Signed, signed.Signature); err != nil {
+		t.Errorf("sign returned an invalid signature: %v", err)
+	}
+
+	var linked linkResult
+	mustRun(t, getenv, &linked, "link", "-file", receipt)
+	if want := vfd.VerifyReceiptTestingURL + "55B8C5101_081530"; linked.Link != want {
+		t.Errorf("link = %s, want %s", linked.Link, want)
+	}
+
+	// a rejected report prints the error together with the response
+	reportParams := saved.NewReportParams()
+	reportParams.Date, reportParams.Time, reportParams.ZNumber = "2023-01-01", "23:59:59", "20230101"
+	payload, err = vfd.ReportBytes(cert.Key, reportParams, *saved.NewAddress(), nil, nil, vfd.ReportTotals{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, report, payload)
+	server.QueueAck(vfd.SubmitReportAction, vfd.InvalidSignatureCode)
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"report", "submit", "-file", report}, &stdout, &stderr, getenv)
+	var failed struct {
+		Error    string       `json:"error"`
+		Response vfd.Response `json:"response"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &failed); err != nil || code != 1 {
+		t.Fatalf("report submit = %d, %s, %s", code, stdout.String(), stderr.String())
+	}
+	if failed.Response.Code != vfd.InvalidSignatureCode || !strings.Contains(failed.Error, "ack code 1") {
+		t.Errorf("report submit = %+v", failed)
+	}
+
+	// a receipt file is not submitted as a report
+	stdout.Reset()
+	if code := run(context.Background(), []string{"report", "submit", "-file", receipt}, &stdout, &stderr,
+		getenv); code != 1 || server.Requests(vfd.SubmitReportAction) != 1 {
+		t.Errorf("report submit of a receipt = %d, %s", code, stdout.String())
+	}
+
+	if code := run(context.Background(), []string{"receipt"}, &stdout, &stderr, getenv); code != 2 {
+		t.Errorf("receipt without submit = %d, want 2", code)
+	}
+}
+
+func mustRun(t *testing.T, getenv func(string) string, v any, args ...string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), args, &stdout, &stderr, getenv); code != 0 {
+		t.Fatalf("vfd %s = %d: %s%s", strings.Join(args, " "), code, stdout.String(), stderr.String())
+	}
+	if err := json.Unmarshal(stdout.Bytes(), v); err != nil {
+		t.Fatalf("vfd %s printed %s: %v", strings.Join(args, " "), stdout.String(), err)
+	}
+}
+
+func writeJSON(t *testing.T, path string, v any) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, data)
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
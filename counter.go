@@ -0,0 +1,394 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Golang-Tanzania/tra-vfd/internal/fileutil"
+)
+
+const (
+	// DateFormat is the layout of the dates in receipts and Z reports.
+	DateFormat = "2006-01-02"
+	// TimeFormat is the layout of the times in receipts and Z reports.
+	TimeFormat = "15:04:05"
+	// ZNumFormat is the layout of ZNUM, the business date the receipt belongs to.
+	ZNumFormat = "20060102"
+)
+
+var (
+	// ErrCountersNotFound is returned by a CounterStore when nothing has been saved.
+	ErrCountersNotFound = errors.New("counters not found")
+
+	// ErrStaleCounters is returned when saving counters that are not ahead of
+	// the ones already saved, which means another process issued receipts.
+	ErrStaleCounters = errors.New("stale counters")
+
+	// TanzaniaTime is the time zone used for the business day. Tanzania does
+	// not observe daylight saving time so a fixed zone is exact.
+	TanzaniaTime = time.FixedZone("EAT", 3*60*60)
+
+	sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+)
+
+type (
+	// CounterState is the persisted state of a CounterManager. GlobalCounter and
+	// DailyCounter are the last values handed out, Date is the business day
+	// the DailyCounter belongs to in DateFormat.
+	CounterState struct {
+		GlobalCounter int64  `json:"gc"`
+		DailyCounter  int64  `json:"dc"`
+		Date          string `json:"date"`
+	}
+
+	// CounterStore persists CounterState. LoadCounters returns ErrCountersNotFound
+	// when nothing has been saved yet.
+	CounterStore interface {
+		LoadCounters(ctx context.Context) (*CounterState, error)
+		SaveCounters(ctx context.Context, state *CounterState) error
+	}
+
+	// Counters are the values to be used for a single receipt.
+	Counters struct {
+		Date          string
+		Time          string
+		GlobalCounter int64
+		DailyCounter  int64
+		ReceiptNum    string
+		ZNum          string
+		ReceiptVNum   string
+	}
+
+	// CounterManager hands out the counters of each receipt. The global counter
+	// (GC) increases by one with every receipt and never goes back, the daily
+	// counter (DC) starts from one at the beginning of each business day. Every
+	// value is saved to the CounterStore before it is handed out so that a
+	// restart never reuses a counter. It is safe for concurrent use.
+	CounterManager struct {
+		mu          sync.Mutex
+		store       CounterStore
+		receiptCode string
+		seed        int64
+		location    *time.Location
+		state       *CounterState
+	}
+
+	// CounterManagerOption configures a CounterManager.
+	CounterManagerOption func(*CounterManager)
+
+	// FileCounterStore saves the counters as JSON in a file. The file is replaced
+	// atomically on every save.
+	FileCounterStore struct {
+		Path string
+	}
+
+	// SQLCounterStore saves the counters in a database table with one row per
+	// device. Placeholder formats the n-th (starting from 1) query parameter, it
+	// defaults to "?". Use DollarPlaceholder for PostgreSQL.
+	SQLCounterStore struct {
+		DB          *sql.DB
+		Table       string
+		DeviceID    string
+		Placeholder func(n int) string
+	}
+)
+
+// WithCounterLocation sets the time zone used to work out the business day. It
+// defaults to TanzaniaTime.
+func WithCounterLocation(location *time.Location) CounterManagerOption {
+	return func(m *CounterManager) {
+		if location != nil {
+			m.location = location
+		}
+	}
+}
+
+// NewCounterManager creates a CounterManager. receiptCode and gc are the
+// RECEIPTCODE and GC returned at registration. gc is the last global counter
+// known to the VFD server, the first receipt gets gc+1 unless the store
+// already holds a higher value.
+func NewCounterManager(store CounterStore, receiptCode string, gc int64, options ...CounterManagerOption) *CounterManager {
+	m := &CounterManager{
+		store:       store,
+		receiptCode: receiptCode,
+		seed:        gc,
+		location:    TanzaniaTime,
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Next returns the counters for a receipt issued at the given time.
+func (m *CounterManager) Next(ctx context.Context, at time.Time) (*Counters, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.load(ctx); err != nil {
+		return nil, err
+	}
+
+	var (
+		local = at.In(m.location)
+		date  = local.Format(DateFormat)
+		next  = &CounterState{
+			GlobalCounter: m.state.GlobalCounter + 1,
+			DailyCounter:  m.state.DailyCounter + 1,
+			Date:          date,
+		}
+	)
+
+	if date != m.state.Date {
+		next.DailyCounter = 1
+	}
+
+	if err := m.store.SaveCounters(ctx, next); err != nil {
+		if errors.Is(err, ErrStaleCounters) {
+			// another process issued receipts, reload its counters on the next call
+			m.state = nil
+		}
+		return nil, fmt.Errorf("could not save counters: %w", err)
+	}
+	m.state = next
+
+	return &Counters{
+		Date:          date,
+		Time:          local.Format(TimeFormat),
+		GlobalCounter: next.GlobalCounter,
+		DailyCounter:  next.DailyCounter,
+		ReceiptNum:    strconv.FormatInt(next.GlobalCounter, 10),
+		ZNum:          local.Format(ZNumFormat),
+		ReceiptVNum:   fmt.Sprintf("%s%d", m.receiptCode, next.GlobalCounter),
+	}, nil
+}
+
+// Current returns the last counters handed out.
+func (m *CounterManager) Current(ctx context.Context) (CounterState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.load(ctx); err != nil {
+		return CounterState{}, err
+	}
+
+	return *m.state, nil
+}
+
+// load reads the saved state once. Callers must hold m.mu.
+func (m *CounterManager) load(ctx context.Context) error {
+	if m.state != nil {
+		return nil
+	}
+
+	state, err := m.store.LoadCounters(ctx)
+	if err != nil {
+		if !errors.Is(err, ErrCountersNotFound) {
+			return fmt.Errorf("could not load counters: %w", err)
+		}
+		state = &CounterState{}
+	}
+
+	if state.GlobalCounter < m.seed {
+		state.GlobalCounter = m.seed
+	}
+	m.state = state
+
+	return nil
+}
+
+// Apply copies the counters and the date and time into params.
+func (c *Counters) Apply(params *ReceiptParams) {
+	params.Date = c.Date
+	params.Time = c.Time
+	params.GlobalCounter = c.GlobalCounter
+	params.DailyCounter = c.DailyCounter
+	params.ReceiptNum = c.ReceiptNum
+	params.ZNum = c.ZNum
+	params.ReceiptVNum = c.ReceiptVNum
+}
+
+// NewFileCounterStore creates a FileCounterStore that saves counters in path.
+func NewFileCounterStore(path string) *FileCounterStore {
+	return &FileCounterStore{Path: path}
+}
+
+func (f *FileCounterStore) LoadCounters(_ context.Context) (*CounterState, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrCountersNotFound
+		}
+		return nil, fmt.Errorf("could not read counters file: %w", err)
+	}
+
+	state := new(CounterState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not decode counters file: %w", err)
+	}
+
+	return state, nil
+}
+
+func (f *FileCounterStore) SaveCounters(_ context.Context, state *CounterState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not encode counters: %w", err)
+	}
+	return fileutil.WriteAtomic(f.Path, data, 0o600)
+}
+
+// DollarPlaceholder formats query parameters as $1, $2 and so on.
+func DollarPlaceholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// NewSQLCounterStore creates a SQLCounterStore that keeps the counters of
+// deviceID in table.
+func NewSQLCounterStore(db *sql.DB, table string, deviceID string) *SQLCounterStore {
+	return &SQLCounterStore{
+		DB:       db,
+		Table:    table,
+		DeviceID: deviceID,
+	}
+}
+
+// CreateTable creates the counters table if it does not exist.
+func (s *SQLCounterStore) CreateTable(ctx context.Context) error {
+	table, err := s.table()
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	device_id VARCHAR(64) NOT NULL PRIMARY KEY,
+	gc BIGINT NOT NULL,
+	dc BIGINT NOT NULL,
+	business_date VARCHAR(10) NOT NULL
+)`, table)
+
+	if _, err := s.DB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("could not create counters table: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SQLCounterStore) LoadCounters(ctx context.Context) (*CounterState, error) {
+	table, err := s.table()
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("SELECT gc, dc, business_date FROM %s WHERE device_id = %s", table, s.placeholder(1))
+
+	state := new(CounterState)
+	err = s.DB.QueryRowContext(ctx, query, s.DeviceID).Scan(&state.GlobalCounter, &state.DailyCounter, &state.Date)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrCountersNotFound
+		}
+		return nil, fmt.Errorf("could not load counters: %w", err)
+	}
+
+	return state, nil
+}
+
+// SaveCounters updates the row of the device in a transaction. The update only
+// succeeds if the saved global counter is behind the new one, so that the same
+// GC is never saved twice, otherwise ErrStaleCounters is returned.
+func (s *SQLCounterStore) SaveCounters(ctx context.Context, state *CounterState) error {
+	table, err := s.table()
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not save counters: %w", err)
+	}
+	defer func() {
+		// no-op once the transaction has been committed
+		_ = tx.Rollback()
+	}()
+
+	update := fmt.Sprintf("UPDATE %s SET gc = %s, dc = %s, business_date = %s WHERE device_id = %s AND gc < %s",
+		table, s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5))
+	result, err := tx.ExecContext(ctx, update,
+		state.GlobalCounter, state.DailyCounter, state.Date, s.DeviceID, state.GlobalCounter)
+	if err != nil {
+		return fmt.Errorf("could not save counters: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not save counters: %w", err)
+	}
+
+	if updated == 0 {
+		var exists int
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE device_id = %s", table, s.placeholder(1))
+		if err := tx.QueryRowContext(ctx, query, s.DeviceID).Scan(&exists); err != nil {
+			return fmt.Errorf("could not save counters: %w", err)
+		}
+		if exists > 0 {
+			return ErrStaleCounters
+		}
+
+		insert := fmt.Sprintf("INSERT INTO %s (device_id, gc, dc, business_date) VALUES (%s, %s, %s, %s)",
+			table, s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4))
+		_, err := tx.ExecContext(ctx, insert, s.DeviceID, state.GlobalCounter, state.DailyCounter, state.Date)
+		if err != nil {
+			return fmt.Errorf("could not save counters: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not save counters: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SQLCounterStore) table() (string, error) {
+	if !sqlIdentifier.MatchString(s.Table) {
+		return "", fmt.Errorf("invalid counters table name %q", s.Table)
+	}
+	return s.Table, nil
+}
+
+func (s *SQLCounterStore) placeholder(n int) string {
+	if s.Placeholder == nil {
+		return "?"
+	}
+	return s.Placeholder(n)
+}
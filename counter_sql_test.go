@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+)
+
+// fakeCounterDB is an in-memory database/sql driver that understands the
+// queries of SQLCounterStore. Transactions are not isolated, which is enough
+// as the store writes at most once per transaction.
+type (
+	fakeCounterDB struct {
+		mu   sync.Mutex
+		rows map[string][]driver.Value // device_id: gc, dc, business_date
+	}
+
+	fakeCounterConn struct{ db *fakeCounterDB }
+
+	fakeCounterStmt struct {
+		db    *fakeCounterDB
+		query string
+	}
+
+	fakeCounterRows struct {
+		columns []string
+		values  [][]driver.Value
+	}
+)
+
+var registerFakeCounterDriver sync.Once
+
+func openFakeCounterDB(t *testing.T) *sql.DB {
+	t.Helper()
+	registerFakeCounterDriver.Do(func() {
+		sql.Register("fakecounters", &fakeCounterDriver{dbs: make(map[string]*fakeCounterDB)})
+	})
+
+	db, err := sql.Open("fakecounters", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+type fakeCounterDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeCounterDB
+}
+
+func (d *fakeCounterDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dbs[name] == nil {
+		d.dbs[name] = &fakeCounterDB{rows: make(map[string][]driver.Value)}
+	}
+	return &fakeCounterConn{db: d.dbs[name]}, nil
+}
+
+func (c *fakeCounterConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeCounterStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeCounterConn) Close() error              { return nil }
+func (c *fakeCounterConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeCounterConn) Commit() error             { return nil }
+func (c *fakeCounterConn) Rollback() error           { return nil }
+
+func (s *fakeCounterStmt) Close() error  { return nil }
+func (s *fakeCounterStmt) NumInput() int { return -1 }
+
+func (s *fakeCounterStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE"):
+		return driver.RowsAffected(0), nil
+
+	case strings.HasPrefix(s.query, "UPDATE"):
+		// SET gc, dc, business_date WHERE device_id AND gc < or <= new gc
+		row, ok := s.db.rows[args[3].(string)]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		saved, next := row[0].(int64), args[4].(int64)
+		if saved > next || (saved == next && !strings.Contains(s.query, "gc <= ")) {
+			return driver.RowsAffected(0), nil
+		}
+		s.db.rows[args[3].(string)] = []driver.Value{args[0], args[1], args[2]}
+		return driver.RowsAffected(1), nil
+
+	case strings.HasPrefix(s.query, "INSERT"):
+		s.db.rows[args[0].(string)] = []driver.Value{args[1], args[2], args[3]}
+		return driver.RowsAffected(1), nil
+	}
+
+	return nil, fmt.Errorf("unexpected query %q", s.query)
+}
+
+func (s *fakeCounterStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, ok := s.db.rows[args[0].(string)]
+	switch {
+	case strings.HasPrefix(s.query, "SELECT COUNT(*)"):
+		count := int64(0)
+		if ok {
+			count = 1
+		}
+		return &fakeCounterRows{columns: []string{"count"}, values: [][]driver.Value{{count}}}, nil
+
+	case strings.HasPrefix(s.query, "SELECT gc, dc, business_date"):
+		rows := &fakeCounterRows{columns: []string{"gc", "dc", "business_date"}}
+		if ok {
+			rows.values = append(rows.values, row)
+		}
+		return rows, nil
+	}
+
+	return nil, fmt.Errorf("unexpected query %q", s.query)
+}
+
+func (r *fakeCounterRows) Columns() []string { return r.columns }
+func (r *fakeCounterRows) Close() error      { return nil }
+
+func (r *fakeCounterRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestSQLCounterStore(t *testing.T) {
+	t.Parallel()
+	var (
+		ctx   = context.Background()
+		db    = openFakeCounterDB(t)
+		store = vfd.NewSQLCounterStore(db, "vfd_counters", "TZ0100553997")
+		at    = time.Date(2023, 1, 1, 8, 0, 0, 0, vfd.TanzaniaTime)
+	)
+
+	if err := store.CreateTable(ctx); err != nil {
+		t.Fatalf("CreateTable() error = %v", err)
+	}
+	if _, err := store.LoadCounters(ctx); !errors.Is(err, vfd.ErrCountersNotFound) {
+		t.Fatalf("LoadCounters() error = %v, want %v", err, vfd.ErrCountersNotFound)
+	}
+
+	// two processes that both loaded GC 100
+	first := vfd.NewCounterManager(store, "55B8C5", 100)
+	second := vfd.NewCounterManager(store, "55B8C5", 100)
+	for _, manager := range []*vfd.CounterManager{first, second} {
+		if _, err := manager.Current(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := first.Next(ctx, at)
+	if err != nil || got.GlobalCounter != 101 {
+		t.Fatalf("first Next() = %+v, %v, want GC 101", got, err)
+	}
+
+	// the second process must not issue GC 101 again
+	if _, err := second.Next(ctx, at); !errors.Is(err, vfd.ErrStaleCounters) {
+		t.Fatalf("second Next() error = %v, want %v", err, vfd.ErrStaleCounters)
+	}
+
+	// and continues from the saved counters once it reloaded them
+	got, err = second.Next(ctx, at)
+	if err != nil || got.GlobalCounter != 102 || got.DailyCounter != 2 {
+		t.Fatalf("second Next() after reload = %+v, %v, want GC 102 and DC 2", got, err)
+	}
+
+	state, err := store.LoadCounters(ctx)
+	if err != nil || state.GlobalCounter != 102 || state.Date != "2023-01-01" {
+		t.Errorf("LoadCounters() = %+v, %v, want GC 102", state, err)
+	}
+
+	// the same counters can not be saved twice
+	if err := store.SaveCounters(ctx, state); !errors.Is(err, vfd.ErrStaleCounters) {
+		t.Errorf("SaveCounters() of the saved GC error = %v, want %v", err, vfd.ErrStaleCounters)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+)
+
+func TestCounterManager_Next(t *testing.T) {
+	t.Parallel()
+	var (
+		ctx   = context.Background()
+		store = vfd.NewFileCounterStore(filepath.Join(t.TempDir(), "counters.json"))
+		day1  = time.Date(2023, 1, 1, 20, 0, 0, 0, time.UTC) // 23:00 in Dar es Salaam
+	)
+
+	tests := []struct {
+		name   string
+		at     time.Time
+		wantGC int64
+		wantDC int64
+		wantZ  string
+	}{
+		{name: "first receipt", at: day1, wantGC: 101, wantDC: 1, wantZ: "20230101"},
+		{name: "same business day", at: day1.Add(30 * time.Minute), wantGC: 102, wantDC: 2, wantZ: "20230101"},
+		{name: "after local midnight", at: day1.Add(90 * time.Minute), wantGC: 103, wantDC: 1, wantZ: "20230102"},
+	}
+
+	manager := vfd.NewCounterManager(store, "55B8C5", 100)
+	for _, tt := range tests {
+		got, err := manager.Next(ctx, tt.at)
+		if err != nil {
+			t.Fatalf("%s: Next() error = %v", tt.name, err)
+		}
+		if got.GlobalCounter != tt.wantGC || got.DailyCounter != tt.wantDC || got.ZNum != tt.wantZ {
+			t.Errorf("%s: Next() = GC %d, DC %d, ZNUM %s, want GC %d, DC %d, ZNUM %s", tt.name,
+				got.GlobalCounter, got.DailyCounter, got.ZNum, tt.wantGC, tt.wantDC, tt.wantZ)
+		}
+		if want := "55B8C5" + got.ReceiptNum; got.ReceiptVNum != want {
+			t.Errorf("%s: ReceiptVNum = %s, want %s", tt.name, got.ReceiptVNum, want)
+		}
+	}
+
+	// a new manager, as after a restart, continues from the saved state even
+	// when seeded with an older GC
+	restarted := vfd.NewCounterManager(store, "55B8C5", 100)
+	got, err := restarted.Next(ctx, day1.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("Next() after restart error = %v", err)
+	}
+	if got.GlobalCounter != 104 || got.DailyCounter != 2 {
+		t.Errorf("Next() after restart = GC %d, DC %d, want GC 104, DC 2", got.GlobalCounter, got.DailyCounter)
+	}
+
+	var params vfd.ReceiptParams
+	got.Apply(&params)
+	if params.GlobalCounter != 104 || params.Date != "2023-01-02" || params.Time != "01:00:00" {
+		t.Errorf("Apply() = %+v", params)
+	}
+}
@@ -22,18 +22,31 @@
 package vfd
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1" //nolint:gosec
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 
 	"software.sslmate.com/src/go-pkcs12"
 )
 
+// ErrInvalidServerSignature is returned when the EFDMSSIGNATURE of a response
+// from the VFD server is missing or does not match the signed element.
+var ErrInvalidServerSignature = errors.New("invalid server signature")
+
+// ErrInvalidCiphertext is returned when encrypted data is too short to contain
+// a nonce or fails authentication.
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+
 type (
 	// CertLoader loads a certificate from a file and returns the private key and the certificate
 	CertLoader func(certPath string, certPassword string) (*rsa.PrivateKey, *x509.Certificate, error)
@@ -66,6 +79,15 @@ func LoadCertChain(certPath string, certPassword string) (*rsa.PrivateKey, *x509
 	return privateKey, cert, caCerts, nil
 }
 
+// CertSerial returns the serial number of cert as the lower case hex string
+// used for the CertSerial of a DeviceProfile and the Cert-Serial header.
+func CertSerial(cert *x509.Certificate) string {
+	if cert == nil || cert.SerialNumber == nil {
+		return ""
+	}
+	return cert.SerialNumber.Text(16)
+}
+
 func LoadCert(path, password string) (*rsa.PrivateKey, *x509.Certificate, error) {
 	pfxData, err := os.ReadFile(path)
 	if err != nil {
@@ -136,6 +158,111 @@ func SignPayload(privateKey *rsa.PrivateKey, payload []byte) ([]byte, error) {
 	return out, nil
 }
 
+// SignedElement returns the exact bytes of the first element with the given name
+// in data, from its start tag up to and including its end tag, or the whole tag
+// if the element is self-closing. These are the bytes covered by the
+// EFDMSSIGNATURE of both requests and responses.
+func SignedElement(data []byte, name string) ([]byte, error) {
+	var (
+		openTag  = []byte("<" + name)
+		closeTag = []byte("</" + name)
+		start    = -1
+	)
+
+	// make sure the match is the element itself and not one whose name has
+	// the same prefix
+	for offset := 0; offset < len(data); {
+		i := bytes.Index(data[offset:], openTag)
+		if i < 0 {
+			break
+		}
+		i += offset
+		next := i + len(openTag)
+		if next < len(data) && (data[next] == '>' || data[next] == '/' || isXMLSpace(data[next])) {
+			start = i
+			break
+		}
+		offset = next
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("element %s not found", name)
+	}
+
+	tagEnd := startTagEnd(data, start+len(openTag))
+	if tagEnd < 0 {
+		return nil, fmt.Errorf("element %s is not closed", name)
+	}
+	if data[tagEnd-1] == '/' {
+		return data[start : tagEnd+1], nil
+	}
+
+	// the end tag may have whitespace before its '>'
+	for offset := tagEnd; offset < len(data); {
+		i := bytes.Index(data[offset:], closeTag)
+		if i < 0 {
+			break
+		}
+		next := offset + i + len(closeTag)
+		for next < len(data) && isXMLSpace(data[next]) {
+			next++
+		}
+		if next < len(data) && data[next] == '>' {
+			return data[start : next+1], nil
+		}
+		offset = next
+	}
+
+	return nil, fmt.Errorf("element %s is not closed", name)
+}
+
+// startTagEnd returns the index of the '>' that ends the start tag whose
+// attributes begin at from, skipping any '>' inside quoted attribute values.
+// It returns -1 if the tag is not terminated.
+func startTagEnd(data []byte, from int) int {
+	var quote byte
+	for i := from; i < len(data); i++ {
+		switch c := data[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i
+		}
+	}
+	return -1
+}
+
+// isXMLSpace reports whether c is one of the whitespace characters of XML.
+func isXMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// verifyServerSignature checks the signature of the named element of a response
+// from the VFD server. It does nothing unless a server public key was configured.
+func (c *Client) verifyServerSignature(body []byte, element, signature string) error {
+	if c.serverKey == nil {
+		return nil
+	}
+
+	if signature == "" {
+		return fmt.Errorf("%w: missing EFDMSSIGNATURE", ErrInvalidServerSignature)
+	}
+
+	signed, err := SignedElement(body, element)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidServerSignature, err)
+	}
+
+	if err := VerifySignature(c.serverKey, signed, signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidServerSignature, err)
+	}
+
+	return nil
+}
+
 func signPayload(pub *rsa.PrivateKey, payload []byte) ([]byte, error) {
 	hasher := crypto.SHA1.New()
 	hasher.Write(payload)
@@ -151,3 +278,47 @@ func signPayload(pub *rsa.PrivateKey, payload []byte) ([]byte, error) {
 func verifySignature(pub *rsa.PublicKey, hash []byte, sig []byte) error {
 	return rsa.VerifyPKCS1v15(pub, crypto.SHA1, hash, sig)
 }
+
+// encrypt seals plaintext with AES-GCM. The key must be 16, 24 or 32 bytes long.
+// The random nonce is prepended to the returned ciphertext.
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt opens ciphertext produced by encrypt.
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	size := gcm.NonceSize()
+	if len(ciphertext) < size {
+		return nil, ErrInvalidCiphertext
+	}
+
+	plaintext, err := gcm.Open(nil, ciphertext[:size], ciphertext[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
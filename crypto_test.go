@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd_test
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/testcert"
+)
+
+func TestLoadCert(t *testing.T) {
+	t.Parallel()
+	const password = "secret"
+
+	ca, err := testcert.NewCA("Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := ca.IssueCA("Test Intermediate CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chained, err := intermediate.Issue("10TZ101807")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSigned, err := testcert.SelfSigned("10TZ101807")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		cert      *testcert.Certificate
+		withChain bool
+		password  string
+		wantChain int
+		wantErr   bool
+	}{
+		{name: "self-signed", cert: selfSigned, password: password},
+		{name: "without chain", cert: chained, password: password},
+		{name: "with chain", cert: chained, withChain: true, password: password, wantChain: 2},
+		{name: "wrong password", cert: selfSigned, password: "wrong", wantErr: true},
+		{name: "wrong password with chain", cert: chained, withChain: true, password: "wrong", wantErr: true},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".pfx")
+		if err := tt.cert.WritePFX(path, password, tt.withChain); err != nil {
+			t.Fatalf("%s: WritePFX() error = %v", tt.name, err)
+		}
+
+		key, cert, err := vfd.LoadCert(path, tt.password)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: LoadCert() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !key.Equal(tt.cert.Key) || !cert.Equal(tt.cert.Cert) {
+			t.Errorf("%s: LoadCert() returned another key or certificate", tt.name)
+		}
+
+		_, _, chain, err := vfd.LoadCertChain(path, tt.password)
+		if err != nil || len(chain) != tt.wantChain {
+			t.Errorf("%s: LoadCertChain() = %d CA certificates, %v, want %d", tt.name, len(chain), err, tt.wantChain)
+		}
+
+		payload := []byte("<RCT><GC>101</GC></RCT>")
+		signature, err := vfd.Sign(key, payload)
+		if err != nil {
+			t.Fatalf("%s: Sign() error = %v", tt.name, err)
+		}
+		if err := vfd.VerifySignature(cert.PublicKey.(*rsa.PublicKey), payload,
+			base64.StdEncoding.EncodeToString(signature)); err != nil {
+			t.Errorf("%s: VerifySignature() error = %v", tt.name, err)
+		}
+	}
+
+	if err := chained.Cert.CheckSignatureFrom(intermediate.Cert); err != nil {
+		t.Errorf("certificate is not issued by the intermediate CA: %v", err)
+	}
+}
+
+func TestSignedElement(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "plain",
+			data: "<EFDMS><RCT><DATE>2023-01-01</DATE></RCT><EFDMSSIGNATURE>x</EFDMSSIGNATURE></EFDMS>",
+			want: "<RCT><DATE>2023-01-01</DATE></RCT>",
+		},
+		{
+			name: "longer name with the same prefix",
+			data: "<EFDMS><RCTVNUM>1</RCTVNUM><RCT a=\"1\">x</RCT></EFDMS>",
+			want: "<RCT a=\"1\">x</RCT>",
+		},
+		{
+			name: "newline and tab after the name",
+			data: "<EFDMS><RCT\n\ta=\"1\"\r\n>x</RCT\n></EFDMS>",
+			want: "<RCT\n\ta=\"1\"\r\n>x</RCT\n>",
+		},
+		{
+			name: "self-closing",
+			data: "<EFDMS><RCT/><EFDMSSIGNATURE>x</EFDMSSIGNATURE></EFDMS>",
+			want: "<RCT/>",
+		},
+		{
+			name: "self-closing with attributes",
+			data: "<EFDMS><RCT a=\"/>\" /></EFDMS>",
+			want: "<RCT a=\"/>\" />",
+		},
+		{
+			name:    "missing",
+			data:    "<EFDMS><RCTVNUM>1</RCTVNUM></EFDMS>",
+			wantErr: true,
+		},
+		{
+			name:    "not closed",
+			data:    "<EFDMS><RCT>x</EFDMS>",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := vfd.SignedElement([]byte(tt.data), "RCT")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SignedElement() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("SignedElement() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
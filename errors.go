@@ -49,6 +49,19 @@ const (
 	InvalidCertificate   int64 = 8
 )
 
+// Sentinel ACK errors, they match any *AckError with the same code:
+//
+//	if errors.Is(err, vfd.ErrInvalidSignature) { ... }
+var (
+	ErrInvalidSignature    = &AckError{Code: InvalidSignatureCode, Message: "Invalid Signature"}
+	ErrInvalidTIN          = &AckError{Code: InvalidTaxID, Message: ParseErrorCode(InvalidTaxID)}
+	ErrApprovalRequired    = &AckError{Code: ApprovalRequired, Message: ParseErrorCode(ApprovalRequired)}
+	ErrUnhandledException  = &AckError{Code: UnhandledException, Message: ParseErrorCode(UnhandledException)}
+	ErrInvalidSerial       = &AckError{Code: InvalidSerial, Message: ParseErrorCode(InvalidSerial)}
+	ErrInvalidClientHeader = &AckError{Code: InvalidClientHeader, Message: ParseErrorCode(InvalidClientHeader)}
+	ErrInvalidCertificate  = &AckError{Code: InvalidCertificate, Message: ParseErrorCode(InvalidCertificate)}
+)
+
 type (
 	Error struct {
 		Code    int64  `json:"code,omitempty"`
@@ -60,8 +73,61 @@ type (
 		Err     error
 		Message string
 	}
+
+	// AckError is returned when the VFD server acknowledges a request with an
+	// ACKCODE other than SuccessCode. Operation tells which request it was.
+	// The decoded Response, if any, is returned alongside the error.
+	AckError struct {
+		Code      int64
+		Message   string
+		Operation string
+
+		// cause is the operation error, ErrReceiptUploadFailed for example
+		cause error
+	}
+
+	// StatusError is returned when the VFD server responds with a 5xx status.
+	// Message is taken from the error body when there is one.
+	StatusError struct {
+		StatusCode int
+		Message    string
+	}
 )
 
+func (e *AckError) Error() string {
+	if e.Operation == "" {
+		return fmt.Sprintf("ack code %d: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: ack code %d: %s", e.Operation, e.Code, e.Message)
+}
+
+// Is reports whether target is an *AckError with the same code.
+func (e *AckError) Is(target error) bool {
+	t, ok := target.(*AckError)
+	return ok && t.Code == e.Code
+}
+
+// Unwrap returns the error of the operation, so that errors.Is(err, ErrReceiptUploadFailed)
+// holds for a rejected receipt.
+func (e *AckError) Unwrap() error {
+	return e.cause
+}
+
+// ackError returns an *AckError if code is not SuccessCode and nil otherwise.
+func ackError(operation string, cause error, code int64, message string) error {
+	if code == SuccessCode {
+		return nil
+	}
+	return &AckError{Code: code, Message: message, Operation: operation, cause: cause}
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("status %d", e.StatusCode)
+	}
+	return e.Message
+}
+
 func (e *NetworkError) Error() string {
 	return fmt.Sprintf("%s: %s", e.Message, e.Err.Error())
 }
@@ -23,10 +23,9 @@ package models
 
 import (
 	"encoding/xml"
-	"math"
-)
 
-const hundred = 100
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
 
 type (
 	// RCTACK is the receipt acknowledge received from
@@ -48,6 +47,14 @@ type (
 		EFDMSSIGNATURE string   `xml:"EFDMSSIGNATURE"`
 	}
 
+	// RCTEFDMS is a signed receipt as it is uploaded to the vfd server
+	RCTEFDMS struct {
+		XMLName        xml.Name `xml:"EFDMS"`
+		Text           string   `xml:",chardata"`
+		RCT            RCT      `xml:"RCT"`
+		EFDMSSIGNATURE string   `xml:"EFDMSSIGNATURE"`
+	}
+
 	RCT struct {
 		XMLName    xml.Name  `xml:"RCT"`
 		Text       string    `xml:",chardata"`
@@ -78,29 +85,29 @@ type (
 	}
 
 	ITEM struct {
-		XMLName xml.Name `xml:"ITEM"`
-		Text    string   `xml:",chardata"`
-		ID      string   `xml:"ID"`
-		DESC    string   `xml:"DESC"`
-		QTY     float64  `xml:"QTY"`
-		TAXCODE int64    `xml:"TAXCODE"`
-		AMT     float64  `xml:"AMT"`
+		XMLName xml.Name    `xml:"ITEM"`
+		Text    string      `xml:",chardata"`
+		ID      string      `xml:"ID"`
+		DESC    string      `xml:"DESC"`
+		QTY     float64     `xml:"QTY"`
+		TAXCODE int64       `xml:"TAXCODE"`
+		AMT     money.Money `xml:"AMT"`
 	}
 
 	TOTALS struct {
-		XMLName      xml.Name `xml:"TOTALS"`
-		Text         string   `xml:",chardata"`
-		TOTALTAXEXCL float64  `xml:"TOTALTAXEXCL"`
-		TOTALTAXINCL float64  `xml:"TOTALTAXINCL"`
-		DISCOUNT     float64  `xml:"DISCOUNT"`
+		XMLName      xml.Name    `xml:"TOTALS"`
+		Text         string      `xml:",chardata"`
+		TOTALTAXEXCL money.Money `xml:"TOTALTAXEXCL"`
+		TOTALTAXINCL money.Money `xml:"TOTALTAXINCL"`
+		DISCOUNT     money.Money `xml:"DISCOUNT"`
 	}
 
 	VATTOTAL struct {
-		XMLName    xml.Name `xml:"VATTOTAL"`
-		Text       string   `xml:",chardata"`
-		VATRATE    string   `xml:"VATRATE"`
-		NETTAMOUNT string   `xml:"NETTAMOUNT"`
-		TAXAMOUNT  string   `xml:"TAXAMOUNT"`
+		XMLName    xml.Name    `xml:"VATTOTAL"`
+		Text       string      `xml:",chardata"`
+		VATRATE    string      `xml:"VATRATE"`
+		NETTAMOUNT money.Money `xml:"NETTAMOUNT"`
+		TAXAMOUNT  money.Money `xml:"TAXAMOUNT"`
 	}
 
 	VATTOTALS struct {
@@ -110,10 +117,10 @@ type (
 	}
 
 	PAYMENT struct {
-		XMLName   xml.Name `xml:"PAYMENT"`
-		Text      string   `xml:",chardata"`
-		PMTTYPE   string   `xml:"PMTTYPE"`
-		PMTAMOUNT string   `xml:"PMTAMOUNT"`
+		XMLName   xml.Name    `xml:"PAYMENT"`
+		Text      string      `xml:",chardata"`
+		PMTTYPE   string      `xml:"PMTTYPE"`
+		PMTAMOUNT money.Money `xml:"PMTAMOUNT"`
 	}
 
 	PAYMENTS struct {
@@ -123,11 +130,142 @@ type (
 	}
 )
 
-// RoundOff is a helper function to round off the all the values of RCT with float64 as a Data Type
-// to 2 decimal places.
-func (r *RCT) RoundOff() {
-	// RoundOff all the RCT.TOTALS
-	r.TOTALS.TOTALTAXEXCL = math.Round(r.TOTALS.TOTALTAXEXCL*hundred) / hundred
-	r.TOTALS.TOTALTAXINCL = math.Round(r.TOTALS.TOTALTAXINCL*hundred) / hundred
-	r.TOTALS.DISCOUNT = math.Round(r.TOTALS.DISCOUNT*hundred) / hundred
+// MarshalXML writes the payments without the PAYMENT wrapper, a PMTTYPE and
+// PMTAMOUNT pair per payment directly inside PAYMENTS, which is the layout
+// expected by the VFD server.
+func (p PAYMENTS) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return encodeFlat(e, start, len(p.PAYMENT), func(i int) []flatField {
+		payment := p.PAYMENT[i]
+		if payment == nil {
+			return nil
+		}
+		return []flatField{
+			{"PMTTYPE", payment.PMTTYPE},
+			{"PMTAMOUNT", payment.PMTAMOUNT},
+		}
+	})
+}
+
+// MarshalXML writes the totals without the VATTOTAL wrapper, a VATRATE,
+// NETTAMOUNT and TAXAMOUNT triple per rate directly inside VATTOTALS, which
+// is the layout expected by the VFD server.
+func (v VATTOTALS) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return encodeFlat(e, start, len(v.VATTOTAL), func(i int) []flatField {
+		total := v.VATTOTAL[i]
+		if total == nil {
+			return nil
+		}
+		return []flatField{
+			{"VATRATE", total.VATRATE},
+			{"NETTAMOUNT", total.NETTAMOUNT},
+			{"TAXAMOUNT", total.TAXAMOUNT},
+		}
+	})
+}
+
+type flatField struct {
+	name  string
+	value any
+}
+
+// encodeFlat writes the fields of n entries one after the other inside start.
+func encodeFlat(e *xml.Encoder, start xml.StartElement, n int, fields func(i int) []flatField) error {
+	start = xml.StartElement{Name: start.Name}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		for _, field := range fields(i) {
+			if err := e.EncodeElement(field.value, xml.StartElement{Name: xml.Name{Local: field.name}}); err != nil {
+				return err
+			}
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// UnmarshalXML reads payments in the flattened layout written by MarshalXML,
+// a new PAYMENT starts at every PMTTYPE. PAYMENT wrappers are accepted too.
+func (p *PAYMENTS) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	p.XMLName = start.Name
+	p.PAYMENT = nil
+
+	var current *PAYMENT
+	next := func() *PAYMENT {
+		current = &PAYMENT{XMLName: xml.Name{Local: "PAYMENT"}}
+		p.PAYMENT = append(p.PAYMENT, current)
+		return current
+	}
+
+	return decodeFlat(d, func(el xml.StartElement) error {
+		switch el.Name.Local {
+		case "PAYMENT":
+			current = nil
+			return d.DecodeElement(next(), &el)
+		case "PMTTYPE":
+			return d.DecodeElement(&next().PMTTYPE, &el)
+		case "PMTAMOUNT":
+			if current == nil {
+				next()
+			}
+			return d.DecodeElement(&current.PMTAMOUNT, &el)
+		default:
+			return d.Skip()
+		}
+	})
+}
+
+// UnmarshalXML reads totals in the flattened layout written by MarshalXML,
+// a new VATTOTAL starts at every VATRATE. VATTOTAL wrappers are accepted too.
+func (v *VATTOTALS) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	v.XMLName = start.Name
+	v.VATTOTAL = nil
+
+	var current *VATTOTAL
+	next := func() *VATTOTAL {
+		current = &VATTOTAL{XMLName: xml.Name{Local: "VATTOTAL"}}
+		v.VATTOTAL = append(v.VATTOTAL, current)
+		return current
+	}
+
+	return decodeFlat(d, func(el xml.StartElement) error {
+		switch el.Name.Local {
+		case "VATTOTAL":
+			current = nil
+			return d.DecodeElement(next(), &el)
+		case "VATRATE":
+			return d.DecodeElement(&next().VATRATE, &el)
+		case "NETTAMOUNT":
+			if current == nil {
+				next()
+			}
+			return d.DecodeElement(&current.NETTAMOUNT, &el)
+		case "TAXAMOUNT":
+			if current == nil {
+				next()
+			}
+			return d.DecodeElement(&current.TAXAMOUNT, &el)
+		default:
+			return d.Skip()
+		}
+	})
+}
+
+// decodeFlat calls child for every child element until the end of the
+// current element.
+func decodeFlat(d *xml.Decoder, child func(el xml.StartElement) error) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if err := child(t); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
 }
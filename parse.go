@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"crypto/rsa"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/Golang-Tanzania/tra-vfd/internal/models"
+)
+
+var (
+	// ErrInvalidPayload is returned when a signed receipt or Z report can not be parsed.
+	ErrInvalidPayload = errors.New("invalid signed payload")
+
+	// ErrInvalidPayloadSignature is returned when the EFDMSSIGNATURE of a signed
+	// receipt or Z report does not match its content.
+	ErrInvalidPayloadSignature = errors.New("invalid payload signature")
+)
+
+type (
+	// SignedReceipt is a receipt read back from a payload created by ReceiptBytes.
+	// Signed is the exact RCT element the Signature was computed over.
+	SignedReceipt struct {
+		Receipt   *models.RCT
+		Signed    []byte
+		Signature string
+	}
+
+	// SignedReport is a Z report read back from a payload created by ReportBytes.
+	// Signed is the exact ZREPORT element the Signature was computed over.
+	SignedReport struct {
+		Report    *models.ZREPORT
+		Signed    []byte
+		Signature string
+	}
+)
+
+// ParseReceipt decodes a signed receipt payload. It does not check the signature,
+// call SignedReceipt.Verify for that.
+func ParseReceipt(data []byte) (*SignedReceipt, error) {
+	var doc models.RCTEFDMS
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	signed, err := SignedElement(data, "RCT")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	return &SignedReceipt{
+		Receipt:   &doc.RCT,
+		Signed:    signed,
+		Signature: doc.EFDMSSIGNATURE,
+	}, nil
+}
+
+// ParseReport decodes a signed Z report payload. It does not check the signature,
+// call SignedReport.Verify for that.
+func ParseReport(data []byte) (*SignedReport, error) {
+	var doc models.ZREPORTEFDMS
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	signed, err := SignedElement(data, "ZREPORT")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	return &SignedReport{
+		Report:    &doc.ZREPORT,
+		Signed:    signed,
+		Signature: doc.EFDMSSIGNATURE,
+	}, nil
+}
+
+// Verify checks the EFDMSSIGNATURE of the receipt against the public key of the
+// certificate that signed it.
+func (r *SignedReceipt) Verify(publicKey *rsa.PublicKey) error {
+	return verifyPayload(publicKey, r.Signed, r.Signature)
+}
+
+// Verify checks the EFDMSSIGNATURE of the Z report against the public key of the
+// certificate that signed it.
+func (r *SignedReport) Verify(publicKey *rsa.PublicKey) error {
+	return verifyPayload(publicKey, r.Signed, r.Signature)
+}
+
+func verifyPayload(publicKey *rsa.PublicKey, signed []byte, signature string) error {
+	if signature == "" {
+		return fmt.Errorf("%w: missing EFDMSSIGNATURE", ErrInvalidPayloadSignature)
+	}
+
+	if err := VerifySignature(publicKey, signed, signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayloadSignature, err)
+	}
+
+	return nil
+}
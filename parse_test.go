@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+)
+
+func TestParseReceipt(t *testing.T) {
+	t.Parallel()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, customer, items, payments := goldenReceipt()
+	payload, err := ReceiptBytes(privateKey, params, customer, items, payments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ParseReceipt(payload)
+	if err != nil {
+		t.Fatalf("ParseReceipt() error = %v", err)
+	}
+	if err := got.Verify(&privateKey.PublicKey); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+	if err := got.Verify(&otherKey.PublicKey); !errors.Is(err, ErrInvalidPayloadSignature) {
+		t.Errorf("Verify() with another key error = %v, want %v", err, ErrInvalidPayloadSignature)
+	}
+
+	rct := got.Receipt
+	if rct.GC != params.GlobalCounter || rct.CUSTNAME != customer.Name || len(rct.ITEMS.ITEM) != len(items) {
+		t.Errorf("ParseReceipt() = %+v", rct)
+	}
+	if len(rct.PAYMENTS.PAYMENT) != 2 || rct.PAYMENTS.PAYMENT[1].PMTTYPE != string(ElectronicPaymentType) ||
+		rct.PAYMENTS.PAYMENT[1].PMTAMOUNT != payments[1].Amount {
+		t.Errorf("PAYMENTS = %+v", rct.PAYMENTS.PAYMENT)
+	}
+	if len(rct.VATTOTALS.VATTOTAL) != 1 || rct.VATTOTALS.VATTOTAL[0].TAXAMOUNT.String() != "1677.97" {
+		t.Errorf("VATTOTALS = %+v", rct.VATTOTALS.VATTOTAL)
+	}
+
+	// the payload must re-encode to the bytes that were signed
+	unsigned, err := receiptPayload(params, customer, items, payments, ReceiptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Signed, unsigned) {
+		t.Errorf("Signed = %s, want %s", got.Signed, unsigned)
+	}
+
+	tampered := bytes.Replace(payload, []byte("<AMT>7000.00</AMT>"), []byte("<AMT>700.00</AMT>"), 1)
+	got, err = ParseReceipt(tampered)
+	if err != nil {
+		t.Fatalf("ParseReceipt() error = %v", err)
+	}
+	if err := got.Verify(&privateKey.PublicKey); !errors.Is(err, ErrInvalidPayloadSignature) {
+		t.Errorf("Verify() of a tampered receipt error = %v, want %v", err, ErrInvalidPayloadSignature)
+	}
+
+	if _, err := ParseReceipt([]byte("<EFDMS><RCT>")); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("ParseReceipt() of a truncated payload error = %v, want %v", err, ErrInvalidPayload)
+	}
+}
+
+func TestParseReport(t *testing.T) {
+	t.Parallel()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, address, vats, payments, totals := goldenReport()
+	payload, err := ReportBytes(privateKey, params, address, vats, payments, totals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ParseReport(payload)
+	if err != nil {
+		t.Fatalf("ParseReport() error = %v", err)
+	}
+	if err := got.Verify(&privateKey.PublicKey); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	report := got.Report
+	if report.ZNUMBER != params.ZNumber || report.TOTALS.GROSS != totals.Gross {
+		t.Errorf("ParseReport() = %+v", report)
+	}
+	if len(report.VATTOTALS.VATTOTAL) != 5 || report.VATTOTALS.VATTOTAL[2].NETTAMOUNT.String() != "2500.00" {
+		t.Errorf("VATTOTALS = %+v", report.VATTOTALS.VATTOTAL)
+	}
+	if len(report.PAYMENTS.PAYMENT) != 5 || report.PAYMENTS.PAYMENT[3].PMTAMOUNT.String() != "3000.00" {
+		t.Errorf("PAYMENTS = %+v", report.PAYMENTS.PAYMENT)
+	}
+}
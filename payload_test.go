@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func goldenReceipt() (ReceiptParams, Customer, []Item, []Payment) {
+	params := ReceiptParams{
+		Date:           "2023-01-01",
+		Time:           "08:00:00",
+		TIN:            "100553997",
+		RegistrationID: "TZ0100553997",
+		EFDSerial:      "10TZ101807",
+		ReceiptNum:     "101",
+		DailyCounter:   1,
+		GlobalCounter:  101,
+		ZNum:           "20230101",
+		ReceiptVNum:    "55B8C5101",
+	}
+	customer := Customer{
+		Type:   TINCustomerID,
+		ID:     "100553998",
+		Name:   "John & Sons",
+		Mobile: "255765992153",
+	}
+	items := []Item{
+		NewItem("1", "Sugar 1kg", TaxableItemCode, 2, 3500, 0),
+		NewItem("2", "Rice <5kg>", TaxableItemCode, 1.5, 2999.99, 500),
+	}
+	payments := []Payment{
+		NewPayment(CashPaymentType, 7000),
+		NewPayment(ElectronicPaymentType, 3999.99),
+	}
+
+	return params, customer, items, payments
+}
+
+func goldenReport() (*ReportParams, Address, []VATTOTAL, []Payment, ReportTotals) {
+	params := &ReportParams{
+		Date:             "2023-01-01",
+		Time:             "23:59:59",
+		VRN:              "40005334W",
+		TIN:              "100553997",
+		UIN:              "09VFDWEBAPI-10131758710TZ100553997",
+		TaxOffice:        "Tax Office Ilala",
+		RegistrationID:   "TZ0100553997",
+		ZNumber:          "20230101",
+		EFDSerial:        "10TZ101807",
+		RegistrationDate: "2022-10-19",
+	}
+	address := Address{
+		Name:    "Golang Tanzania",
+		Street:  "Sam Nujoma Road",
+		Mobile:  "0765992153",
+		City:    "Dar es Salaam",
+		Country: "Tanzania",
+	}
+	vats := []VATTOTAL{
+		{ID: StandardVATID, Rate: StandardVATRATE, NetAmount: money.MustParse("8474.58"), TaxAmount: money.MustParse("1525.42")},
+		{ID: ZeroVATID, Rate: ZeroVATRATE, NetAmount: money.MustParse("2500.00")},
+	}
+	payments := []Payment{
+		NewPayment(CashPaymentType, 9500),
+		NewPayment(ElectronicPaymentType, 3000),
+	}
+	totals := ReportTotals{
+		DailyTotalAmount: money.MustParse("12500"),
+		Gross:            money.MustParse("1012500.50"),
+		Discounts:        money.MustParse("500"),
+		TicketsFiscal:    3,
+	}
+
+	return params, address, vats, payments, totals
+}
+
+func TestPayloadGolden(t *testing.T) {
+	t.Parallel()
+	params, customer, items, payments := goldenReceipt()
+	receipt, err := receiptPayload(params, customer, items, payments, ReceiptOptions{})
+	if err != nil {
+		t.Fatalf("receiptPayload() error = %v", err)
+	}
+	reportParams, address, vats, payments, totals := goldenReport()
+	report, err := reportPayload(reportParams, address, vats, payments, totals, ReportOptions{})
+	if err != nil {
+		t.Fatalf("reportPayload() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  []byte
+	}{
+		{name: "receipt.golden.xml", got: receipt},
+		{name: "report.golden.xml", got: report},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join("testdata", tt.name)
+		if *update {
+			if err := os.WriteFile(path, tt.got, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tt.got, want) {
+			t.Errorf("%s mismatch:\ngot:  %s\nwant: %s", tt.name, tt.got, want)
+		}
+	}
+}
+
+func TestReceiptPayload_MarkupInValues(t *testing.T) {
+	t.Parallel()
+	params, customer, items, payments := goldenReceipt()
+	items[0].Description = "<PAYMENT></VATTOTAL>"
+
+	payload, err := receiptPayload(params, customer, items, payments, ReceiptOptions{})
+	if err != nil {
+		t.Fatalf("receiptPayload() error = %v", err)
+	}
+
+	var rct struct {
+		Items []string `xml:"ITEMS>ITEM>DESC"`
+	}
+	if err := xml.Unmarshal(payload, &rct); err != nil {
+		t.Fatalf("xml.Unmarshal() error = %v", err)
+	}
+	if len(rct.Items) != 2 || rct.Items[0] != items[0].Description {
+		t.Errorf("descriptions = %q, want %q first", rct.Items, items[0].Description)
+	}
+}
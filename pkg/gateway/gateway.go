@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package gateway is an HTTP server that lets point of sale systems written in
+// any language submit receipts and Z reports as JSON. Requests are decoded into
+// vfd.ReceiptRequest and vfd.ReportRequest, validated, then signed and submitted
+// with a configured vfd.Client.
+//
+// The gateway is the only place receipts are validated, see WithValidationMode.
+// A vfd.Client used as the Submitter validates every receipt again with its own
+// mode, so it should be created with vfd.WithValidationMode(vfd.ValidationDisabled).
+//
+// Endpoints:
+//
+//	POST /receipts  body: vfd.ReceiptRequest  reply: ReceiptResponse
+//	POST /reports   body: vfd.ReportRequest   reply: ReportResponse
+//
+// Failures are replied with an ErrorResponse.
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/env"
+)
+
+const (
+	ReceiptsPath = "/receipts"
+	ReportsPath  = "/reports"
+
+	// DefaultMaxBodySize is the largest request body accepted by default.
+	DefaultMaxBodySize = 1 << 20
+)
+
+// ErrUnauthorized is returned by an AuthFunc to reject a request.
+var ErrUnauthorized = errors.New("unauthorized")
+
+type (
+	// Submitter signs and submits receipts and Z reports, *vfd.Client configured
+	// with NewClient options is one. The gateway has validated the receipts it
+	// passes on, the Submitter should not reject them again.
+	Submitter interface {
+		Receipt(ctx context.Context, receipt *vfd.ReceiptRequest) (*vfd.Response, error)
+		Report(ctx context.Context, report *vfd.ReportRequest) (*vfd.Response, error)
+	}
+
+	// Middleware wraps the handlers of the gateway.
+	Middleware func(http.Handler) http.Handler
+
+	// AuthFunc authenticates a request, any error rejects it with 401.
+	AuthFunc func(r *http.Request) error
+
+	// Server is the gateway http.Handler.
+	Server struct {
+		submitter   Submitter
+		env         env.Env
+		validation  vfd.ValidationMode
+		maxBodySize int64
+		middlewares []Middleware
+		handler     http.Handler
+	}
+
+	Option func(*Server)
+
+	// ReceiptResponse is the reply to an accepted receipt. Link is the URL
+	// where the customer can verify the receipt.
+	ReceiptResponse struct {
+		Response *vfd.Response `json:"response"`
+		Link     string        `json:"link"`
+	}
+
+	// ReportResponse is the reply to an accepted Z report.
+	ReportResponse struct {
+		Response *vfd.Response `json:"response"`
+	}
+
+	// ErrorResponse is the reply to a failed request. Violations are set when
+	// the request is invalid, Response when the VFD server rejected it.
+	ErrorResponse struct {
+		Error      string         `json:"error"`
+		Violations vfd.Violations `json:"violations,omitempty"`
+		Response   *vfd.Response  `json:"response,omitempty"`
+	}
+)
+
+// WithEnv sets the environment of the verification links, it should be the one
+// the Submitter submits to.
+func WithEnv(e env.Env) Option {
+	return func(s *Server) {
+		s.env = e
+	}
+}
+
+// WithValidationMode decides which violations reject a receipt before it is
+// submitted, ValidationLenient by default. It only takes effect when the
+// Submitter does not validate receipts itself, see the package documentation.
+func WithValidationMode(mode vfd.ValidationMode) Option {
+	return func(s *Server) {
+		s.validation = mode
+	}
+}
+
+// WithMaxBodySize sets the largest request body accepted.
+func WithMaxBodySize(size int64) Option {
+	return func(s *Server) {
+		s.maxBodySize = size
+	}
+}
+
+// WithMiddleware wraps the handlers, the first middleware is the outermost.
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(s *Server) {
+		s.middlewares = append(s.middlewares, middlewares...)
+	}
+}
+
+// Authenticate returns a Middleware that replies 401 to requests rejected by auth.
+func Authenticate(auth AuthFunc) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := auth(r); err != nil {
+				writeJSON(w, http.StatusUnauthorized, &ErrorResponse{Error: err.Error()})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BearerTokens returns an AuthFunc that accepts requests with an
+// "Authorization: Bearer <token>" header carrying one of the tokens. The token
+// is compared with every configured token in constant time.
+func BearerTokens(tokens ...string) AuthFunc {
+	allowed := make([][]byte, 0, len(tokens))
+	for _, token := range tokens {
+		allowed = append(allowed, []byte(token))
+	}
+
+	return func(r *http.Request) error {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		matched := 0
+		for _, candidate := range allowed {
+			matched |= subtle.ConstantTimeCompare([]byte(token), candidate)
+		}
+		if !strings.EqualFold(scheme, "bearer") || matched != 1 {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+}
+
+// New returns a gateway that submits the requests it accepts with submitter. A
+// *vfd.Client submitter should have validation disabled, see the package
+// documentation.
+func New(submitter Submitter, options ...Option) *Server {
+	s := &Server{
+		submitter:   submitter,
+		validation:  vfd.ValidationLenient,
+		maxBodySize: DefaultMaxBodySize,
+	}
+	for _, option := range options {
+		option(s)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ReceiptsPath, s.receipt)
+	mux.HandleFunc(ReportsPath, s.report)
+
+	var handler http.Handler = mux
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		handler = s.middlewares[i](handler)
+	}
+	s.handler = handler
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *Server) receipt(w http.ResponseWriter, r *http.Request) {
+	receipt := &vfd.ReceiptRequest{}
+	if !s.decode(w, r, receipt) {
+		return
+	}
+
+	if err := receipt.Validate().Err(s.validation); err != nil {
+		writeError(w, nil, err)
+		return
+	}
+
+	response, err := s.submitter.Receipt(r.Context(), receipt)
+	if err != nil {
+		writeError(w, response, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ReceiptResponse{
+		Response: response,
+		Link:     vfd.ReceiptLink(s.env, receiptCode(receipt.Params), receipt.Params.GlobalCounter, receipt.Params.Time),
+	})
+}
+
+func (s *Server) report(w http.ResponseWriter, r *http.Request) {
+	report := &vfd.ReportRequest{}
+	if !s.decode(w, r, report) {
+		return
+	}
+
+	if violations := validateReport(report); len(violations) > 0 {
+		writeError(w, nil, &vfd.ValidationError{Violations: violations})
+		return
+	}
+
+	response, err := s.submitter.Report(r.Context(), report)
+	if err != nil {
+		writeError(w, response, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ReportResponse{Response: response})
+}
+
+// decode reads the JSON body into v, unknown fields are rejected so that
+// misspelled fields are not silently dropped.
+func (s *Server) decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, &ErrorResponse{Error: "method not allowed"})
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: fmt.Sprintf("invalid request body: %v", err)})
+		return false
+	}
+
+	return true
+}
+
+// validateReport checks the fields a Z report can not be generated without.
+func validateReport(report *vfd.ReportRequest) vfd.Violations {
+	var violations vfd.Violations
+	add := func(field, message string) {
+		violations = append(violations, vfd.Violation{Field: field, Message: message, Severity: vfd.SeverityError})
+	}
+
+	if report.Params == nil {
+		add("Params", "is required")
+	} else {
+		if report.Params.Date == "" {
+			add("Params.Date", "is required")
+		}
+		if report.Params.Time == "" {
+			add("Params.Time", "is required")
+		}
+		if report.Params.ZNumber == "" {
+			add("Params.ZNumber", "is required")
+		}
+	}
+	if report.Totals == nil {
+		add("Totals", "is required")
+	}
+
+	return violations
+}
+
+// writeError replies to a request that failed validation or submission. Invalid
+// requests and those the VFD server rejected for good are unprocessable,
+// anything that may succeed later is a bad gateway.
+func writeError(w http.ResponseWriter, response *vfd.Response, err error) {
+	reply := &ErrorResponse{Error: err.Error(), Response: response}
+
+	status := http.StatusBadGateway
+	var (
+		validationErr *vfd.ValidationError
+		ackErr        *vfd.AckError
+	)
+	switch {
+	case errors.As(err, &validationErr):
+		status = http.StatusUnprocessableEntity
+		reply.Violations = validationErr.Violations
+	case errors.As(err, &ackErr) && !vfd.IsRetryableCode(ackErr.Code):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, vfd.ErrClientNotConfigured):
+		status = http.StatusInternalServerError
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	}
+
+	writeJSON(w, status, reply)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// receiptCode returns the receipt code from the receipt verification number,
+// which is the receipt code followed by the GC.
+func receiptCode(params vfd.ReceiptParams) string {
+	return strings.TrimSuffix(params.ReceiptVNum, strconv.FormatInt(params.GlobalCounter, 10))
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package gateway_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/env"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/gateway"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/testcert"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/vfdtest"
+)
+
+const receiptJSON = `{
+	"params": {
+		"date": "2023-01-01", "time": "08:15:30", "tin": "100553997",
+		"registration_id": "TZ0100553997", "efd_serial": "10TZ101807", "receipt_num": "101",
+		"daily_counter": 1, "global_counter": %GC%, "znum": "20230101", "receipt_vnum": "55B8C5%GC%"
+	},
+	"customer": {"type": 6},
+	"items": [
+		{"id": "1", "description": "Item 1", "tax_code": 1, "quantity": 2, "unit_price": "5000.00", "discount": 0}
+	],
+	"payments": [{"type": "CASH", "amount": 10000}]
+}`
+
+// newClient returns a registered client of a new vfdtest server, with
+// validation left to the gateway.
+func newClient(t *testing.T) (*vfd.Client, *vfdtest.Server) {
+	t.Helper()
+	cert, err := testcert.SelfSigned(vfdtest.DefaultCertKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tra := vfdtest.NewServer(vfdtest.WithClientKey(&cert.Key.PublicKey))
+	t.Cleanup(tra.Close)
+
+	client := vfd.NewClient(
+		vfd.WithHttpClient(tra.Client()),
+		vfd.WithURLs(tra.URLs()),
+		vfd.WithServerCertificate(tra.Certificate),
+		vfd.WithPrivateKey(cert.Key),
+		vfd.WithCertSerial(vfdtest.DefaultCertSerial),
+		vfd.WithCredentials(vfdtest.DefaultTIN, vfdtest.DefaultCertKey),
+		vfd.WithValidationMode(vfd.ValidationDisabled),
+	)
+	if _, err := client.RegisterDevice(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return client, tra
+}
+
+func TestGateway(t *testing.T) {
+	t.Parallel()
+	client, tra := newClient(t)
+
+	server := httptest.NewServer(gateway.New(client,
+		gateway.WithEnv(env.PROD),
+		gateway.WithMiddleware(gateway.Authenticate(gateway.BearerTokens("pos-1"))),
+	))
+	defer server.Close()
+
+	receipt := func(gc string) string {
+		return strings.ReplaceAll(receiptJSON, "%GC%", gc)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		body       string
+		before     func()
+		wantStatus int
+		wantCode   int64
+		wantLink   string
+		wantField  string
+	}{
+		{
+			name:       "receipt",
+			path:       gateway.ReceiptsPath,
+			token:      "pos-1",
+			body:       receipt("101"),
+			wantStatus: http.StatusOK,
+			wantLink:   vfd.VerifyReceiptProductionURL + "55B8C5101_081530",
+		},
+		{
+			name:       "not authenticated",
+			path:       gateway.ReceiptsPath,
+			token:      "pos-2",
+			body:       receipt("102"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "token prefix",
+			path:       gateway.ReceiptsPath,
+			token:      "pos-",
+			body:       receipt("102"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "invalid receipt",
+			path:       gateway.ReceiptsPath,
+			token:      "pos-1",
+			body:       strings.Replace(receipt("102"), `"quantity": 2`, `"quantity": 0`, 1),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantField:  "Items[0].Quantity",
+		},
+		{
+			name:       "unknown field",
+			path:       gateway.ReceiptsPath,
+			token:      "pos-1",
+			body:       strings.Replace(receipt("102"), `"customer"`, `"customr"`, 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "rejected by the VFD server",
+			path:       gateway.ReceiptsPath,
+			token:      "pos-1",
+			body:       receipt("102"),
+			before:     func() { tra.QueueAck(vfd.SubmitReceiptAction, vfd.InvalidSignatureCode) },
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   vfd.InvalidSignatureCode,
+		},
+		{
+			name:  "report",
+			path:  gateway.ReportsPath,
+			token: "pos-1",
+			body: `{"params": {"date": "2023-01-01", "time": "23:59:59", "tin": "100553997", "znumber": "20230101"},
+				"totals": {"daily_total_amount": 10000, "gross": 10000}}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "report without totals",
+			path:       gateway.ReportsPath,
+			token:      "pos-1",
+			body:       `{"params": {"date": "2023-01-01", "time": "23:59:59", "znumber": "20230101"}}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantField:  "Totals",
+		},
+	}
+
+	for _, tt := range tests {
+		if tt.before != nil {
+			tt.before()
+		}
+
+		req, err := http.NewRequest(http.MethodPost, server.URL+tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var reply struct {
+			gateway.ErrorResponse
+			Link string `json:"link"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&reply)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: could not decode reply: %v", tt.name, err)
+		}
+
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, resp.StatusCode, tt.wantStatus, reply.Error)
+		}
+		if reply.Link != tt.wantLink {
+			t.Errorf("%s: link = %q, want %q", tt.name, reply.Link, tt.wantLink)
+		}
+		if tt.wantStatus == http.StatusOK || tt.wantCode != 0 {
+			if reply.Response == nil || reply.Response.Code != tt.wantCode {
+				t.Errorf("%s: response = %+v, want code %d", tt.name, reply.Response, tt.wantCode)
+			}
+		}
+		if tt.wantField != "" && (len(reply.Violations) == 0 || reply.Violations[0].Field != tt.wantField) {
+			t.Errorf("%s: violations = %v, want %s", tt.name, reply.Violations, tt.wantField)
+		}
+	}
+
+	if got := len(tra.Receipts()); got != 1 {
+		t.Errorf("TRA received %d receipts, want 1", got)
+	}
+	if reports := tra.Reports(); len(reports) != 1 || reports[0].Report.ZNUMBER != "20230101" {
+		t.Errorf("TRA received reports %v", reports)
+	}
+}
+
+func TestGateway_ValidationMode(t *testing.T) {
+	t.Parallel()
+	client, tra := newClient(t)
+	body := strings.Replace(strings.ReplaceAll(receiptJSON, "%GC%", "101"), `"quantity": 2`, `"quantity": 0`, 1)
+
+	tests := []struct {
+		name       string
+		mode       vfd.ValidationMode
+		wantStatus int
+	}{
+		{name: "lenient", mode: vfd.ValidationLenient, wantStatus: http.StatusUnprocessableEntity},
+		{name: "disabled", mode: vfd.ValidationDisabled, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, gateway.ReceiptsPath, strings.NewReader(body))
+		gateway.New(client, gateway.WithValidationMode(tt.mode)).ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.wantStatus, rec.Body.String())
+		}
+	}
+
+	if got := len(tra.Receipts()); got != 1 {
+		t.Errorf("TRA received %d receipts, want 1", got)
+	}
+}
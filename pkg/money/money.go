@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package money implements a fixed-point amount of money with two decimal
+// places, which is the precision used by the VFD API.
+package money
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrOutOfRange is returned when an amount does not fit in a whole number of
+// cents. MustMul and MustScale panic with it.
+var ErrOutOfRange = errors.New("money: amount out of range")
+
+// decimalPattern matches the plain decimal amounts accepted by Parse.
+var decimalPattern = regexp.MustCompile(`^[-+]?[0-9]+(\.[0-9]+)?$`)
+
+// Money is an amount of money stored as a whole number of cents. Use FromFloat,
+// FromCents or Parse to create one. The zero value is zero.
+type Money struct {
+	cents int64
+}
+
+// Zero is an amount of zero.
+var Zero = Money{}
+
+// FromCents creates Money from a whole number of cents.
+func FromCents(cents int64) Money {
+	return Money{cents: cents}
+}
+
+// FromFloat creates Money from a float, rounding to the nearest cent with
+// halves rounded away from zero. It exists for compatibility with amounts
+// kept as float64, prefer Parse for amounts that come as text. NaN is zero and
+// amounts out of range are clamped to the largest or smallest amount, use
+// FromFloatChecked to get an error for them instead.
+func FromFloat(amount float64) Money {
+	m, err := FromFloatChecked(amount)
+	switch {
+	case err == nil:
+		return m
+	case math.IsNaN(amount):
+		return Zero
+	case amount > 0:
+		return Money{cents: math.MaxInt64}
+	default:
+		return Money{cents: math.MinInt64}
+	}
+}
+
+// FromFloatChecked is like FromFloat but returns an error for NaN, infinities
+// and amounts out of range.
+func FromFloatChecked(amount float64) (Money, error) {
+	if math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return Money{}, fmt.Errorf("money: invalid amount %v", amount)
+	}
+	return Parse(strconv.FormatFloat(amount, 'f', -1, 64))
+}
+
+// Parse parses a decimal amount such as "1500", "1500.5" or "-0.25". Fractions
+// and exponents such as "1/3" or "1e3" are not accepted. Amounts with more than
+// two decimal places are rounded to the nearest cent with halves rounded away
+// from zero.
+func Parse(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if !decimalPattern.MatchString(s) {
+		return Money{}, fmt.Errorf("money: invalid amount %q", s)
+	}
+	value, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Money{}, fmt.Errorf("money: invalid amount %q", s)
+	}
+	return fromRat(value.Mul(value, big.NewRat(100, 1)))
+}
+
+// MustParse is like Parse but panics if s is not a valid amount.
+func MustParse(s string) Money {
+	m, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Sum adds up all the amounts.
+func Sum(amounts ...Money) Money {
+	var total Money
+	for _, amount := range amounts {
+		total = total.Add(amount)
+	}
+	return total
+}
+
+// Cents returns the amount as a whole number of cents.
+func (m Money) Cents() int64 {
+	return m.cents
+}
+
+// Float64 returns the amount as a float. It is meant for display and for
+// interoperability with code that still uses float amounts.
+func (m Money) Float64() float64 {
+	return float64(m.cents) / 100
+}
+
+func (m Money) Add(other Money) Money {
+	return Money{cents: m.cents + other.cents}
+}
+
+func (m Money) Sub(other Money) Money {
+	return Money{cents: m.cents - other.cents}
+}
+
+func (m Money) Neg() Money {
+	return Money{cents: -m.cents}
+}
+
+func (m Money) IsZero() bool {
+	return m.cents == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.cents < 0
+}
+
+// Cmp compares two amounts and returns -1, 0 or +1.
+func (m Money) Cmp(other Money) int {
+	switch {
+	case m.cents < other.cents:
+		return -1
+	case m.cents > other.cents:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Mul multiplies the amount by a quantity and rounds the result to the nearest
+// cent. The quantity is taken at its shortest decimal representation so that
+// 0.1 is exactly one tenth. It returns an error if the quantity is not a finite
+// number or the result is out of range.
+func (m Money) Mul(quantity float64) (Money, error) {
+	if math.IsNaN(quantity) || math.IsInf(quantity, 0) {
+		return Money{}, fmt.Errorf("money: invalid quantity %v", quantity)
+	}
+	q, ok := new(big.Rat).SetString(strconv.FormatFloat(quantity, 'f', -1, 64))
+	if !ok {
+		return Money{}, fmt.Errorf("money: invalid quantity %v", quantity)
+	}
+	return fromRat(q.Mul(q, new(big.Rat).SetInt64(m.cents)))
+}
+
+// MustMul is like Mul but panics instead of returning an error. It is meant
+// for quantities that are known to be valid.
+func (m Money) MustMul(quantity float64) Money {
+	result, err := m.Mul(quantity)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// Scale returns the amount multiplied by num/den rounded to the nearest cent.
+// It returns an error if den is zero or the result is out of range.
+func (m Money) Scale(num, den int64) (Money, error) {
+	if den == 0 {
+		return Money{}, errors.New("money: scale by a zero denominator")
+	}
+	r := new(big.Rat).SetFrac(big.NewInt(m.cents), big.NewInt(den))
+	return fromRat(r.Mul(r, new(big.Rat).SetInt64(num)))
+}
+
+// MustScale is like Scale but panics instead of returning an error. It is
+// meant for factors that are known not to overflow, such as num <= den.
+func (m Money) MustScale(num, den int64) Money {
+	result, err := m.Scale(num, den)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// String formats the amount with exactly two decimal places, for example "1500.00".
+func (m Money) String() string {
+	sign := ""
+	cents := m.cents
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// MarshalText implements encoding.TextMarshaler, it is used for XML.
+func (m Money) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. Empty text is zero.
+func (m *Money) UnmarshalText(text []byte) error {
+	if len(bytes.TrimSpace(text)) == 0 {
+		*m = Money{}
+		return nil
+	}
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// MarshalJSON encodes the amount as a JSON number with two decimal places.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a string holding a number.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	return m.UnmarshalText(bytes.Trim(data, `"`))
+}
+
+// fromRat rounds a number of cents to the nearest whole cent, halves away from zero.
+func fromRat(cents *big.Rat) (Money, error) {
+	num := new(big.Int).Abs(cents.Num())
+	den := cents.Denom()
+
+	// (2*num + den) / (2*den) rounds half up on the absolute value
+	num.Mul(num, big.NewInt(2)).Add(num, den)
+	num.Quo(num, new(big.Int).Mul(den, big.NewInt(2)))
+	if cents.Sign() < 0 {
+		num.Neg(num)
+	}
+
+	if !num.IsInt64() {
+		return Money{}, ErrOutOfRange
+	}
+	return Money{cents: num.Int64()}, nil
+}
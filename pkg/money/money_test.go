@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package money_test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{input: "1500", want: 150000},
+		{input: "1500.5", want: 150050},
+		{input: "-0.25", want: -25},
+		{input: "0.005", want: 1},
+		{input: "-0.005", want: -1},
+		{input: "0.0049", want: 0},
+		{input: "abc", wantErr: true},
+		{input: "1/3", wantErr: true},
+		{input: "1e3", wantErr: true},
+		{input: "0x10", wantErr: true},
+		{input: "1.", wantErr: true},
+		{input: "99999999999999999999", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.input, func(t *testing.T) {
+			t.Parallel()
+			got, err := money.Parse(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got.Cents() != tt.want {
+				t.Errorf("Parse(%q) = %d cents, want %d", tt.input, got.Cents(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMoney_Arithmetic(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		got  money.Money
+		want string
+	}{
+		{name: "float sum", got: money.FromFloat(0.1).Add(money.FromFloat(0.2)), want: "0.30"},
+		{name: "decimal quantity", got: money.MustParse("10.05").MustMul(0.1), want: "1.01"},
+		{name: "whole quantity", got: money.MustParse("2000").MustMul(5), want: "10000.00"},
+		{name: "negative", got: money.MustParse("1").Sub(money.MustParse("1.50")), want: "-0.50"},
+		{name: "net of 18% VAT", got: money.MustParse("5000").MustScale(10000, 11800), want: "4237.29"},
+		{name: "sum", got: money.Sum(money.FromCents(1), money.FromCents(2), money.FromCents(3)), want: "0.06"},
+	}
+
+	for _, tt := range tests {
+		if tt.got.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestMoney_OutOfRange(t *testing.T) {
+	t.Parallel()
+	large := money.FromCents(math.MaxInt64 / 2)
+
+	errorTests := []struct {
+		name string
+		call func() (money.Money, error)
+	}{
+		{name: "Mul overflow", call: func() (money.Money, error) { return large.Mul(3) }},
+		{name: "Mul NaN", call: func() (money.Money, error) { return large.Mul(math.NaN()) }},
+		{name: "Mul Inf", call: func() (money.Money, error) { return large.Mul(math.Inf(1)) }},
+		{name: "Scale overflow", call: func() (money.Money, error) { return large.Scale(3, 1) }},
+		{name: "Scale by zero", call: func() (money.Money, error) { return large.Scale(1, 0) }},
+		{name: "FromFloatChecked NaN", call: func() (money.Money, error) { return money.FromFloatChecked(math.NaN()) }},
+		{name: "FromFloatChecked large", call: func() (money.Money, error) { return money.FromFloatChecked(1e20) }},
+	}
+	for _, tt := range errorTests {
+		if got, err := tt.call(); err == nil {
+			t.Errorf("%s = %s, want an error", tt.name, got)
+		}
+	}
+	if _, err := large.Mul(3); !errors.Is(err, money.ErrOutOfRange) {
+		t.Errorf("Mul() error = %v, want %v", err, money.ErrOutOfRange)
+	}
+
+	clampTests := []struct {
+		input float64
+		want  int64
+	}{
+		{input: math.NaN(), want: 0},
+		{input: math.Inf(1), want: math.MaxInt64},
+		{input: -1e20, want: math.MinInt64},
+	}
+	for _, tt := range clampTests {
+		if got := money.FromFloat(tt.input); got.Cents() != tt.want {
+			t.Errorf("FromFloat(%v) = %d cents, want %d", tt.input, got.Cents(), tt.want)
+		}
+	}
+
+	for name, call := range map[string]func(){
+		"MustMul":   func() { large.MustMul(3) },
+		"MustScale": func() { large.MustScale(1, 0) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s did not panic", name)
+				}
+			}()
+			call()
+		}()
+	}
+}
+
+func TestMoney_Encoding(t *testing.T) {
+	t.Parallel()
+	type doc struct {
+		XMLName xml.Name    `xml:"DOC" json:"-"`
+		Amount  money.Money `xml:"AMOUNT" json:"amount"`
+	}
+
+	data, err := xml.Marshal(doc{Amount: money.FromFloat(1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<DOC><AMOUNT>1500.00</AMOUNT></DOC>"; string(data) != want {
+		t.Errorf("xml.Marshal() = %s, want %s", data, want)
+	}
+
+	for _, input := range []string{`{"amount":1500.5}`, `{"amount":"1500.50"}`} {
+		var got doc
+		if err := json.Unmarshal([]byte(input), &got); err != nil {
+			t.Fatalf("json.Unmarshal(%s) error = %v", input, err)
+		}
+		if got.Amount.Cents() != 150050 {
+			t.Errorf("json.Unmarshal(%s) = %s, want 1500.50", input, got.Amount)
+		}
+	}
+
+	data, err = json.Marshal(doc{Amount: money.MustParse("0.5")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"amount":0.50}`; string(data) != want {
+		t.Errorf("json.Marshal() = %s, want %s", data, want)
+	}
+}
@@ -0,0 +1,447 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package outbox implements a store and forward queue for signed receipts and
+// Z reports. Payloads are stored durably before they are submitted, so a sale
+// is not lost when the VFD server can not be reached, and are submitted in GC
+// order with exponential backoff once it is back. Payloads that fail in a way
+// resubmitting them will not change, such as an ACK code that is not retryable
+// or a 4xx response, are marked as failed.
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+)
+
+const (
+	// StatusPending entries are waiting to be submitted or resubmitted.
+	StatusPending Status = "pending"
+	// StatusSubmitted entries were accepted by the VFD server.
+	StatusSubmitted Status = "submitted"
+	// StatusFailed entries were rejected by the VFD server in a way that
+	// resubmitting the same payload will not change.
+	StatusFailed Status = "failed"
+
+	DefaultMinBackoff = 5 * time.Second
+	DefaultMaxBackoff = 5 * time.Minute
+
+	// DefaultCompactThreshold is the number of entries settled by Flush after
+	// which a Compacter store is compacted.
+	DefaultCompactThreshold = 1000
+)
+
+var (
+	// ErrDuplicateEntry is returned when a different payload is added with the
+	// GC of a receipt or the ZNUMBER of a report that is already in the outbox.
+	ErrDuplicateEntry = errors.New("outbox: duplicate entry")
+
+	// ErrEntryNotFound is returned by Retry when there is no entry with the given ID.
+	ErrEntryNotFound = errors.New("outbox: entry not found")
+)
+
+type (
+	// Status is the state of an Entry.
+	Status string
+
+	// Entry is a signed payload waiting in the outbox together with the counters
+	// it was signed with and the outcome of the submissions so far.
+	Entry struct {
+		ID          string        `json:"id"`
+		Action      vfd.Action    `json:"action"`
+		GC          int64         `json:"gc"`
+		DC          int64         `json:"dc,omitempty"`
+		ZNumber     string        `json:"znumber,omitempty"`
+		Sequence    int64         `json:"sequence"`
+		Payload     []byte        `json:"payload"`
+		Status      Status        `json:"status"`
+		Attempts    int           `json:"attempts"`
+		LastError   string        `json:"last_error,omitempty"`
+		NextAttempt time.Time     `json:"next_attempt,omitempty"`
+		CreatedAt   time.Time     `json:"created_at"`
+		UpdatedAt   time.Time     `json:"updated_at"`
+		Ack         *vfd.Response `json:"ack,omitempty"`
+	}
+
+	// SubmitFunc submits a signed payload, it is usually created by ClientSubmitter.
+	SubmitFunc func(ctx context.Context, action vfd.Action, payload []byte) (*vfd.Response, error)
+
+	// Compacter is implemented by stores that can drop the superseded states of
+	// their entries, such as FileStore. Flush compacts them once enough entries
+	// were settled, see WithCompaction.
+	Compacter interface {
+		Compact(ctx context.Context, dropSubmitted bool) error
+	}
+
+	// Outbox queues signed payloads in a Store and submits them with a SubmitFunc.
+	Outbox struct {
+		store         Store
+		submit        SubmitFunc
+		minBackoff    time.Duration
+		maxBackoff    time.Duration
+		now           func() time.Time
+		compactAfter  int
+		dropSubmitted bool
+
+		// mu makes sure payloads are added and entries saved one at a time,
+		// flushMu that only one Flush submits at a time. The submission itself
+		// is done without holding mu so that adding payloads is never blocked
+		// by a slow VFD server.
+		mu      sync.Mutex
+		flushMu sync.Mutex
+		settled int
+	}
+
+	Option func(*Outbox)
+)
+
+// WithBackoff sets the delay before an entry is resubmitted after a failure.
+// The delay starts at min and doubles with every failed attempt up to max.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *Outbox) {
+		o.minBackoff = min
+		o.maxBackoff = max
+	}
+}
+
+// WithCompaction sets after how many entries settled by Flush, submitted or
+// failed, a store that implements Compacter is compacted. Submitted entries are
+// removed from the store when dropSubmitted is true, they are then no longer
+// returned by Submitted and adding one of their payloads again queues it again.
+// A threshold of 0 disables compaction, the caller must then call Compact.
+func WithCompaction(threshold int, dropSubmitted bool) Option {
+	return func(o *Outbox) {
+		o.compactAfter = threshold
+		o.dropSubmitted = dropSubmitted
+	}
+}
+
+// WithClock replaces time.Now, it is meant for tests.
+func WithClock(now func() time.Time) Option {
+	return func(o *Outbox) {
+		o.now = now
+	}
+}
+
+// ClientSubmitter returns a SubmitFunc that submits receipts to receiptURL and
+// Z reports to reportURL using client.
+func ClientSubmitter(client *vfd.Client, receiptURL, reportURL string, headers *vfd.RequestHeaders) SubmitFunc {
+	return func(ctx context.Context, action vfd.Action, payload []byte) (*vfd.Response, error) {
+		url := receiptURL
+		if action == vfd.SubmitReportAction {
+			url = reportURL
+		}
+		return client.SubmitPayload(ctx, url, headers, action, payload)
+	}
+}
+
+func New(store Store, submit SubmitFunc, options ...Option) *Outbox {
+	o := &Outbox{
+		store:        store,
+		submit:       submit,
+		minBackoff:   DefaultMinBackoff,
+		maxBackoff:   DefaultMaxBackoff,
+		now:          time.Now,
+		compactAfter: DefaultCompactThreshold,
+	}
+	for _, option := range options {
+		option(o)
+	}
+	return o
+}
+
+// AddReceipt stores a signed receipt payload, as created by vfd.ReceiptBytes,
+// for submission. Adding the same payload again returns the existing entry.
+func (o *Outbox) AddReceipt(ctx context.Context, payload []byte) (*Entry, error) {
+	receipt, err := vfd.ParseReceipt(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.add(ctx, &Entry{
+		ID:      fmt.Sprintf("receipt-%d", receipt.Receipt.GC),
+		Action:  vfd.SubmitReceiptAction,
+		GC:      receipt.Receipt.GC,
+		DC:      receipt.Receipt.DC,
+		ZNumber: receipt.Receipt.ZNUM,
+		Payload: payload,
+	})
+}
+
+// AddReport stores a signed Z report payload, as created by vfd.ReportBytes,
+// for submission. The report is submitted after all the receipts added before it.
+// Adding the same payload again returns the existing entry.
+func (o *Outbox) AddReport(ctx context.Context, payload []byte) (*Entry, error) {
+	report, err := vfd.ParseReport(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.add(ctx, &Entry{
+		ID:      "report-" + report.Report.ZNUMBER,
+		Action:  vfd.SubmitReportAction,
+		ZNumber: report.Report.ZNUMBER,
+		Payload: payload,
+	})
+}
+
+func (o *Outbox) add(ctx context.Context, entry *Entry) (*Entry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries, err := o.store.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastGC, lastSequence int64
+	for _, existing := range entries {
+		if existing.ID == entry.ID {
+			if bytes.Equal(existing.Payload, entry.Payload) {
+				return existing, nil
+			}
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateEntry, entry.ID)
+		}
+		lastGC = max(lastGC, existing.GC)
+		lastSequence = max(lastSequence, existing.Sequence)
+	}
+
+	// a report covers the receipts added before it, it takes the highest GC
+	// so far and is ordered after the receipts with that GC
+	if entry.Action == vfd.SubmitReportAction {
+		entry.GC = lastGC
+	}
+
+	now := o.now()
+	entry.Sequence = lastSequence + 1
+	entry.Status = StatusPending
+	entry.CreatedAt = now
+	entry.UpdatedAt = now
+
+	if err := o.store.SaveEntry(ctx, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Flush submits the pending entries in order and returns how many were accepted.
+// It stops at the first entry that can not be submitted, or whose backoff has
+// not elapsed yet, so that receipts reach the VFD server in GC order. Entries
+// that fail in a way resubmitting will not change are marked as failed and
+// skipped. Payloads can be added while Flush is waiting for the VFD server,
+// they are submitted by the next Flush.
+func (o *Outbox) Flush(ctx context.Context) (submitted int, err error) {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+
+	defer func() {
+		if compactErr := o.compact(ctx); err == nil {
+			err = compactErr
+		}
+	}()
+
+	pending, err := o.Pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range pending {
+		if entry.NextAttempt.After(o.now()) {
+			return submitted, nil
+		}
+
+		response, err := o.submit(ctx, entry.Action, entry.Payload)
+		if ctx.Err() != nil {
+			return submitted, ctx.Err()
+		}
+
+		entry.Attempts++
+		entry.UpdatedAt = o.now()
+		entry.Ack = response
+
+		switch {
+		case err == nil:
+			entry.Status = StatusSubmitted
+			entry.LastError = ""
+			entry.NextAttempt = time.Time{}
+			submitted++
+			o.settled++
+
+		case !retryable(err):
+			entry.Status = StatusFailed
+			entry.LastError = err.Error()
+			o.settled++
+
+		default:
+			entry.LastError = err.Error()
+			entry.NextAttempt = entry.UpdatedAt.Add(o.backoff(entry.Attempts))
+			if saveErr := o.save(ctx, entry); saveErr != nil {
+				return submitted, saveErr
+			}
+			return submitted, err
+		}
+
+		if err := o.save(ctx, entry); err != nil {
+			return submitted, err
+		}
+	}
+
+	return submitted, nil
+}
+
+// Run calls Flush every interval until ctx is done. Submission errors are
+// recorded in the entries and do not stop Run.
+func (o *Outbox) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, _ = o.Flush(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Retry moves a failed entry back to pending so that the next Flush submits it again.
+func (o *Outbox) Retry(ctx context.Context, id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries, err := o.store.Entries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.ID != id {
+			continue
+		}
+		entry.Status = StatusPending
+		entry.NextAttempt = time.Time{}
+		entry.UpdatedAt = o.now()
+		return o.store.SaveEntry(ctx, entry)
+	}
+
+	return fmt.Errorf("%w: %s", ErrEntryNotFound, id)
+}
+
+// Pending returns the entries waiting to be submitted in submission order.
+func (o *Outbox) Pending(ctx context.Context) ([]*Entry, error) {
+	return o.withStatus(ctx, StatusPending)
+}
+
+// Failed returns the entries rejected by the VFD server.
+func (o *Outbox) Failed(ctx context.Context) ([]*Entry, error) {
+	return o.withStatus(ctx, StatusFailed)
+}
+
+// Submitted returns the entries accepted by the VFD server.
+func (o *Outbox) Submitted(ctx context.Context) ([]*Entry, error) {
+	return o.withStatus(ctx, StatusSubmitted)
+}
+
+func (o *Outbox) withStatus(ctx context.Context, status Status) ([]*Entry, error) {
+	entries, err := o.store.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Entry
+	for _, entry := range entries {
+		if entry.Status == status {
+			list = append(list, entry)
+		}
+	}
+	return list, nil
+}
+
+// save stores the outcome of a submission. Callers must hold o.flushMu.
+func (o *Outbox) save(ctx context.Context, entry *Entry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.store.SaveEntry(ctx, entry)
+}
+
+// compact compacts the store once enough entries were settled. Callers must
+// hold o.flushMu.
+func (o *Outbox) compact(ctx context.Context) error {
+	compacter, ok := o.store.(Compacter)
+	if !ok || o.compactAfter <= 0 || o.settled < o.compactAfter {
+		return nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := compacter.Compact(ctx, o.dropSubmitted); err != nil {
+		return err
+	}
+	o.settled = 0
+	return nil
+}
+
+// retryable tells if submitting the payload again may succeed after it failed
+// with err: ACK codes that vfd.IsRetryableCode accepts, network errors and 5xx
+// responses are.
+func retryable(err error) bool {
+	var ackErr *vfd.AckError
+	if errors.As(err, &ackErr) {
+		return vfd.IsRetryableCode(ackErr.Code)
+	}
+	return vfd.IsRetryable(err)
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.minBackoff
+	for i := 1; i < attempts && delay < o.maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, o.maxBackoff)
+}
+
+// before tells if e is submitted before other, by GC then receipts before
+// reports then by the order they were added.
+func (e *Entry) before(other *Entry) bool {
+	if e.GC != other.GC {
+		return e.GC < other.GC
+	}
+	if e.Action != other.Action {
+		return e.Action == vfd.SubmitReceiptAction
+	}
+	return e.Sequence < other.Sequence
+}
+
+func (e *Entry) clone() *Entry {
+	c := *e
+	c.Payload = append([]byte(nil), e.Payload...)
+	if e.Ack != nil {
+		ack := *e.Ack
+		c.Ack = &ack
+	}
+	return &c
+}
@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package outbox_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/outbox"
+)
+
+type fakeServer struct {
+	down     bool
+	rejectGC int64
+	received []string
+}
+
+func (s *fakeServer) submit(_ context.Context, action vfd.Action, payload []byte) (*vfd.Response, error) {
+	if s.down {
+		return nil, &vfd.NetworkError{Err: errors.New("connection refused"), Message: "receipt upload"}
+	}
+
+	if action == vfd.SubmitReportAction {
+		report, err := vfd.ParseReport(payload)
+		if err != nil {
+			return nil, err
+		}
+		s.received = append(s.received, "Z"+report.Report.ZNUMBER)
+		return &vfd.Response{Code: vfd.SuccessCode}, nil
+	}
+
+	receipt, err := vfd.ParseReceipt(payload)
+	if err != nil {
+		return nil, err
+	}
+	s.received = append(s.received, fmt.Sprintf("GC%d", receipt.Receipt.GC))
+	if receipt.Receipt.GC == s.rejectGC {
+		return &vfd.Response{Code: vfd.InvalidSignatureCode, Message: "Invalid Signature"}, vfd.ErrInvalidSignature
+	}
+	return &vfd.Response{Number: receipt.Receipt.GC, Code: vfd.SuccessCode}, nil
+}
+
+func receiptPayload(t *testing.T, key *rsa.PrivateKey, gc int64) []byte {
+	t.Helper()
+	params := vfd.ReceiptParams{
+		Date: "2023-01-01", Time: "08:00:00", TIN: "100553997", RegistrationID: "TZ0100553997",
+		EFDSerial: "10TZ101807", ReceiptNum: fmt.Sprint(gc), DailyCounter: gc, GlobalCounter: gc,
+		ZNum: "20230101", ReceiptVNum: fmt.Sprintf("55B8C5%d", gc),
+	}
+	items := []vfd.Item{vfd.NewItem("1", "Item 1", vfd.TaxableItemCode, 1, 1000, 0)}
+	payments := []vfd.Payment{vfd.NewPayment(vfd.CashPaymentType, 1000)}
+	payload, err := vfd.ReceiptBytes(key, params, vfd.Customer{Type: vfd.NonCustomerID}, items, payments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func reportPayload(t *testing.T, key *rsa.PrivateKey, znumber string) []byte {
+	t.Helper()
+	params := &vfd.ReportParams{Date: "2023-01-01", Time: "23:59:59", ZNumber: znumber}
+	payload, err := vfd.ReportBytes(key, params, vfd.Address{}, nil, nil, vfd.ReportTotals{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestOutbox_Flush(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx    = context.Background()
+		path   = filepath.Join(t.TempDir(), "outbox.jsonl")
+		now    = time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+		clock  = func() time.Time { return now }
+		server = &fakeServer{down: true, rejectGC: 2}
+		box    = outbox.New(outbox.NewFileStore(path), server.submit, outbox.WithClock(clock),
+			outbox.WithBackoff(time.Second, time.Minute))
+	)
+
+	for _, gc := range []int64{3, 1, 2} {
+		if _, err := box.AddReceipt(ctx, receiptPayload(t, key, gc)); err != nil {
+			t.Fatalf("AddReceipt(GC %d) error = %v", gc, err)
+		}
+	}
+	if _, err := box.AddReport(ctx, reportPayload(t, key, "20230101")); err != nil {
+		t.Fatalf("AddReport() error = %v", err)
+	}
+	if _, err := box.AddReceipt(ctx, receiptPayload(t, key, 4)); err != nil {
+		t.Fatalf("AddReceipt(GC 4) error = %v", err)
+	}
+
+	// the server is down, nothing is lost and the first entry backs off
+	n, err := box.Flush(ctx)
+	if !vfd.IsNetworkError(err) || n != 0 {
+		t.Fatalf("Flush() = %d, %v, want 0 and a network error", n, err)
+	}
+	pending, err := box.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 5 || pending[0].GC != 1 || pending[0].Attempts != 1 || pending[0].LastError == "" {
+		t.Fatalf("Pending() = %+v", pending)
+	}
+
+	// a restarted process reads the journal back, once the backoff has
+	// elapsed everything is submitted in GC order
+	server.down = false
+	now = now.Add(time.Second)
+	restarted := outbox.New(outbox.NewFileStore(path), server.submit, outbox.WithClock(clock))
+	n, err = restarted.Flush(ctx)
+	if err != nil || n != 4 {
+		t.Fatalf("Flush() = %d, %v, want 4, nil", n, err)
+	}
+	if want := []string{"GC1", "GC2", "GC3", "Z20230101", "GC4"}; !reflect.DeepEqual(server.received, want) {
+		t.Errorf("submission order = %v, want %v", server.received, want)
+	}
+
+	failed, err := restarted.Failed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].GC != 2 || failed[0].Ack.Code != vfd.InvalidSignatureCode {
+		t.Errorf("Failed() = %+v, want GC 2 rejected", failed)
+	}
+
+	// the same payload can be added again, a different one with the same GC can not
+	if _, err := restarted.AddReceipt(ctx, receiptPayload(t, key, 1)); err != nil {
+		t.Errorf("AddReceipt() of the same GC 1 payload error = %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.AddReceipt(ctx, receiptPayload(t, otherKey, 1)); !errors.Is(err, outbox.ErrDuplicateEntry) {
+		t.Errorf("AddReceipt() of another GC 1 error = %v, want %v", err, outbox.ErrDuplicateEntry)
+	}
+
+	if err := restarted.Retry(ctx, failed[0].ID); err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	server.rejectGC = 0
+	if n, err := restarted.Flush(ctx); err != nil || n != 1 {
+		t.Errorf("Flush() after Retry = %d, %v, want 1, nil", n, err)
+	}
+}
+
+func TestOutbox_FlushDoesNotBlockAdd(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx     = context.Background()
+		started = make(chan struct{})
+		release = make(chan struct{})
+		submit  = func(ctx context.Context, action vfd.Action, payload []byte) (*vfd.Response, error) {
+			close(started)
+			<-release
+			return &vfd.Response{Code: vfd.SuccessCode}, nil
+		}
+		box = outbox.New(outbox.NewMemoryStore(), submit)
+	)
+
+	if _, err := box.AddReceipt(ctx, receiptPayload(t, key, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	flushed := make(chan error)
+	go func() {
+		_, err := box.Flush(ctx)
+		flushed <- err
+	}()
+	<-started
+
+	added := make(chan error)
+	go func() {
+		_, err := box.AddReceipt(ctx, receiptPayload(t, key, 2))
+		added <- err
+	}()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Errorf("AddReceipt() during Flush error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("AddReceipt() is blocked by the submission in flight")
+	}
+
+	close(release)
+	if err := <-flushed; err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	pending, err := box.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].GC != 2 {
+		t.Errorf("Pending() = %+v, want the receipt added during Flush", pending)
+	}
+}
+
+func TestOutbox_FlushPermanentErrors(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		err        error
+		wantFailed bool
+	}{
+		{name: "4xx response", err: errors.New("unexpected status 400"), wantFailed: true},
+		{name: "invalid server signature", err: vfd.ErrInvalidServerSignature, wantFailed: true},
+		{name: "ack code", err: vfd.ErrInvalidSignature, wantFailed: true},
+		{name: "unhandled exception", err: vfd.ErrUnhandledException, wantFailed: false},
+		{name: "5xx response", err: &vfd.StatusError{StatusCode: 503}, wantFailed: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var (
+				ctx    = context.Background()
+				submit = func(ctx context.Context, action vfd.Action, payload []byte) (*vfd.Response, error) {
+					receipt, err := vfd.ParseReceipt(payload)
+					if err != nil || receipt.Receipt.GC == 1 {
+						return nil, tt.err
+					}
+					return &vfd.Response{Code: vfd.SuccessCode}, nil
+				}
+				box = outbox.New(outbox.NewMemoryStore(), submit)
+			)
+
+			for _, gc := range []int64{1, 2} {
+				if _, err := box.AddReceipt(ctx, receiptPayload(t, key, gc)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			n, err := box.Flush(ctx)
+			failed, failedErr := box.Failed(ctx)
+			if failedErr != nil {
+				t.Fatal(failedErr)
+			}
+
+			if tt.wantFailed {
+				if err != nil || n != 1 || len(failed) != 1 {
+					t.Errorf("Flush() = %d, %v with %d failed, want the entry failed and the next one submitted", n, err, len(failed))
+				}
+				return
+			}
+			if err == nil || n != 0 || len(failed) != 0 {
+				t.Errorf("Flush() = %d, %v with %d failed, want the entry kept pending", n, err, len(failed))
+			}
+		})
+	}
+}
+
+func TestOutbox_Compaction(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx    = context.Background()
+		path   = filepath.Join(t.TempDir(), "outbox.jsonl")
+		server = &fakeServer{}
+		box    = outbox.New(outbox.NewFileStore(path), server.submit, outbox.WithCompaction(3, true))
+	)
+
+	for gc := int64(1); gc <= 2; gc++ {
+		if _, err := box.AddReceipt(ctx, receiptPayload(t, key, gc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := box.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ids := entryIDs(t, outbox.NewFileStore(path)); len(ids) != 2 {
+		t.Fatalf("journal has %v below the threshold, want 2 entries", ids)
+	}
+
+	if _, err := box.AddReceipt(ctx, receiptPayload(t, key, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := box.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ids := entryIDs(t, outbox.NewFileStore(path)); len(ids) != 0 {
+		t.Errorf("journal has %v after compaction, want the submitted entries dropped", ids)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Golang-Tanzania/tra-vfd/internal/fileutil"
+)
+
+type (
+	// Store persists outbox entries. SaveEntry inserts the entry or replaces the
+	// one with the same ID. Entries returns every entry in any order.
+	Store interface {
+		SaveEntry(ctx context.Context, entry *Entry) error
+		Entries(ctx context.Context) ([]*Entry, error)
+	}
+
+	// MemoryStore keeps entries in memory. Entries are lost when the process exits.
+	MemoryStore struct {
+		mu      sync.Mutex
+		entries map[string]*Entry
+	}
+
+	// FileStore is a journal of entries, one JSON object per line. Every save
+	// appends the new state of the entry and is synced to disk before it returns,
+	// the last line of an entry wins when the journal is read back. Compact
+	// rewrites the journal with only the latest state of every entry.
+	FileStore struct {
+		Path string
+
+		mu      sync.Mutex
+		loaded  bool
+		entries map[string]*Entry
+	}
+)
+
+var (
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*FileStore)(nil)
+
+	_ Compacter = (*FileStore)(nil)
+)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*Entry)}
+}
+
+func (s *MemoryStore) SaveEntry(_ context.Context, entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]*Entry)
+	}
+	s.entries[entry.ID] = entry.clone()
+	return nil
+}
+
+func (s *MemoryStore) Entries(_ context.Context) ([]*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cloneAll(s.entries), nil
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+func (s *FileStore) SaveEntry(_ context.Context, entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("could not encode outbox entry: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o700); err != nil {
+		return fmt.Errorf("could not create outbox directory: %w", err)
+	}
+
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open outbox journal: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write outbox journal: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("could not sync outbox journal: %w", err)
+	}
+
+	s.entries[entry.ID] = entry.clone()
+	return nil
+}
+
+func (s *FileStore) Entries(_ context.Context) ([]*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return cloneAll(s.entries), nil
+}
+
+// Compact rewrites the journal so that it holds a single line per entry.
+// Entries accepted by the VFD server are dropped when dropSubmitted is true.
+func (s *FileStore) Compact(_ context.Context, dropSubmitted bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	var (
+		buf  bytes.Buffer
+		kept = make(map[string]*Entry, len(s.entries))
+	)
+	for _, entry := range cloneAll(s.entries) {
+		if dropSubmitted && entry.Status == StatusSubmitted {
+			continue
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("could not encode outbox entry: %w", err)
+		}
+		buf.Write(append(line, '\n'))
+		kept[entry.ID] = entry
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o700); err != nil {
+		return fmt.Errorf("could not create outbox directory: %w", err)
+	}
+	if err := fileutil.WriteAtomic(s.Path, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("could not compact outbox journal: %w", err)
+	}
+
+	// the journal on disk is only replaced once the write succeeded
+	s.entries = kept
+	return nil
+}
+
+// load reads the journal once. A partially written last line, as left by a
+// crash in the middle of a write, is ignored and truncated away so that the
+// next save starts on a line of its own.
+func (s *FileStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.entries = make(map[string]*Entry)
+
+	file, err := os.Open(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.loaded = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open outbox journal: %w", err)
+	}
+	defer file.Close()
+
+	var (
+		reader   = bufio.NewReader(file)
+		complete int64
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				if err := os.Truncate(s.Path, complete); err != nil {
+					return fmt.Errorf("could not truncate torn outbox journal: %w", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read outbox journal: %w", err)
+		}
+		complete += int64(len(line))
+
+		entry := &Entry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return fmt.Errorf("corrupt outbox journal %s: %w", s.Path, err)
+		}
+		s.entries[entry.ID] = entry
+	}
+
+	s.loaded = true
+	return nil
+}
+
+func cloneAll(entries map[string]*Entry) []*Entry {
+	list := make([]*Entry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry.clone())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].before(list[j])
+	})
+	return list
+}
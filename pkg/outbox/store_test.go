@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package outbox_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Golang-Tanzania/tra-vfd/pkg/outbox"
+)
+
+func entryIDs(t *testing.T, store outbox.Store) []string {
+	t.Helper()
+	entries, err := store.Entries(context.Background())
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func TestFileStore_TornLine(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+
+	if err := outbox.NewFileStore(path).SaveEntry(ctx, &outbox.Entry{ID: "a", GC: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of a write leaves a line without its newline
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"id":"b","gc":2,"pay`); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	restarted := outbox.NewFileStore(path)
+	if got := entryIDs(t, restarted); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("Entries() after the crash = %v, want [a]", got)
+	}
+	if err := restarted.SaveEntry(ctx, &outbox.Entry{ID: "c", GC: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := entryIDs(t, outbox.NewFileStore(path)); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("Entries() after the second restart = %v, want [a c]", got)
+	}
+}
+
+func TestFileStore_Compact(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	store := outbox.NewFileStore(path)
+
+	for _, entry := range []*outbox.Entry{
+		{ID: "a", GC: 1, Status: outbox.StatusSubmitted},
+		{ID: "b", GC: 2, Status: outbox.StatusPending},
+		{ID: "b", GC: 2, Status: outbox.StatusFailed},
+	} {
+		if err := store.SaveEntry(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Compact(ctx, true); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if got := entryIDs(t, outbox.NewFileStore(path)); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("Entries() after Compact() = %v, want [b]", got)
+	}
+
+	// a failed compaction leaves the entries as they were
+	failing := outbox.NewFileStore(path)
+	if err := failing.SaveEntry(ctx, &outbox.Entry{ID: "c", GC: 3, Status: outbox.StatusSubmitted}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := failing.Compact(ctx, true); err == nil {
+		t.Fatal("Compact() error = nil, want an error when the journal can not be replaced")
+	}
+	if got := entryIDs(t, failing); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("Entries() after a failed Compact() = %v, want [b c]", got)
+	}
+}
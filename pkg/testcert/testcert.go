@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package testcert generates RSA keys, self-signed and CA issued X.509
+// certificates and PKCS#12 (.pfx) files for tests, so that the signing paths
+// can be exercised without a certificate issued by TRA.
+package testcert
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	// DefaultBits is the size of the generated RSA keys.
+	DefaultBits = 2048
+	// DefaultValidity is how long generated certificates are valid from now.
+	DefaultValidity = 24 * time.Hour
+)
+
+type (
+	// Certificate is a generated certificate together with its private key.
+	// Chain holds the certificates of the issuing CAs, starting with the one
+	// that issued Cert, it is empty for self-signed certificates.
+	Certificate struct {
+		Key   *rsa.PrivateKey
+		Cert  *x509.Certificate
+		Chain []*x509.Certificate
+	}
+
+	// Option changes the certificate being generated.
+	Option func(*config)
+
+	config struct {
+		bits      int
+		serial    *big.Int
+		notBefore time.Time
+		notAfter  time.Time
+	}
+)
+
+// WithBits sets the size of the RSA key.
+func WithBits(bits int) Option {
+	return func(c *config) {
+		c.bits = bits
+	}
+}
+
+// WithSerialNumber sets the serial number of the certificate.
+func WithSerialNumber(serial *big.Int) Option {
+	return func(c *config) {
+		c.serial = serial
+	}
+}
+
+// WithValidity sets the period the certificate is valid, use a period in the
+// past to generate an expired certificate.
+func WithValidity(notBefore, notAfter time.Time) Option {
+	return func(c *config) {
+		c.notBefore = notBefore
+		c.notAfter = notAfter
+	}
+}
+
+// NewKey generates an RSA key of the given size, DefaultBits if bits is zero.
+func NewKey(bits int) (*rsa.PrivateKey, error) {
+	if bits == 0 {
+		bits = DefaultBits
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate key: %w", err)
+	}
+
+	return key, nil
+}
+
+// SelfSigned generates a self-signed certificate for signing payloads.
+func SelfSigned(commonName string, options ...Option) (*Certificate, error) {
+	return create(commonName, false, nil, options)
+}
+
+// NewCA generates a self-signed CA certificate that can issue certificates.
+func NewCA(commonName string, options ...Option) (*Certificate, error) {
+	return create(commonName, true, nil, options)
+}
+
+// Issue generates a certificate for signing payloads issued by the CA.
+func (ca *Certificate) Issue(commonName string, options ...Option) (*Certificate, error) {
+	return create(commonName, false, ca, options)
+}
+
+// IssueCA generates an intermediate CA certificate issued by the CA.
+func (ca *Certificate) IssueCA(commonName string, options ...Option) (*Certificate, error) {
+	return create(commonName, true, ca, options)
+}
+
+// PFX encodes the key and the certificate as PKCS#12. With withChain the
+// certificates of the issuing CAs are included too, pkcs12.Decode rejects such
+// a file and vfd.LoadCert falls back to vfd.LoadCertChain.
+func (c *Certificate) PFX(password string, withChain bool) ([]byte, error) {
+	var chain []*x509.Certificate
+	if withChain {
+		chain = c.Chain
+	}
+
+	data, err := pkcs12.Encode(rand.Reader, c.Key, c.Cert, chain, password)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode PFX: %w", err)
+	}
+
+	return data, nil
+}
+
+// WritePFX writes the PFX to path, see PFX.
+func (c *Certificate) WritePFX(path, password string, withChain bool) error {
+	data, err := c.PFX(password, withChain)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("could not write PFX: %w", err)
+	}
+
+	return nil
+}
+
+func create(commonName string, isCA bool, issuer *Certificate, options []Option) (*Certificate, error) {
+	now := time.Now()
+	cfg := &config{
+		notBefore: now.Add(-time.Hour),
+		notAfter:  now.Add(DefaultValidity),
+	}
+	for _, option := range options {
+		option(cfg)
+	}
+
+	if cfg.serial == nil {
+		serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+		if err != nil {
+			return nil, fmt.Errorf("could not generate serial number: %w", err)
+		}
+		cfg.serial = serial
+	}
+
+	key, err := NewKey(cfg.bits)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          cfg.serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             cfg.notBefore,
+		NotAfter:              cfg.notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.Cert, issuer.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("could not create certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate: %w", err)
+	}
+
+	generated := &Certificate{Key: key, Cert: cert}
+	if issuer != nil {
+		generated.Chain = append([]*x509.Certificate{issuer.Cert}, issuer.Chain...)
+	}
+
+	return generated, nil
+}
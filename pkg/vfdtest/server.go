@@ -0,0 +1,591 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package vfdtest provides a fake VFD server for integration tests. It serves the
+// registration, token, receipt and Z report endpoints with the XML and JSON
+// responses of the TRA server, checks the headers and signatures of the requests,
+// tracks the global counter of the receipts and signs its responses with a
+// generated certificate.
+package vfdtest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/internal/models"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/testcert"
+)
+
+// Credentials of the device registered by default.
+const (
+	DefaultTIN        = "100553997"
+	DefaultCertKey    = "10TZ101807"
+	DefaultCertSerial = "7d2a0f1c58e64b3a"
+	DefaultUsername   = "babaEdgar"
+	DefaultPassword   = "SuperSecret"
+	DefaultTokenTTL   = time.Hour
+)
+
+// Paths of the endpoints, they are the same as on the TRA server.
+const (
+	RegistrationPath  = "/api/vfdRegReq"
+	FetchTokenPath    = "/vfdtoken" //nolint:gosec
+	SubmitReceiptPath = "/api/efdmsRctInfo"
+	SubmitReportPath  = "/api/efdmszreport"
+	VerifyReceiptPath = "/verify/"
+)
+
+type (
+	// Server is a fake VFD server. The zero value is not usable, create one with
+	// NewServer and close it with Close.
+	Server struct {
+		*httptest.Server
+
+		// Key signs the responses, Certificate is the self-signed certificate of
+		// Key, pass it to vfd.WithServerCertificate to check the signatures.
+		Key         *rsa.PrivateKey
+		Certificate *x509.Certificate
+
+		mu               sync.Mutex
+		clientKey        *rsa.PublicKey
+		certSerial       string
+		certKey          string
+		registration     vfd.RegistrationResponse
+		tokenTTL         time.Duration
+		counterErrorCode int64
+		now              func() time.Time
+
+		tokens        map[string]time.Time
+		lastGC        int64
+		acks          map[vfd.Action][]int64
+		statuses      map[vfd.Action][]int
+		requests      map[vfd.Action]int
+		receipts      []*vfd.SignedReceipt
+		reports       []*vfd.SignedReport
+		counterErrors []*CounterError
+	}
+
+	// Option configures a Server.
+	Option func(*Server)
+
+	// CounterError describes a receipt whose GC does not follow the GC of the
+	// previous receipt, a gap when GC is higher than Expected and a duplicate
+	// when it is lower.
+	CounterError struct {
+		GC       int64
+		Expected int64
+	}
+
+	registrationAck struct {
+		XMLName xml.Name `xml:"EFDMSRESP"`
+		vfd.RegistrationResponse
+	}
+)
+
+// WithClientKey sets the public key of the device certificate. The signatures
+// of registrations, receipts and Z reports are checked against it, without it
+// they only have to be present.
+func WithClientKey(key *rsa.PublicKey) Option {
+	return func(s *Server) {
+		s.clientKey = key
+	}
+}
+
+// WithCertSerial sets the serial expected in the Cert-Serial header.
+func WithCertSerial(serial string) Option {
+	return func(s *Server) {
+		s.certSerial = serial
+	}
+}
+
+// WithRegistration replaces the details returned to a successful registration.
+// Its TIN is expected in registrations, receipts and Z reports, its GC is the
+// counter of the last receipt issued before registration.
+func WithRegistration(registration vfd.RegistrationResponse, certKey string) Option {
+	return func(s *Server) {
+		s.registration = registration
+		s.certKey = certKey
+	}
+}
+
+// WithTokenTTL sets how long the tokens issued by the server are valid.
+func WithTokenTTL(ttl time.Duration) Option {
+	return func(s *Server) {
+		s.tokenTTL = ttl
+	}
+}
+
+// WithCounterErrorCode sets the ACK code returned for receipts that break the
+// GC sequence. By default they are accepted and only recorded, see CounterErrors.
+func WithCounterErrorCode(code int64) Option {
+	return func(s *Server) {
+		s.counterErrorCode = code
+	}
+}
+
+// WithClock replaces time.Now, it is used for token expiry and the date and
+// time of acknowledgements.
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.now = now
+	}
+}
+
+// DefaultRegistration returns the details of the device registered by default.
+func DefaultRegistration() vfd.RegistrationResponse {
+	return vfd.RegistrationResponse{
+		REGID:       "TZ0100553997",
+		SERIAL:      DefaultCertKey,
+		UIN:         "09VFDWEBAPI-10131758710TZ100553997",
+		TIN:         DefaultTIN,
+		VRN:         "40005334W",
+		MOBILE:      "0713655545",
+		STREET:      "MAGOMENI",
+		CITY:        "DAR ES SALAAM",
+		COUNTRY:     "TANZANIA",
+		NAME:        "XYZ LTD",
+		RECEIPTCODE: "55B8C5",
+		REGION:      "DAR ES SALAAM",
+		ROUTINGKEY:  vfd.SubmitReceiptRoutingKey,
+		GC:          100,
+		TAXOFFICE:   "Tax Office Kinondoni",
+		USERNAME:    DefaultUsername,
+		PASSWORD:    DefaultPassword,
+		TOKENPATH:   FetchTokenPath,
+		TAXCODES:    vfd.TAXCODES{CODEA: "18", CODEB: "0", CODEC: "0", CODED: "0"},
+	}
+}
+
+// NewServer starts a fake VFD server. It panics if the signing certificate can
+// not be generated, like httptest.NewServer does when it can not listen.
+func NewServer(options ...Option) *Server {
+	cert, err := testcert.SelfSigned("vfdtest")
+	if err != nil {
+		panic(fmt.Sprintf("vfdtest: %v", err))
+	}
+
+	s := &Server{
+		Key:          cert.Key,
+		Certificate:  cert.Cert,
+		certSerial:   DefaultCertSerial,
+		certKey:      DefaultCertKey,
+		registration: DefaultRegistration(),
+		tokenTTL:     DefaultTokenTTL,
+		now:          time.Now,
+		tokens:       make(map[string]time.Time),
+		acks:         make(map[vfd.Action][]int64),
+		statuses:     make(map[vfd.Action][]int),
+		requests:     make(map[vfd.Action]int),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.lastGC = s.registration.GC
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(RegistrationPath, s.handle(vfd.RegisterClientAction, s.register))
+	mux.HandleFunc(FetchTokenPath, s.handle(vfd.FetchTokenAction, s.token))
+	mux.HandleFunc(SubmitReceiptPath, s.handle(vfd.SubmitReceiptAction, s.receipt))
+	mux.HandleFunc(SubmitReportPath, s.handle(vfd.SubmitReportAction, s.report))
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// URLs returns the URLs of the endpoints, for vfd.WithURLs.
+func (s *Server) URLs() vfd.URL {
+	return vfd.URL{
+		Registration:  s.URL + RegistrationPath,
+		FetchToken:    s.URL + FetchTokenPath,
+		SubmitReceipt: s.URL + SubmitReceiptPath,
+		SubmitReport:  s.URL + SubmitReportPath,
+		VerifyReceipt: s.URL + VerifyReceiptPath,
+	}
+}
+
+// QueueAck makes the next requests of the action that pass the header and
+// signature checks fail with the given ACK codes, one code per request.
+// A request acknowledged with a code other than vfd.SuccessCode is not recorded.
+func (s *Server) QueueAck(action vfd.Action, codes ...int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks[action] = append(s.acks[action], codes...)
+}
+
+// QueueStatus makes the next requests of the action fail with the given HTTP
+// status codes before they are checked, one status per request.
+func (s *Server) QueueStatus(action vfd.Action, statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[action] = append(s.statuses[action], statuses...)
+}
+
+// ExpireTokens invalidates every token issued so far.
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]time.Time)
+}
+
+// Requests returns how many requests of the action the server received.
+func (s *Server) Requests(action vfd.Action) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[action]
+}
+
+// Receipts returns the accepted receipts in the order they were received.
+func (s *Server) Receipts() []*vfd.SignedReceipt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*vfd.SignedReceipt(nil), s.receipts...)
+}
+
+// Reports returns the accepted Z reports in the order they were received.
+func (s *Server) Reports() []*vfd.SignedReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*vfd.SignedReport(nil), s.reports...)
+}
+
+// LastGC returns the highest GC received so far.
+func (s *Server) LastGC() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastGC
+}
+
+// CounterErrors returns the receipts that broke the GC sequence.
+func (s *Server) CounterErrors() []*CounterError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*CounterError(nil), s.counterErrors...)
+}
+
+func (e *CounterError) Error() string {
+	if e.GC < e.Expected {
+		return fmt.Sprintf("duplicate GC %d, expected %d", e.GC, e.Expected)
+	}
+	return fmt.Sprintf("GC gap: got %d, expected %d", e.GC, e.Expected)
+}
+
+// handle counts the request and replies with a queued status, if any, before
+// calling next with the request body.
+func (s *Server) handle(action vfd.Action, next func(w http.ResponseWriter, r *http.Request, body []byte)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.requests[action]++
+		if queued := s.statuses[action]; len(queued) > 0 {
+			s.statuses[action] = queued[1:]
+			writeError(w, queued[0], http.StatusText(queued[0]))
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		next(w, r, body)
+	}
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request, body []byte) {
+	reject := func(code int64) {
+		s.writeSigned(w, "EFDMSRESP", &registrationAck{RegistrationResponse: vfd.RegistrationResponse{
+			ACKCODE: strconv.FormatInt(code, 10),
+			ACKMSG:  vfd.ParseErrorCode(code),
+		}})
+	}
+
+	if r.Header.Get("Client") != vfd.RegistrationRequestClient {
+		reject(vfd.InvalidClientHeader)
+		return
+	}
+	if !s.validCertSerial(r) {
+		reject(vfd.InvalidSerial)
+		return
+	}
+
+	var request models.REGDATAEFDMS
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.validSignature(body, "REGDATA", request.EFDMSSIGNATURE) {
+		reject(vfd.InvalidCertificate)
+		return
+	}
+	if request.REGDATA.TIN != s.registration.TIN {
+		reject(vfd.InvalidTaxID)
+		return
+	}
+	if request.REGDATA.CERTKEY != s.certKey {
+		reject(vfd.InvalidSerial)
+		return
+	}
+	if code := s.nextAck(vfd.RegisterClientAction); code != vfd.SuccessCode {
+		reject(code)
+		return
+	}
+
+	registration := s.registration
+	registration.ACKCODE = strconv.FormatInt(vfd.SuccessCode, 10)
+	registration.ACKMSG = "Registration Successful"
+	s.writeSigned(w, "EFDMSRESP", &registrationAck{RegistrationResponse: registration})
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if form.Get("grant_type") != "password" || form.Get("username") != s.registration.USERNAME ||
+		form.Get("password") != s.registration.PASSWORD {
+		w.Header().Set("ACKCODE", strconv.FormatInt(vfd.InvalidSignatureCode, 10))
+		w.Header().Set("ACKMSG", "Invalid username or password")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&vfd.TokenResponse{Error: "invalid_grant"})
+		return
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	token := hex.EncodeToString(raw)
+	s.tokens[token] = s.now().Add(s.tokenTTL)
+
+	w.Header().Set("ACKCODE", strconv.FormatInt(vfd.SuccessCode, 10))
+	w.Header().Set("ACKMSG", vfd.ParseErrorCode(vfd.SuccessCode))
+	_ = json.NewEncoder(w).Encode(&vfd.TokenResponse{
+		AccessToken: token,
+		TokenType:   "bearer",
+		ExpiresIn:   int64(s.tokenTTL / time.Second),
+	})
+}
+
+func (s *Server) receipt(w http.ResponseWriter, r *http.Request, body []byte) {
+	reply := func(number, code int64) {
+		s.writeSigned(w, "RCTACK", &models.RCTACK{
+			RCTNUM:  number,
+			DATE:    s.now().Format("2006-01-02"),
+			TIME:    s.now().Format("15:04:05"),
+			ACKCODE: code,
+			ACKMSG:  vfd.ParseErrorCode(code),
+		})
+	}
+
+	if !s.checkSubmission(w, r, vfd.SubmitReceiptRoutingKey) {
+		return
+	}
+
+	receipt, err := vfd.ParseReceipt(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	gc := receipt.Receipt.GC
+
+	if !s.validCertSerial(r) {
+		reply(gc, vfd.InvalidSerial)
+		return
+	}
+	if !s.validSignature(body, "RCT", receipt.Signature) {
+		reply(gc, vfd.InvalidSignatureCode)
+		return
+	}
+	if receipt.Receipt.TIN != s.registration.TIN {
+		reply(gc, vfd.InvalidTaxID)
+		return
+	}
+	if code := s.nextAck(vfd.SubmitReceiptAction); code != vfd.SuccessCode {
+		reply(gc, code)
+		return
+	}
+
+	// the same receipt sent again, for example after a lost response, is
+	// acknowledged again
+	for _, accepted := range s.receipts {
+		if accepted.Receipt.GC == gc && bytes.Equal(accepted.Signed, receipt.Signed) {
+			reply(gc, vfd.SuccessCode)
+			return
+		}
+	}
+
+	if expected := s.lastGC + 1; gc != expected {
+		s.counterErrors = append(s.counterErrors, &CounterError{GC: gc, Expected: expected})
+		if s.counterErrorCode != vfd.SuccessCode {
+			reply(gc, s.counterErrorCode)
+			return
+		}
+	}
+
+	s.lastGC = max(s.lastGC, gc)
+	s.receipts = append(s.receipts, receipt)
+	reply(gc, vfd.SuccessCode)
+}
+
+func (s *Server) report(w http.ResponseWriter, r *http.Request, body []byte) {
+	if !s.checkSubmission(w, r, vfd.SubmitReportRoutingKey) {
+		return
+	}
+
+	report, err := vfd.ParseReport(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	number, _ := strconv.ParseInt(report.Report.ZNUMBER, 10, 64)
+
+	reply := func(code int64) {
+		s.writeSigned(w, "ZACK", &models.ZACK{
+			ZNUMBER: number,
+			DATE:    s.now().Format("2006-01-02"),
+			TIME:    s.now().Format("15:04:05"),
+			ACKCODE: code,
+			ACKMSG:  vfd.ParseErrorCode(code),
+		})
+	}
+
+	switch {
+	case !s.validCertSerial(r):
+		reply(vfd.InvalidSerial)
+	case !s.validSignature(body, "ZREPORT", report.Signature):
+		reply(vfd.InvalidSignatureCode)
+	case report.Report.TIN != s.registration.TIN:
+		reply(vfd.InvalidTaxID)
+	default:
+		code := s.nextAck(vfd.SubmitReportAction)
+		if code == vfd.SuccessCode {
+			s.reports = append(s.reports, report)
+		}
+		reply(code)
+	}
+}
+
+// checkSubmission checks the headers of receipt and Z report submissions that
+// the TRA server rejects with an HTTP status rather than an ACK code.
+func (s *Server) checkSubmission(w http.ResponseWriter, r *http.Request, routingKey string) bool {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), vfd.ContentTypeXML) {
+		writeError(w, http.StatusUnsupportedMediaType, "expected "+vfd.ContentTypeXML)
+		return false
+	}
+	if r.Header.Get("Routing-Key") != routingKey {
+		writeError(w, http.StatusBadRequest, "invalid Routing-Key")
+		return false
+	}
+
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	expiry, ok := s.tokens[token]
+	if !strings.EqualFold(scheme, "bearer") || !ok || !s.now().Before(expiry) {
+		writeError(w, http.StatusUnauthorized, "Authorization has been denied for this request.")
+		return false
+	}
+
+	return true
+}
+
+// validCertSerial checks the Cert-Serial header, it holds the base64 encoded serial.
+func (s *Server) validCertSerial(r *http.Request) bool {
+	serial, err := base64.StdEncoding.DecodeString(r.Header.Get("Cert-Serial"))
+	return err == nil && string(serial) == s.certSerial
+}
+
+func (s *Server) validSignature(body []byte, element, signature string) bool {
+	if signature == "" {
+		return false
+	}
+	if s.clientKey == nil {
+		return true
+	}
+
+	signed, err := vfd.SignedElement(body, element)
+	if err != nil {
+		return false
+	}
+	return vfd.VerifySignature(s.clientKey, signed, signature) == nil
+}
+
+func (s *Server) nextAck(action vfd.Action) int64 {
+	queued := s.acks[action]
+	if len(queued) == 0 {
+		return vfd.SuccessCode
+	}
+	s.acks[action] = queued[1:]
+	return queued[0]
+}
+
+// writeSigned writes the element wrapped in an EFDMS document together with the
+// signature of its exact bytes.
+func (s *Server) writeSigned(w http.ResponseWriter, name string, element any) {
+	out, err := xml.Marshal(element)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	signature, err := vfd.Sign(s.Key, out)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("could not sign %s: %v", name, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", vfd.ContentTypeXML)
+	_, _ = fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><EFDMS>%s<EFDMSSIGNATURE>%s</EFDMSSIGNATURE></EFDMS>`,
+		out, base64.StdEncoding.EncodeToString(signature))
+}
+
+// writeError writes the error document returned by the TRA server.
+func writeError(w http.ResponseWriter, status int, message string) {
+	out, _ := xml.Marshal(&models.Error{Message: message})
+	w.Header().Set("Content-Type", vfd.ContentTypeXML)
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfdtest_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/vfdtest"
+)
+
+func receipt(gc int64) *vfd.ReceiptRequest {
+	return &vfd.ReceiptRequest{
+		Params: vfd.ReceiptParams{
+			Date:           "2023-01-01",
+			Time:           "08:00:00",
+			TIN:            vfdtest.DefaultTIN,
+			RegistrationID: "TZ0100553997",
+			EFDSerial:      vfdtest.DefaultCertKey,
+			ReceiptNum:     fmt.Sprint(gc),
+			DailyCounter:   gc - 100,
+			GlobalCounter:  gc,
+			ZNum:           "20230101",
+			ReceiptVNum:    fmt.Sprintf("55B8C5%d", gc),
+		},
+		Customer: vfd.Customer{Type: vfd.NonCustomerID},
+		Items:    []vfd.Item{vfd.NewItem("1", "Item 1", vfd.TaxableItemCode, 1, 1000, 0)},
+		Payments: []vfd.Payment{vfd.NewPayment(vfd.CashPaymentType, 1000)},
+	}
+}
+
+func TestServer_TokenAckCode(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := vfdtest.NewServer(vfdtest.WithClientKey(&key.PublicKey))
+	defer server.Close()
+
+	// the ACK code this server uses to reject a token
+	const tokenRejected int64 = 9
+	ctx := context.Background()
+	client := vfd.NewClient(
+		vfd.WithHttpClient(server.Client()),
+		vfd.WithURLs(server.URLs()),
+		vfd.WithServerCertificate(server.Certificate),
+		vfd.WithPrivateKey(key),
+		vfd.WithCertSerial(vfdtest.DefaultCertSerial),
+		vfd.WithCredentials(vfdtest.DefaultTIN, vfdtest.DefaultCertKey),
+		vfd.WithTokenAckCodes(tokenRejected),
+	)
+	if _, err := client.RegisterDevice(ctx); err != nil {
+		t.Fatalf("RegisterDevice() error = %v", err)
+	}
+
+	server.QueueAck(vfd.SubmitReceiptAction, tokenRejected)
+	response, err := client.Receipt(ctx, receipt(101))
+	if err != nil {
+		t.Fatalf("Receipt() error = %v", err)
+	}
+	if !response.Reauthenticated {
+		t.Errorf("Receipt() = %+v, want Reauthenticated", response)
+	}
+	if got := server.Requests(vfd.FetchTokenAction); got != 2 {
+		t.Errorf("token requests = %d, want 2", got)
+	}
+
+	// the receipt is sent once more only
+	server.QueueAck(vfd.SubmitReceiptAction, tokenRejected, tokenRejected)
+	var ackErr *vfd.AckError
+	if _, err := client.Receipt(ctx, receipt(102)); !errors.As(err, &ackErr) || ackErr.Code != tokenRejected {
+		t.Errorf("Receipt() error = %v, want ack code %d", err, tokenRejected)
+	}
+	if got := server.Requests(vfd.SubmitReceiptAction); got != 4 {
+		t.Errorf("receipt requests = %d, want 4", got)
+	}
+	if got := server.Requests(vfd.FetchTokenAction); got != 3 {
+		t.Errorf("token requests = %d, want 3", got)
+	}
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := vfdtest.NewServer(vfdtest.WithClientKey(&key.PublicKey))
+	defer server.Close()
+
+	var (
+		ctx    = context.Background()
+		client = vfd.NewClient(
+			vfd.WithHttpClient(server.Client()),
+			vfd.WithURLs(server.URLs()),
+			vfd.WithServerCertificate(server.Certificate),
+			vfd.WithRetryPolicy(vfd.RetryPolicy{}),
+			vfd.WithPrivateKey(key),
+			vfd.WithCertSerial(vfdtest.DefaultCertSerial),
+			vfd.WithCredentials(vfdtest.DefaultTIN, vfdtest.DefaultCertKey),
+		)
+	)
+
+	registration, err := client.RegisterDevice(ctx)
+	if err != nil {
+		t.Fatalf("RegisterDevice() error = %v", err)
+	}
+	if registration.GC != 100 || registration.USERNAME != vfdtest.DefaultUsername {
+		t.Fatalf("RegisterDevice() = %+v", registration)
+	}
+
+	// a gap is accepted and recorded, an ACK code can be queued
+	for _, gc := range []int64{101, 103} {
+		if _, err := client.Receipt(ctx, receipt(gc)); err != nil {
+			t.Fatalf("Receipt(GC %d) error = %v", gc, err)
+		}
+	}
+	if errs := server.CounterErrors(); len(errs) != 1 || errs[0].GC != 103 || errs[0].Expected != 102 {
+		t.Errorf("CounterErrors() = %v, want a gap at 102", errs)
+	}
+
+	server.QueueAck(vfd.SubmitReceiptAction, vfd.ApprovalRequired)
+	if _, err := client.Receipt(ctx, receipt(104)); !errors.Is(err, vfd.ErrApprovalRequired) {
+		t.Errorf("Receipt() error = %v, want %v", err, vfd.ErrApprovalRequired)
+	}
+	if got := server.LastGC(); got != 103 {
+		t.Errorf("LastGC() = %d, want 103", got)
+	}
+
+	// expired tokens are refreshed by the client
+	server.ExpireTokens()
+	params := client.Profile().NewReportParams()
+	params.Date, params.Time, params.ZNumber = "2023-01-01", "23:59:59", "20230101"
+	response, err := client.Report(ctx, &vfd.ReportRequest{
+		Params: params,
+		Totals: &vfd.ReportTotals{},
+	})
+	if err != nil {
+		t.Fatalf("Report() error = %v", err)
+	}
+	if response.Number != 20230101 || !response.Reauthenticated {
+		t.Errorf("Report() = %+v", response)
+	}
+	if got := server.Requests(vfd.FetchTokenAction); got != 2 {
+		t.Errorf("token requests = %d, want 2", got)
+	}
+
+	// a receipt signed with another key is rejected
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := vfd.ReceiptBytes(otherKey, receipt(104).Params, vfd.Customer{Type: vfd.NonCustomerID},
+		receipt(104).Items, receipt(104).Payments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "receipt.xml")
+	if err := os.WriteFile(path, payload, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = vfd.SubmitRawRequest(ctx, &vfd.RequestHeaders{
+		CertSerial:  vfdtest.DefaultCertSerial,
+		TokenSource: vfd.NewTokenManager(server.URLs().FetchToken, client.Profile().NewTokenRequest()),
+	}, &vfd.RawRequest{Action: vfd.SubmitReceiptAction, FilePath: path, URL: server.URLs().SubmitReceipt})
+	if !errors.Is(err, vfd.ErrInvalidSignature) {
+		t.Errorf("SubmitRawRequest() error = %v, want %v", err, vfd.ErrInvalidSignature)
+	}
+	if got := len(server.Receipts()); got != 2 {
+		t.Errorf("Receipts() = %d, want 2", got)
+	}
+}
+
+func TestServer_Headers(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := vfdtest.NewServer(vfdtest.WithTokenTTL(time.Minute))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		certSerial string
+		tin        string
+		want       error
+	}{
+		{name: "registered", certSerial: vfdtest.DefaultCertSerial, tin: vfdtest.DefaultTIN},
+		{name: "wrong serial", certSerial: "0000", tin: vfdtest.DefaultTIN, want: vfd.ErrInvalidSerial},
+		{name: "wrong TIN", certSerial: vfdtest.DefaultCertSerial, tin: "100000000", want: vfd.ErrInvalidTIN},
+	}
+
+	for _, tt := range tests {
+		_, err := vfd.Register(context.Background(), server.URLs().Registration, key, &vfd.RegistrationRequest{
+			ContentType: vfd.ContentTypeXML,
+			CertSerial:  tt.certSerial,
+			Tin:         tt.tin,
+			CertKey:     vfdtest.DefaultCertKey,
+		})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Register() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	_, err = vfd.SubmitPayload(context.Background(), server.URLs().SubmitReceipt,
+		&vfd.RequestHeaders{CertSerial: vfdtest.DefaultCertSerial, BearerToken: "not-issued"},
+		vfd.SubmitReceiptAction, []byte("<EFDMS></EFDMS>"))
+	if !errors.Is(err, vfd.ErrUnauthorized) {
+		t.Errorf("SubmitPayload() with an unknown token error = %v, want %v", err, vfd.ErrUnauthorized)
+	}
+}
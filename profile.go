@@ -0,0 +1,353 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Golang-Tanzania/tra-vfd/internal/fileutil"
+)
+
+const (
+	// DeviceProfileSchemaVersion is the version of the DeviceProfile format
+	// written by this package.
+	DeviceProfileSchemaVersion               = 1
+	JSONProfileFormat          ProfileFormat = "json"
+	XMLProfileFormat           ProfileFormat = "xml"
+)
+
+var (
+	// ErrEncryptionKeyRequired is returned when saving a DeviceProfile that
+	// contains a password without providing an encryption key.
+	ErrEncryptionKeyRequired = errors.New("encryption key required to store secrets")
+
+	// ErrUnsupportedProfileVersion is returned when loading a DeviceProfile
+	// written with a newer or unknown schema version.
+	ErrUnsupportedProfileVersion = errors.New("unsupported device profile schema version")
+)
+
+type (
+	// ProfileFormat is the encoding used to save a DeviceProfile.
+	ProfileFormat string
+
+	// DeviceProfile holds the details returned by the VFD server when the
+	// device is registered. Registration is a one-time operation so the profile
+	// should be saved and loaded on startup instead of registering again.
+	// CertSerial and RegistrationDate are not part of the registration
+	// response, they are kept here so that the profile has everything needed
+	// to submit receipts and Z reports.
+	DeviceProfile struct {
+		RegistrationID   string
+		Serial           string
+		UIN              string
+		TIN              string
+		VRN              string
+		Mobile           string
+		Address          string
+		Street           string
+		City             string
+		Country          string
+		Name             string
+		ReceiptCode      string
+		Region           string
+		RoutingKey       string
+		GC               int64
+		TaxOffice        string
+		Username         string
+		Password         string
+		TokenPath        string
+		TaxCodes         TAXCODES
+		CertSerial       string
+		RegistrationDate string
+	}
+
+	// deviceProfileFile is the layout of a saved DeviceProfile. The password
+	// is only ever written encrypted.
+	deviceProfileFile struct {
+		XMLName           xml.Name        `json:"-" xml:"DEVICEPROFILE"`
+		SchemaVersion     int             `json:"schema_version" xml:"SCHEMAVERSION"`
+		RegistrationID    string          `json:"reg_id" xml:"REGID"`
+		Serial            string          `json:"serial" xml:"SERIAL"`
+		UIN               string          `json:"uin" xml:"UIN"`
+		TIN               string          `json:"tin" xml:"TIN"`
+		VRN               string          `json:"vrn" xml:"VRN"`
+		Mobile            string          `json:"mobile" xml:"MOBILE"`
+		Address           string          `json:"address" xml:"ADDRESS"`
+		Street            string          `json:"street" xml:"STREET"`
+		City              string          `json:"city" xml:"CITY"`
+		Country           string          `json:"country" xml:"COUNTRY"`
+		Name              string          `json:"name" xml:"NAME"`
+		ReceiptCode       string          `json:"receipt_code" xml:"RECEIPTCODE"`
+		Region            string          `json:"region" xml:"REGION"`
+		RoutingKey        string          `json:"routing_key" xml:"ROUTINGKEY"`
+		GC                int64           `json:"gc" xml:"GC"`
+		TaxOffice         string          `json:"tax_office" xml:"TAXOFFICE"`
+		Username          string          `json:"username" xml:"USERNAME"`
+		EncryptedPassword string          `json:"encrypted_password,omitempty" xml:"ENCRYPTEDPASSWORD,omitempty"`
+		TokenPath         string          `json:"token_path" xml:"TOKENPATH"`
+		TaxCodes          profileTaxCodes `json:"tax_codes" xml:"TAXCODES"`
+		CertSerial        string          `json:"cert_serial,omitempty" xml:"CERTSERIAL,omitempty"`
+		RegistrationDate  string          `json:"registration_date,omitempty" xml:"REGISTRATIONDATE,omitempty"`
+	}
+
+	profileTaxCodes struct {
+		CODEA string `json:"code_a" xml:"CODEA"`
+		CODEB string `json:"code_b" xml:"CODEB"`
+		CODEC string `json:"code_c" xml:"CODEC"`
+		CODED string `json:"code_d" xml:"CODED"`
+	}
+)
+
+// NewDeviceProfile creates a DeviceProfile from the registration response.
+func NewDeviceProfile(response *RegistrationResponse) *DeviceProfile {
+	return &DeviceProfile{
+		RegistrationID: response.REGID,
+		Serial:         response.SERIAL,
+		UIN:            response.UIN,
+		TIN:            response.TIN,
+		VRN:            response.VRN,
+		Mobile:         response.MOBILE,
+		Address:        response.ADDRESS,
+		Street:         response.STREET,
+		City:           response.CITY,
+		Country:        response.COUNTRY,
+		Name:           response.NAME,
+		ReceiptCode:    response.RECEIPTCODE,
+		Region:         response.REGION,
+		RoutingKey:     response.ROUTINGKEY,
+		GC:             response.GC,
+		TaxOffice:      response.TAXOFFICE,
+		Username:       response.USERNAME,
+		Password:       response.PASSWORD,
+		TokenPath:      response.TOKENPATH,
+		TaxCodes: TAXCODES{
+			CODEA: response.TAXCODES.CODEA,
+			CODEB: response.TAXCODES.CODEB,
+			CODEC: response.TAXCODES.CODEC,
+			CODED: response.TAXCODES.CODED,
+		},
+	}
+}
+
+// NewReceiptParams returns ReceiptParams pre-filled with the device details. The
+// date, time and counters still have to be set for each receipt.
+func (p *DeviceProfile) NewReceiptParams() ReceiptParams {
+	return ReceiptParams{
+		TIN:            p.TIN,
+		RegistrationID: p.RegistrationID,
+		EFDSerial:      p.Serial,
+	}
+}
+
+// NewReportParams returns ReportParams pre-filled with the device details. The
+// date, time and Z number still have to be set for each report.
+func (p *DeviceProfile) NewReportParams() *ReportParams {
+	return &ReportParams{
+		VRN:              p.VRN,
+		TIN:              p.TIN,
+		UIN:              p.UIN,
+		TaxOffice:        p.TaxOffice,
+		RegistrationID:   p.RegistrationID,
+		EFDSerial:        p.Serial,
+		RegistrationDate: p.RegistrationDate,
+	}
+}
+
+// NewTokenRequest returns the TokenRequest for the credentials issued at registration.
+func (p *DeviceProfile) NewTokenRequest() *TokenRequest {
+	return &TokenRequest{
+		Username:  p.Username,
+		Password:  p.Password,
+		GrantType: PasswordGrantType,
+	}
+}
+
+// NewAddress returns the business Address used in the Z report header.
+func (p *DeviceProfile) NewAddress() *Address {
+	return &Address{
+		Name:    p.Name,
+		Street:  p.Street,
+		Mobile:  p.Mobile,
+		City:    p.City,
+		Country: p.Country,
+	}
+}
+
+// EncodeDeviceProfile encodes the profile in the given format. The password is
+// encrypted with key using AES-GCM, so key must be 16, 24 or 32 bytes long. A key
+// is required only when the profile has a password.
+func EncodeDeviceProfile(profile *DeviceProfile, format ProfileFormat, key []byte) ([]byte, error) {
+	file := deviceProfileFile{
+		SchemaVersion:    DeviceProfileSchemaVersion,
+		RegistrationID:   profile.RegistrationID,
+		Serial:           profile.Serial,
+		UIN:              profile.UIN,
+		TIN:              profile.TIN,
+		VRN:              profile.VRN,
+		Mobile:           profile.Mobile,
+		Address:          profile.Address,
+		Street:           profile.Street,
+		City:             profile.City,
+		Country:          profile.Country,
+		Name:             profile.Name,
+		ReceiptCode:      profile.ReceiptCode,
+		Region:           profile.Region,
+		RoutingKey:       profile.RoutingKey,
+		GC:               profile.GC,
+		TaxOffice:        profile.TaxOffice,
+		Username:         profile.Username,
+		TokenPath:        profile.TokenPath,
+		CertSerial:       profile.CertSerial,
+		RegistrationDate: profile.RegistrationDate,
+		TaxCodes: profileTaxCodes{
+			CODEA: profile.TaxCodes.CODEA,
+			CODEB: profile.TaxCodes.CODEB,
+			CODEC: profile.TaxCodes.CODEC,
+			CODED: profile.TaxCodes.CODED,
+		},
+	}
+
+	if profile.Password != "" {
+		if len(key) == 0 {
+			return nil, ErrEncryptionKeyRequired
+		}
+		ciphertext, err := encrypt(key, []byte(profile.Password))
+		if err != nil {
+			return nil, fmt.Errorf("could not encrypt password: %w", err)
+		}
+		file.EncryptedPassword = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+
+	switch format {
+	case JSONProfileFormat:
+		return json.MarshalIndent(&file, "", "  ")
+	case XMLProfileFormat:
+		out, err := xml.MarshalIndent(&file, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(xml.Header), out...), nil
+	default:
+		return nil, fmt.Errorf("unknown device profile format %q", format)
+	}
+}
+
+// DecodeDeviceProfile decodes a profile written by EncodeDeviceProfile. The same
+// key used to encode the profile must be used to decode it.
+func DecodeDeviceProfile(data []byte, format ProfileFormat, key []byte) (*DeviceProfile, error) {
+	var file deviceProfileFile
+	switch format {
+	case JSONProfileFormat:
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("could not decode device profile: %w", err)
+		}
+	case XMLProfileFormat:
+		if err := xml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("could not decode device profile: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown device profile format %q", format)
+	}
+
+	if file.SchemaVersion < 1 || file.SchemaVersion > DeviceProfileSchemaVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedProfileVersion, file.SchemaVersion)
+	}
+
+	profile := &DeviceProfile{
+		RegistrationID:   file.RegistrationID,
+		Serial:           file.Serial,
+		UIN:              file.UIN,
+		TIN:              file.TIN,
+		VRN:              file.VRN,
+		Mobile:           file.Mobile,
+		Address:          file.Address,
+		Street:           file.Street,
+		City:             file.City,
+		Country:          file.Country,
+		Name:             file.Name,
+		ReceiptCode:      file.ReceiptCode,
+		Region:           file.Region,
+		RoutingKey:       file.RoutingKey,
+		GC:               file.GC,
+		TaxOffice:        file.TaxOffice,
+		Username:         file.Username,
+		TokenPath:        file.TokenPath,
+		CertSerial:       file.CertSerial,
+		RegistrationDate: file.RegistrationDate,
+		TaxCodes: TAXCODES{
+			CODEA: file.TaxCodes.CODEA,
+			CODEB: file.TaxCodes.CODEB,
+			CODEC: file.TaxCodes.CODEC,
+			CODED: file.TaxCodes.CODED,
+		},
+	}
+
+	if file.EncryptedPassword != "" {
+		if len(key) == 0 {
+			return nil, ErrEncryptionKeyRequired
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(file.EncryptedPassword)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode password: %w", err)
+		}
+		password, err := decrypt(key, ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt password: %w", err)
+		}
+		profile.Password = string(password)
+	}
+
+	return profile, nil
+}
+
+// SaveDeviceProfile writes the profile to path. Files ending in .xml are written
+// as XML, everything else as JSON.
+func SaveDeviceProfile(path string, profile *DeviceProfile, key []byte) error {
+	data, err := EncodeDeviceProfile(profile, profileFormat(path), key)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(path, data, 0o600)
+}
+
+// LoadDeviceProfile reads a profile saved with SaveDeviceProfile.
+func LoadDeviceProfile(path string, key []byte) (*DeviceProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read device profile: %w", err)
+	}
+	return DecodeDeviceProfile(data, profileFormat(path), key)
+}
+
+func profileFormat(path string) ProfileFormat {
+	if strings.EqualFold(filepath.Ext(path), ".xml") {
+		return XMLProfileFormat
+	}
+	return JSONProfileFormat
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+)
+
+func TestDeviceProfile_SaveLoad(t *testing.T) {
+	t.Parallel()
+	var (
+		dir = t.TempDir()
+		key = bytes.Repeat([]byte{1}, 32)
+	)
+
+	profile := vfd.NewDeviceProfile(&vfd.RegistrationResponse{
+		REGID:       "TZ0100553997",
+		SERIAL:      "10TZ101807",
+		UIN:         "09VFDWEBAPI-10131758710TZ100553997",
+		TIN:         "100553997",
+		VRN:         "40005334W",
+		MOBILE:      "0713655545",
+		STREET:      "MAGOMENI",
+		CITY:        "DAR ES SALAAM",
+		COUNTRY:     "TANZANIA",
+		NAME:        "XYZ LTD",
+		RECEIPTCODE: "55B8C5",
+		ROUTINGKEY:  "vfdrct",
+		GC:          100,
+		TAXOFFICE:   "Tax Office Kinondoni",
+		USERNAME:    "babaEdgar",
+		PASSWORD:    "SuperSecret",
+		TAXCODES:    vfd.TAXCODES{CODEA: "18", CODEB: "0", CODEC: "0", CODED: "0"},
+	})
+	profile.CertSerial = "7d2b0d4a"
+
+	for _, name := range []string{"profile.json", "profile.xml"} {
+		path := filepath.Join(dir, name)
+		if err := vfd.SaveDeviceProfile(path, profile, nil); !errors.Is(err, vfd.ErrEncryptionKeyRequired) {
+			t.Fatalf("%s: SaveDeviceProfile() without key error = %v, want ErrEncryptionKeyRequired", name, err)
+		}
+		if err := vfd.SaveDeviceProfile(path, profile, key); err != nil {
+			t.Fatalf("%s: SaveDeviceProfile() error = %v", name, err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: could not read saved profile: %v", name, err)
+		}
+		if bytes.Contains(data, []byte(profile.Password)) {
+			t.Errorf("%s: saved profile contains the plain password", name)
+		}
+
+		got, err := vfd.LoadDeviceProfile(path, key)
+		if err != nil {
+			t.Fatalf("%s: LoadDeviceProfile() error = %v", name, err)
+		}
+		if !reflect.DeepEqual(got, profile) {
+			t.Errorf("%s: LoadDeviceProfile() = %+v, want %+v", name, got, profile)
+		}
+	}
+
+	if got := profile.NewTokenRequest(); got.Username != "babaEdgar" || got.Password != "SuperSecret" ||
+		got.GrantType != vfd.PasswordGrantType {
+		t.Errorf("NewTokenRequest() = %+v", got)
+	}
+	if got := profile.NewReceiptParams(); got.TIN != profile.TIN || got.EFDSerial != profile.Serial ||
+		got.RegistrationID != profile.RegistrationID {
+		t.Errorf("NewReceiptParams() = %+v", got)
+	}
+}
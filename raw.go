@@ -24,25 +24,22 @@ package vfd
 import (
 	"bytes"
 	"context"
-	"encoding/xml"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 
 	"github.com/Golang-Tanzania/tra-vfd/pkg/env"
-
-	vhttp "github.com/Golang-Tanzania/tra-vfd/internal/http"
-	"github.com/Golang-Tanzania/tra-vfd/internal/models"
 )
 
 type (
 	// RawRequest contains information needed to send receipt/z report file
-	// to the vfd server.
+	// to the vfd server. URL, when set, is used instead of the URL of Env
+	// and Action, for example to submit to a fake server in tests.
 	RawRequest struct {
 		Env      env.Env
 		Action   Action
 		FilePath string
+		URL      string
 	}
 )
 
@@ -50,13 +47,6 @@ type (
 // content of the file is read and submitted to the server as is.
 func SubmitRawRequest(ctx context.Context, headers *RequestHeaders,
 	raw *RawRequest) (*Response, error) {
-	var (
-		client      = vhttp.Instance()
-		certSerial  = headers.CertSerial
-		bearerToken = headers.BearerToken
-		reqURL      = RequestURL(raw.Env, raw.Action)
-	)
-
 	payload := bytes.NewBuffer(nil)
 
 	// read the file if the file path is provided and return the content as bytes
@@ -71,82 +61,51 @@ func SubmitRawRequest(ctx context.Context, headers *RequestHeaders,
 		}
 	}
 
-	newContext, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(newContext, http.MethodPost, reqURL, payload)
-	if err != nil {
-		return nil, err
+	url := raw.URL
+	if url == "" {
+		url = RequestURL(raw.Env, raw.Action)
 	}
 
-	req.Header.Set("Content-Type", ContentTypeXML)
-	req.Header.Set("Cert-Serial", encodeBase64String(certSerial))
-	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", bearerToken))
-
-	if raw.Action == SubmitReceiptAction {
-		req.Header.Set("Routing-Key", SubmitReceiptRoutingKey)
-	}
-
-	if raw.Action == SubmitReportAction {
-		req.Header.Set("Routing-Key", SubmitReportRoutingKey)
-	}
+	return submitPayload(ctx, defaultClient(), url, headers,
+		raw.Action, payload.Bytes(), "raw request submit")
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, checkNetworkError(newContext, "raw request submit", err)
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "registration: could not close response body %v", err)
-		}
-	}(resp.Body)
+// SubmitPayload submits a receipt or a Z report that is already signed, for
+// example one created by ReceiptBytes or ReportBytes and stored for later.
+// action must be SubmitReceiptAction or SubmitReportAction.
+func SubmitPayload(ctx context.Context, url string, headers *RequestHeaders, action Action,
+	payload []byte,
+) (*Response, error) {
+	return submitPayload(ctx, defaultClient(), url, headers, action, payload, "payload submit")
+}
 
-	out, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
+func submitPayload(ctx context.Context, client *Client, url string, headers *RequestHeaders,
+	action Action, payload []byte, operation string,
+) (*Response, error) {
+	var routingKey string
+	switch action {
+	case SubmitReceiptAction:
+		routingKey = SubmitReceiptRoutingKey
+	case SubmitReportAction:
+		routingKey = SubmitReportRoutingKey
+	default:
+		return nil, fmt.Errorf("couldnt figure out the action")
 	}
 
-	if resp.StatusCode == 500 {
-		errBody := models.Error{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&errBody)
-		if err != nil {
-			return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
-		}
-
-		return nil, fmt.Errorf("registration error: %s", errBody.Message)
-	}
+	newContext, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	if raw.Action == SubmitReportAction {
-		response := models.ReportAckEFDMS{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&response)
+	return withRetry(newContext, client.retry, operation, func() (*Response, error) {
+		result, err := postPayload(newContext, client, url, headers,
+			routingKey, payload, operation)
 		if err != nil {
-			return nil, fmt.Errorf("%v : %w", ErrReportSubmitFailed, err)
+			return nil, err
 		}
 
-		return &Response{
-			Number:  response.ZACK.ZNUMBER,
-			Date:    response.ZACK.DATE,
-			Time:    response.ZACK.TIME,
-			Code:    response.ZACK.ACKCODE,
-			Message: response.ZACK.ACKMSG,
-		}, nil
-	}
-
-	if raw.Action == SubmitReceiptAction {
-		response := models.RCTACKEFDMS{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&response)
-		if err != nil {
-			return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
+		if action == SubmitReportAction {
+			return client.decodeReportAck(result)
 		}
-		return &Response{
-			Number:  response.RCTACK.RCTNUM,
-			Date:    response.RCTACK.DATE,
-			Time:    response.RCTACK.TIME,
-			Code:    response.RCTACK.ACKCODE,
-			Message: response.RCTACK.ACKMSG,
-		}, nil
-	}
 
-	return nil, fmt.Errorf("couldnt figure out the action")
+		return client.decodeReceiptAck(result)
+	})
 }
@@ -22,20 +22,15 @@
 package vfd
 
 import (
-	"bytes"
 	"context"
 	"crypto/rsa"
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
 	"strings"
 
 	"github.com/Golang-Tanzania/tra-vfd/pkg/env"
-
-	xhttp "github.com/Golang-Tanzania/tra-vfd/internal/http"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
 
 	"github.com/Golang-Tanzania/tra-vfd/internal/models"
 )
@@ -45,133 +40,123 @@ var ErrReceiptUploadFailed = errors.New("receipt upload failed")
 type (
 	// ReceiptParams contains parameters icluded while sending the receipts
 	ReceiptParams struct {
-		Date           string
-		Time           string
-		TIN            string
-		RegistrationID string
-		EFDSerial      string
-		ReceiptNum     string
-		DailyCounter   int64
-		GlobalCounter  int64
-		ZNum           string
-		ReceiptVNum    string
+		Date           string `json:"date"`
+		Time           string `json:"time"`
+		TIN            string `json:"tin"`
+		RegistrationID string `json:"registration_id"`
+		EFDSerial      string `json:"efd_serial"`
+		ReceiptNum     string `json:"receipt_num"`
+		DailyCounter   int64  `json:"daily_counter"`
+		GlobalCounter  int64  `json:"global_counter"`
+		ZNum           string `json:"znum"`
+		ReceiptVNum    string `json:"receipt_vnum"`
 	}
 
 	// Customer contains customer information
 	Customer struct {
-		Type   CustomerID
-		ID     string
-		Name   string
-		Mobile string
+		Type   CustomerID `json:"type"`
+		ID     string     `json:"id,omitempty"`
+		Name   string     `json:"name,omitempty"`
+		Mobile string     `json:"mobile,omitempty"`
 	}
 
-	// Item represent a purchased item. TaxCode is an integer that can take the
-	// value of 1 for taxable items and 3 for non-taxable items.
+	// Item represent a purchased item. TaxCode is the TaxCategory of the item,
+	// 1 through 5, see StandardTaxCategory and the other TaxCategory constants.
 	// Discount is for the whole package not a unit discount
 	Item struct {
-		ID          string
-		Description string
-		TaxCode     int64
-		Quantity    float64
-		UnitPrice   float64
-		Discount    float64
+		ID          string      `json:"id"`
+		Description string      `json:"description"`
+		TaxCode     TaxCategory `json:"tax_code"`
+		Quantity    float64     `json:"quantity"`
+		UnitPrice   money.Money `json:"unit_price"`
+		Discount    money.Money `json:"discount"`
+	}
+
+	// ReceiptOptions changes how the receipt payload is generated.
+	// AllVATGroups adds all the five VAT groups to VATTOTALS, with zero amounts
+	// for the groups not used by any item, the way Z reports do. By default
+	// only the groups used by the items are added.
+	// VATTable holds the rates the items are taxed at, the built-in rates of
+	// NewVATTable if nil.
+	ReceiptOptions struct {
+		AllVATGroups bool      `json:"all_vat_groups,omitempty"`
+		VATTable     *VATTable `json:"-"`
 	}
 
 	ReceiptRequest struct {
-		Params   ReceiptParams
-		Customer Customer
-		Items    []Item
-		Payments []Payment
+		Params   ReceiptParams  `json:"params"`
+		Customer Customer       `json:"customer"`
+		Items    []Item         `json:"items"`
+		Payments []Payment      `json:"payments"`
+		Options  ReceiptOptions `json:"options"`
 	}
 )
 
-// SubmitReceipt uploads a receipt to the VFD server.
+// NewItem creates an Item from float amounts, the unit price and the discount
+// are rounded to the nearest cent.
+func NewItem(id, description string, taxCode int64, quantity, unitPrice, discount float64) Item {
+	return Item{
+		ID:          id,
+		Description: description,
+		TaxCode:     TaxCategory(taxCode),
+		Quantity:    quantity,
+		UnitPrice:   money.FromFloat(unitPrice),
+		Discount:    money.FromFloat(discount),
+	}
+}
+
+// SubmitReceipt uploads a receipt to the VFD server. The receipt is validated
+// first and rejected with a *ValidationError if it has violations of
+// SeverityError, see ReceiptRequest.Validate. Use a Client configured with
+// WithValidationMode to change that.
 func SubmitReceipt(ctx context.Context, requestURL string, headers *RequestHeaders, privateKey *rsa.PrivateKey,
 	receiptRequest *ReceiptRequest,
 ) (*Response, error) {
-	client := xhttp.Instance()
-	return submitReceipt(ctx, client, requestURL, headers, privateKey, receiptRequest)
+	return submitReceipt(ctx, defaultClient(), requestURL, headers, privateKey, receiptRequest)
 }
 
-func submitReceipt(ctx context.Context, client *http.Client, requestURL string, headers *RequestHeaders,
+func submitReceipt(ctx context.Context, client *Client, requestURL string, headers *RequestHeaders,
 	privateKey *rsa.PrivateKey, rct *ReceiptRequest,
 ) (*Response, error) {
-	var (
-		certSerial  = headers.CertSerial
-		bearerToken = headers.BearerToken
-	)
-
 	newContext, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	payload, err := ReceiptBytes(
-		privateKey, rct.Params, rct.Customer, rct.Items, rct.Payments)
-	if err != nil {
+	if err := rct.Validate().Err(client.validation); err != nil {
 		return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
 	}
 
-	req, err := http.NewRequestWithContext(newContext, http.MethodPost, requestURL,
-		bytes.NewBuffer(payload))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", ContentTypeXML)
-	req.Header.Set("Routing-Key", SubmitReceiptRoutingKey)
-	req.Header.Set("Cert-Serial", encodeBase64String(certSerial))
-	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", bearerToken))
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, checkNetworkError(newContext, "receipt upload", err)
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "registration: could not close response body %v", err)
-		}
-	}(resp.Body)
-
-	out, err := io.ReadAll(resp.Body)
+	payload, err := ReceiptBytesWithOptions(
+		privateKey, rct.Params, rct.Customer, rct.Items, rct.Payments, rct.Options)
 	if err != nil {
 		return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
 	}
 
-	if resp.StatusCode == 500 {
-		errBody := models.Error{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&errBody)
+	return withRetry(newContext, client.retry, "receipt upload", func() (*Response, error) {
+		result, err := postPayload(newContext, client, requestURL, headers,
+			SubmitReceiptRoutingKey, payload, "receipt upload")
 		if err != nil {
-			return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
+			return nil, err
 		}
 
-		return nil, fmt.Errorf("registration error: %s", errBody.Message)
-	}
-
-	response := models.RCTACKEFDMS{}
-	err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&response)
-	if err != nil {
-		return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
-	}
-
-	return &Response{
-		Number:  response.RCTACK.RCTNUM,
-		Date:    response.RCTACK.DATE,
-		Time:    response.RCTACK.TIME,
-		Code:    response.RCTACK.ACKCODE,
-		Message: response.RCTACK.ACKMSG,
-	}, nil
+		return client.decodeReceiptAck(result)
+	})
 }
 
-func generateReceipt(params ReceiptParams, customer Customer, items []Item, payments []Payment) *models.RCT {
+func generateReceipt(params ReceiptParams, customer Customer, items []Item, payments []Payment,
+	opts ReceiptOptions,
+) (*models.RCT, error) {
 	rctPayments := make([]*models.PAYMENT, len(payments))
 	for i, payment := range payments {
 		rctPayments[i] = &models.PAYMENT{
 			PMTTYPE:   string(payment.Type),
-			PMTAMOUNT: fmt.Sprintf("%.2f", payment.Amount),
+			PMTAMOUNT: payment.Amount,
 		}
 	}
 
-	RESULTS := ProcessItems(items)
+	RESULTS, err := processItems(items, params.Date, opts, false)
+	if err != nil {
+		return nil, err
+	}
 	ITEMS := models.ITEMS{ITEM: RESULTS.ITEMS}
 	TOTALS := RESULTS.TOTALS
 	VATTOTALS := models.VATTOTALS{VATTOTAL: RESULTS.VATTOTALS}
@@ -198,27 +183,25 @@ func generateReceipt(params ReceiptParams, customer Customer, items []Item, paym
 		VATTOTALS:  VATTOTALS,
 	}
 
-	// round off all values to 2 decimal places
-	RECEIPT.RoundOff()
-
-	return RECEIPT
+	return RECEIPT, nil
 }
 
+// ReceiptBytes returns the signed receipt payload using the default ReceiptOptions.
 func ReceiptBytes(privateKey *rsa.PrivateKey, params ReceiptParams, customer Customer,
 	items []Item, payments []Payment,
 ) ([]byte, error) {
-	receipt := generateReceipt(params, customer, items, payments)
-	receiptBytes, err := xml.Marshal(receipt)
+	return ReceiptBytesWithOptions(privateKey, params, customer, items, payments, ReceiptOptions{})
+}
+
+// ReceiptBytesWithOptions returns the signed receipt payload. The payload only
+// depends on its input, the same receipt always produces the same bytes.
+func ReceiptBytesWithOptions(privateKey *rsa.PrivateKey, params ReceiptParams, customer Customer,
+	items []Item, payments []Payment, opts ReceiptOptions,
+) ([]byte, error) {
+	receiptBytes, err := receiptPayload(params, customer, items, payments, opts)
 	if err != nil {
-		return nil, fmt.Errorf("could not marshal receipt: %w", err)
+		return nil, err
 	}
-	replacer := strings.NewReplacer(
-		"<PAYMENT>", "",
-		"</PAYMENT>", "",
-		"<VATTOTAL>", "",
-		"</VATTOTAL>", "")
-
-	receiptBytes = []byte(replacer.Replace(string(receiptBytes)))
 	signedReceipt, err := Sign(privateKey, receiptBytes)
 	if err != nil {
 		return nil, fmt.Errorf("could not sign receipt: %w", err)
@@ -232,6 +215,22 @@ func ReceiptBytes(privateKey *rsa.PrivateKey, params ReceiptParams, customer Cus
 	return []byte(report), nil
 }
 
+// receiptPayload returns the unsigned RCT element of the receipt.
+func receiptPayload(params ReceiptParams, customer Customer, items []Item, payments []Payment,
+	opts ReceiptOptions,
+) ([]byte, error) {
+	receipt, err := generateReceipt(params, customer, items, payments, opts)
+	if err != nil {
+		return nil, err
+	}
+	receiptBytes, err := xml.Marshal(receipt)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal receipt: %w", err)
+	}
+
+	return receiptBytes, nil
+}
+
 // ReceiptLink creates a link to the receipt it accepts RECEIPTCODE, GC and the RECEIPTTIME
 // and env.Env to know if the receipt was created during testing or production.
 func ReceiptLink(e env.Env, receiptCode string, gc int64, receiptTime string) string {
@@ -263,8 +262,8 @@ type (
 
 	vatTotal struct {
 		VATRATE    string
-		NETTAMOUNT float64
-		TAXAMOUNT  float64
+		NETTAMOUNT money.Money
+		TAXAMOUNT  money.Money
 	}
 )
 
@@ -272,10 +271,49 @@ type (
 // and create []*models.ITEM which is used to create the xml request also
 // calculates the total discount, total tax exclusive and total tax inclusive
 func ProcessItems(items []Item) *ItemProcessResponse {
+	return ProcessItemsWithOptions(items, ReceiptOptions{})
+}
+
+// ProcessItemsWithOptions is like ProcessItems. VATTOTALS are always in the
+// order A, B, C, D, E and include all of them when opts.AllVATGroups is set.
+func ProcessItemsWithOptions(items []Item, opts ReceiptOptions) *ItemProcessResponse {
+	return ProcessItemsForDate(items, "", opts)
+}
+
+// ProcessItemsForDate is like ProcessItemsWithOptions with the VAT rates in
+// effect on date, the date of the receipt in DateFormat. An empty date is today.
+// Items whose amount can not be computed, because the quantity is not a finite
+// number or the amount is out of range, count as zero. Use ProcessItemsStrict
+// to get an error for them instead.
+func ProcessItemsForDate(items []Item, date string, opts ReceiptOptions) *ItemProcessResponse {
+	result, _ := processItems(items, date, opts, false)
+	return result
+}
+
+// ProcessItemsStrict is like ProcessItemsForDate but returns an error wrapping
+// ErrUnknownTaxCode when an item has a tax code other than 1 through 5,
+// instead of taxing it at the standard rate, and an error when the amount of
+// an item can not be computed.
+func ProcessItemsStrict(items []Item, date string, opts ReceiptOptions) (*ItemProcessResponse, error) {
+	result, err := processItems(items, date, opts, true)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// processItems computes the items and totals of a receipt. Unknown tax codes
+// fail when strict is set. Items whose amount can not be computed count as
+// zero, the result is then returned together with the first such error.
+
+func processItems(items []Item, date string, opts ReceiptOptions, strict bool) (*ItemProcessResponse, error) {
+	table := opts.VATTable.orDefault()
+
 	var (
-		DISCOUNT          = 0.0
-		TOTALTAXEXCLUSIVE = 0.0
-		TOTALTAXINCLUSIVE = 0.0
+		DISCOUNT          money.Money
+		TOTALTAXEXCLUSIVE money.Money
+		TOTALTAXINCLUSIVE money.Money
+		amountErr         error
 	)
 
 	// TotalPrice = UnitPrice * Quantity
@@ -283,24 +321,30 @@ func ProcessItems(items []Item) *ItemProcessResponse {
 	// TaxableAmount + TaxableAmount * TaxRate = Amount
 	vatTotals := make(map[string]*vatTotal)
 	var ITEMS []*models.ITEM
-	for _, item := range items {
+	for i, item := range items {
 		item := item
-		itemAmount := item.Quantity * item.UnitPrice
+		vat := table.ParseTaxCode(int64(item.TaxCode), date)
+		if strict && !item.TaxCode.Valid() {
+			return nil, fmt.Errorf("items[%d]: %w: %d", i, ErrUnknownTaxCode, item.TaxCode)
+		}
+		itemAmount, err := item.UnitPrice.Mul(item.Quantity)
+		if err != nil && amountErr == nil {
+			amountErr = fmt.Errorf("items[%d]: could not compute amount: %w", i, err)
+		}
 		itemXML := &models.ITEM{
 			ID:      item.ID,
 			DESC:    item.Description,
 			QTY:     item.Quantity,
-			TAXCODE: item.TaxCode,
+			TAXCODE: int64(item.TaxCode),
 			AMT:     itemAmount,
 		}
-		itemAmountWithoutDiscount := itemAmount - item.Discount
-		DISCOUNT += item.Discount
+		itemAmountWithoutDiscount := itemAmount.Sub(item.Discount)
+		DISCOUNT = DISCOUNT.Add(item.Discount)
 		ITEMS = append(ITEMS, itemXML)
-		NETAMOUNT := NetAmount(item.TaxCode, itemAmountWithoutDiscount)
-		TOTALTAXEXCLUSIVE += NETAMOUNT
-		TOTALTAXINCLUSIVE += itemAmountWithoutDiscount
-		TAXAMOUNT := ValueAddedTaxAmount(item.TaxCode, itemAmountWithoutDiscount)
-		vatID := ParseTaxCode(item.TaxCode).ID
+		NETAMOUNT, TAXAMOUNT := vat.Split(itemAmountWithoutDiscount)
+		TOTALTAXEXCLUSIVE = TOTALTAXEXCLUSIVE.Add(NETAMOUNT)
+		TOTALTAXINCLUSIVE = TOTALTAXINCLUSIVE.Add(itemAmountWithoutDiscount)
+		vatID := vat.ID
 		// check if the tax code is already in the map if not add it
 		if _, ok := vatTotals[vatID]; !ok {
 			vatTotals[vatID] = &vatTotal{
@@ -309,17 +353,24 @@ func ProcessItems(items []Item) *ItemProcessResponse {
 				TAXAMOUNT:  TAXAMOUNT,
 			}
 		} else {
-			vatTotals[vatID].NETTAMOUNT += NETAMOUNT
-			vatTotals[vatID].TAXAMOUNT += TAXAMOUNT
+			vatTotals[vatID].NETTAMOUNT = vatTotals[vatID].NETTAMOUNT.Add(NETAMOUNT)
+			vatTotals[vatID].TAXAMOUNT = vatTotals[vatID].TAXAMOUNT.Add(TAXAMOUNT)
 		}
 	}
 
 	VATTOTALS := make([]*models.VATTOTAL, 0)
-	for _, v := range vatTotals {
+	for _, vatID := range vatIDs {
+		v, ok := vatTotals[vatID]
+		if !ok && !opts.AllVATGroups {
+			continue
+		}
+		if !ok {
+			v = &vatTotal{VATRATE: vatID}
+		}
 		V := &models.VATTOTAL{
 			VATRATE:    v.VATRATE,
-			NETTAMOUNT: fmt.Sprintf("%.2f", v.NETTAMOUNT),
-			TAXAMOUNT:  fmt.Sprintf("%.2f", v.TAXAMOUNT),
+			NETTAMOUNT: v.NETTAMOUNT,
+			TAXAMOUNT:  v.TAXAMOUNT,
 		}
 		VATTOTALS = append(VATTOTALS, V)
 	}
@@ -332,5 +383,5 @@ func ProcessItems(items []Item) *ItemProcessResponse {
 		ITEMS:     ITEMS,
 		VATTOTALS: VATTOTALS,
 		TOTALS:    TOTALS,
-	}
+	}, amountErr
 }
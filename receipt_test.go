@@ -22,14 +22,17 @@
 package vfd
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/xml"
 	"fmt"
+	"math"
 	"reflect"
 	"testing"
 
 	"github.com/Golang-Tanzania/tra-vfd/internal/models"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
 )
 
 func TestProcessItems(t *testing.T) {
@@ -37,7 +40,7 @@ func TestProcessItems(t *testing.T) {
 		items []Item
 	}
 	type result struct {
-		ItemsAmount []float64
+		ItemsAmount []money.Money
 		VAT         []*models.VATTOTAL
 		Totals      models.TOTALS
 	}
@@ -55,26 +58,26 @@ func TestProcessItems(t *testing.T) {
 						Description: "Item 1",
 						TaxCode:     TaxableItemCode,
 						Quantity:    5,
-						UnitPrice:   2000,
-						Discount:    5000,
+						UnitPrice:   money.FromFloat(2000),
+						Discount:    money.FromFloat(5000),
 					},
 				},
 			},
 			want: &result{
-				ItemsAmount: []float64{10000},
+				ItemsAmount: []money.Money{money.FromFloat(10000)},
 				VAT: []*models.VATTOTAL{
 					{
 						XMLName:    xml.Name{},
 						Text:       "",
 						VATRATE:    "A",
-						NETTAMOUNT: "4237.29",
-						TAXAMOUNT:  "762.71",
+						NETTAMOUNT: money.MustParse("4237.29"),
+						TAXAMOUNT:  money.MustParse("762.71"),
 					},
 				},
 				Totals: models.TOTALS{
-					TOTALTAXEXCL: 4237.29,
-					TOTALTAXINCL: 5000.00,
-					DISCOUNT:     5000.00,
+					TOTALTAXEXCL: money.MustParse("4237.29"),
+					TOTALTAXINCL: money.MustParse("5000.00"),
+					DISCOUNT:     money.MustParse("5000.00"),
 				},
 			},
 		},
@@ -87,26 +90,26 @@ func TestProcessItems(t *testing.T) {
 						Description: "Item 1",
 						TaxCode:     TaxableItemCode,
 						Quantity:    5,
-						UnitPrice:   1000,
-						Discount:    0,
+						UnitPrice:   money.FromFloat(1000),
+						Discount:    money.FromFloat(0),
 					},
 				},
 			},
 			want: &result{
-				ItemsAmount: []float64{5000},
+				ItemsAmount: []money.Money{money.FromFloat(5000)},
 				VAT: []*models.VATTOTAL{
 					{
 						XMLName:    xml.Name{},
 						Text:       "",
 						VATRATE:    "A",
-						NETTAMOUNT: "4237.29",
-						TAXAMOUNT:  "762.71",
+						NETTAMOUNT: money.MustParse("4237.29"),
+						TAXAMOUNT:  money.MustParse("762.71"),
 					},
 				},
 				Totals: models.TOTALS{
-					TOTALTAXEXCL: 4237.29,
-					TOTALTAXINCL: 5000.00,
-					DISCOUNT:     0.00,
+					TOTALTAXEXCL: money.MustParse("4237.29"),
+					TOTALTAXINCL: money.MustParse("5000.00"),
+					DISCOUNT:     money.MustParse("0.00"),
 				},
 			},
 		},
@@ -117,7 +120,7 @@ func TestProcessItems(t *testing.T) {
 				items := got.ITEMS
 				for i, item := range items {
 					wantItemAmount := tt.want.ItemsAmount[i]
-					message := fmt.Sprintf("[GOT]: Item %d: id: %s, quantity: %.2f, amount: %.2f [EXPECTED]: %.2f\n", i, item.ID, item.QTY, item.AMT, wantItemAmount)
+					message := fmt.Sprintf("[GOT]: Item %d: id: %s, quantity: %.2f, amount: %s [EXPECTED]: %s\n", i, item.ID, item.QTY, item.AMT, wantItemAmount)
 					if item.AMT != wantItemAmount {
 						t.Errorf("[ERROR] ProcessItems Error(): %s", message)
 					}
@@ -127,15 +130,15 @@ func TestProcessItems(t *testing.T) {
 				// Comparing TOTALS
 				func(got, want models.TOTALS) {
 					if got.TOTALTAXEXCL != want.TOTALTAXEXCL {
-						t.Errorf("[ERROR] TOTALTAXEXCL: got %.2f, want %.2f", got.TOTALTAXEXCL, want.TOTALTAXEXCL)
+						t.Errorf("[ERROR] TOTALTAXEXCL: got %s, want %s", got.TOTALTAXEXCL, want.TOTALTAXEXCL)
 					}
 					if got.TOTALTAXINCL != want.TOTALTAXINCL {
-						t.Errorf("[ERROR] TOTALTAXINCL: got %.2f, want %.2f", got.TOTALTAXINCL, want.TOTALTAXINCL)
+						t.Errorf("[ERROR] TOTALTAXINCL: got %s, want %s", got.TOTALTAXINCL, want.TOTALTAXINCL)
 					}
 					if got.DISCOUNT != want.DISCOUNT {
-						t.Errorf("[ERROR] DISCOUNT: got %.2f, want %.2f", got.DISCOUNT, want.DISCOUNT)
+						t.Errorf("[ERROR] DISCOUNT: got %s, want %s", got.DISCOUNT, want.DISCOUNT)
 					}
-					t.Logf("[INFO] TOTALS: [GOT]: TAXEXCL: %.2f, TAXINCL: %.2f, DISCOUNT: %.2f [EXPECTED]: TAXEXCL: %.2f, TAXINCL: %.2f, DISCOUNT: %.2f ",
+					t.Logf("[INFO] TOTALS: [GOT]: TAXEXCL: %s, TAXINCL: %s, DISCOUNT: %s [EXPECTED]: TAXEXCL: %s, TAXINCL: %s, DISCOUNT: %s ",
 						got.TOTALTAXEXCL, got.TOTALTAXINCL, got.DISCOUNT, want.TOTALTAXEXCL, want.TOTALTAXINCL, want.DISCOUNT)
 				}(got.TOTALS, tt.want.Totals)
 
@@ -176,15 +179,15 @@ func TestReceiptBytes(t *testing.T) {
 			Description: "Item 1",
 			TaxCode:     TaxableItemCode,
 			Quantity:    5,
-			UnitPrice:   2000,
-			Discount:    5000,
+			UnitPrice:   money.FromFloat(2000),
+			Discount:    money.FromFloat(5000),
 		},
 	}
 
 	payments := []Payment{
 		{
 			Type:   CashPaymentType,
-			Amount: 5000,
+			Amount: money.FromFloat(5000),
 		},
 	}
 
@@ -208,3 +211,86 @@ func TestReceiptBytes(t *testing.T) {
 
 	t.Logf("Receipt bytes: \n\n%s\n\n", string(got))
 }
+
+func TestProcessItemsWithOptions_VATOrder(t *testing.T) {
+	t.Parallel()
+	items := []Item{
+		NewItem("1", "Exempted", ExemptedVATCODE, 1, 500, 0),
+		NewItem("2", "Zero rated", ZeroVATCODE, 1, 1000, 0),
+		NewItem("3", "Standard", StandardVATCODE, 1, 1180, 0),
+	}
+
+	tests := []struct {
+		name string
+		opts ReceiptOptions
+		want []string
+	}{
+		{name: "used groups only", opts: ReceiptOptions{}, want: []string{"A", "C", "E"}},
+		{name: "all groups", opts: ReceiptOptions{AllVATGroups: true}, want: []string{"A", "B", "C", "D", "E"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var got []string
+			for _, v := range ProcessItemsWithOptions(items, tt.opts).VATTOTALS {
+				got = append(got, v.VATRATE)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("VATRATE order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceiptBytes_AmountOutOfRange(t *testing.T) {
+	t.Parallel()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, customer, _, payments := goldenReceipt()
+
+	for _, quantity := range []float64{math.NaN(), math.Inf(1), 1e300} {
+		items := []Item{NewItem("1", "Item 1", StandardVATCODE, quantity, 1180, 0)}
+
+		if _, err := ReceiptBytes(privateKey, params, customer, items, payments); err == nil {
+			t.Errorf("ReceiptBytes() with quantity %v error = nil, want an error", quantity)
+		}
+		if _, err := ProcessItemsStrict(items, "", ReceiptOptions{}); err == nil {
+			t.Errorf("ProcessItemsStrict() with quantity %v error = nil, want an error", quantity)
+		}
+		if got := ProcessItems(items).TOTALS.TOTALTAXINCL; !got.IsZero() {
+			t.Errorf("ProcessItems() with quantity %v total = %s, want the item counted as zero", quantity, got)
+		}
+	}
+}
+
+func TestReceiptBytes_Reproducible(t *testing.T) {
+	t.Parallel()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, customer, _, payments := goldenReceipt()
+	items := []Item{
+		NewItem("1", "Exempted", ExemptedVATCODE, 1, 500, 0),
+		NewItem("2", "Zero rated", ZeroVATCODE, 1, 1000, 0),
+		NewItem("3", "Standard", StandardVATCODE, 1, 1180, 0),
+	}
+
+	first, err := ReceiptBytes(privateKey, params, customer, items, payments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		got, err := ReceiptBytes(privateKey, params, customer, items, payments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, first) {
+			t.Fatalf("ReceiptBytes() is not reproducible:\n%s\n%s", first, got)
+		}
+	}
+}
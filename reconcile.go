@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+const (
+	// DiscrepancyMismatch is a total of the Z report that differs from the
+	// acknowledged receipts.
+	DiscrepancyMismatch DiscrepancyKind = "mismatch"
+	// DiscrepancyGap is a run of GC or DC values missing from the receipts.
+	DiscrepancyGap DiscrepancyKind = "gap"
+	// DiscrepancyDuplicate is a GC or DC used by more than one receipt.
+	DiscrepancyDuplicate DiscrepancyKind = "duplicate"
+	// DiscrepancyUnacknowledged is a receipt the VFD server has not accepted, it
+	// is left out of the expected totals.
+	DiscrepancyUnacknowledged DiscrepancyKind = "unacknowledged"
+	// DiscrepancyMissingReceipt is an acknowledgement without a receipt payload.
+	DiscrepancyMissingReceipt DiscrepancyKind = "missing_receipt"
+)
+
+// ErrNoReport is returned by Reconcile when there is no Z report to check.
+var ErrNoReport = errors.New("no z report to reconcile")
+
+type (
+	// DiscrepancyKind tells what a Discrepancy is about.
+	DiscrepancyKind string
+
+	// Discrepancy is a single difference found by Reconcile. Field is the path of
+	// the value, for example Totals.Gross, VATS[A-18.00].TaxAmount,
+	// Payment[CASH] or GC. Expected is the value worked out from the receipts
+	// and Reported the one in the Z report or in the receipts.
+	Discrepancy struct {
+		Kind     DiscrepancyKind `json:"kind"`
+		Field    string          `json:"field"`
+		Expected string          `json:"expected,omitempty"`
+		Reported string          `json:"reported,omitempty"`
+		Message  string          `json:"message"`
+	}
+
+	// Reconciliation is the result of Reconcile. Expected is the Z report built
+	// from the acknowledged receipts with the params and address of the checked
+	// one, it can be submitted in its place.
+	Reconciliation struct {
+		Expected      *ReportRequest `json:"expected"`
+		Discrepancies []Discrepancy  `json:"discrepancies"`
+	}
+)
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Field, d.Message)
+}
+
+// OK tells if the Z report matches the receipts.
+func (r *Reconciliation) OK() bool {
+	return len(r.Discrepancies) == 0
+}
+
+// Reconcile checks a Z report against the signed receipts of the day and the
+// acknowledgements the VFD server returned for them, matched by RCTNUM. Only
+// receipts with a successful acknowledgement are counted. previousGross is the
+// Gross of the previous Z report. VAT groups are worked out with the VATTable
+// of the report options.
+func Reconcile(report *ReportRequest, previousGross money.Money, receipts [][]byte, acks []*Response,
+) (*Reconciliation, error) {
+	if report == nil {
+		return nil, ErrNoReport
+	}
+
+	acknowledged := make(map[int64]bool)
+	for _, ack := range acks {
+		if ack != nil && ack.Code == SuccessCode {
+			acknowledged[ack.Number] = true
+		}
+	}
+
+	signed := make([]*SignedReceipt, len(receipts))
+	for i, payload := range receipts {
+		receipt, err := ParseReceipt(payload)
+		if err != nil {
+			return nil, fmt.Errorf("receipt %d: %w", i, err)
+		}
+		signed[i] = receipt
+	}
+	sort.SliceStable(signed, func(i, j int) bool {
+		return signed[i].Receipt.GC < signed[j].Receipt.GC
+	})
+
+	var (
+		result     = &Reconciliation{}
+		aggregator = NewDailyAggregator(previousGross, WithAggregatorVATTable(report.Options.VATTable))
+		found      = make(map[int64]bool)
+	)
+	add := func(kind DiscrepancyKind, field, expected, reported, message string) {
+		result.Discrepancies = append(result.Discrepancies, Discrepancy{
+			Kind: kind, Field: field, Expected: expected, Reported: reported, Message: message,
+		})
+	}
+
+	for _, receipt := range signed {
+		rct := receipt.Receipt
+		number, _ := strconv.ParseInt(rct.RCTNUM, 10, 64)
+		if found[number] {
+			continue // reported by checkSequence
+		}
+		found[number] = true
+
+		if !acknowledged[number] {
+			add(DiscrepancyUnacknowledged, fmt.Sprintf("Receipts[GC %d]", rct.GC), "", rct.RCTNUM,
+				fmt.Sprintf("receipt %s has not been acknowledged", rct.RCTNUM))
+			continue
+		}
+		if err := aggregator.AddSigned(receipt); err != nil {
+			if errors.Is(err, ErrDuplicateReceipt) {
+				continue // reported by checkSequence
+			}
+			return nil, err
+		}
+	}
+
+	numbers := make([]int64, 0, len(acknowledged))
+	for number := range acknowledged {
+		if !found[number] {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	for _, number := range numbers {
+		add(DiscrepancyMissingReceipt, "Receipts", strconv.FormatInt(number, 10), "",
+			fmt.Sprintf("receipt %d was acknowledged but its payload is missing", number))
+	}
+
+	gcs := make([]int64, len(signed))
+	dcs := make([]int64, len(signed))
+	for i, receipt := range signed {
+		gcs[i] = receipt.Receipt.GC
+		dcs[i] = receipt.Receipt.DC
+	}
+	checkSequence("GC", gcs, 0, add)
+	sort.Slice(dcs, func(i, j int) bool { return dcs[i] < dcs[j] })
+	checkSequence("DC", dcs, 1, add)
+
+	result.Expected = aggregator.Report(report.Params, report.Address)
+	compareReports(result.Expected, report, add)
+
+	return result, nil
+}
+
+// checkSequence reports duplicates and gaps in sorted values. A positive first
+// is the value the sequence must start at.
+func checkSequence(field string, values []int64, first int64,
+	add func(kind DiscrepancyKind, field, expected, reported, message string),
+) {
+	if len(values) == 0 {
+		return
+	}
+
+	want := values[0]
+	if first > 0 {
+		want = first
+	}
+	for _, value := range values {
+		switch {
+		case value < want:
+			add(DiscrepancyDuplicate, field, "", strconv.FormatInt(value, 10),
+				fmt.Sprintf("%s %d is used by more than one receipt", field, value))
+			continue
+		case value > want:
+			add(DiscrepancyGap, field, strconv.FormatInt(want, 10), strconv.FormatInt(value, 10),
+				fmt.Sprintf("%s %d to %d are missing", field, want, value-1))
+		}
+		want = value + 1
+	}
+}
+
+// compareReports reports the totals, VAT groups and payments of reported that
+// differ from expected. Groups and payment types missing from a report count
+// as zero.
+func compareReports(expected, reported *ReportRequest,
+	add func(kind DiscrepancyKind, field, expected, reported, message string),
+) {
+	compare := func(field string, want, got money.Money) {
+		if want != got {
+			add(DiscrepancyMismatch, field, want.String(), got.String(),
+				fmt.Sprintf("the receipts add up to %s, the report has %s", want, got))
+		}
+	}
+
+	totals := reported.Totals
+	if totals == nil {
+		totals = &ReportTotals{}
+	}
+	if want, got := expected.Totals.TicketsFiscal, totals.TicketsFiscal; want != got {
+		add(DiscrepancyMismatch, "Totals.TicketsFiscal", strconv.FormatInt(want, 10), strconv.FormatInt(got, 10),
+			fmt.Sprintf("%d receipts were acknowledged, the report has %d", want, got))
+	}
+	compare("Totals.DailyTotalAmount", expected.Totals.DailyTotalAmount, totals.DailyTotalAmount)
+	compare("Totals.Gross", expected.Totals.Gross, totals.Gross)
+	compare("Totals.Discounts", expected.Totals.Discounts, totals.Discounts)
+
+	wantVATs, gotVATs := vatsByRate(expected.VATS), vatsByRate(reported.VATS)
+	groups := make([]VATTOTAL, 0, len(wantVATs)+len(gotVATs))
+	for rate, vat := range wantVATs {
+		groups = append(groups, vat)
+		if _, ok := gotVATs[rate]; !ok {
+			gotVATs[rate] = VATTOTAL{ID: vat.ID, Rate: vat.Rate}
+		}
+	}
+	for rate, vat := range gotVATs {
+		if _, ok := wantVATs[rate]; !ok {
+			groups = append(groups, vat)
+		}
+	}
+	sortVATTotals(groups)
+
+	for _, group := range groups {
+		rate := reportTaxRateID(group.ID, group.Rate)
+		if _, ok := vatCategory(group.ID); !ok {
+			add(DiscrepancyMismatch, fmt.Sprintf("VATS[%s]", rate), "", rate,
+				fmt.Sprintf("the report has the unknown VAT group %s", rate))
+			continue
+		}
+		compare(fmt.Sprintf("VATS[%s].NetAmount", rate), wantVATs[rate].NetAmount, gotVATs[rate].NetAmount)
+		compare(fmt.Sprintf("VATS[%s].TaxAmount", rate), wantVATs[rate].TaxAmount, gotVATs[rate].TaxAmount)
+	}
+
+	wantPayments, gotPayments := paymentsByType(expected.Payment), paymentsByType(reported.Payment)
+	for _, pType := range paymentTypes {
+		compare(fmt.Sprintf("Payment[%s]", pType), wantPayments[pType], gotPayments[pType])
+	}
+}
+
+// vatsByRate sums VAT totals by their report rate id, like sumVatTotals does.
+func vatsByRate(vats []VATTOTAL) map[string]VATTOTAL {
+	sums := make(map[string]VATTOTAL)
+	for _, vat := range vats {
+		rate := reportTaxRateID(vat.ID, vat.Rate)
+		sum, ok := sums[rate]
+		if !ok {
+			sum = VATTOTAL{ID: vat.ID, Rate: vat.Rate}
+		}
+		sum.NetAmount = sum.NetAmount.Add(vat.NetAmount)
+		sum.TaxAmount = sum.TaxAmount.Add(vat.TaxAmount)
+		sums[rate] = sum
+	}
+	return sums
+}
+
+func paymentsByType(payments []Payment) map[PaymentType]money.Money {
+	sums := make(map[PaymentType]money.Money)
+	for _, payment := range payments {
+		sums[payment.Type] = sums[payment.Type].Add(payment.Amount)
+	}
+	return sums
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipt := func(gc, dc int64, item Item, payment Payment) *ReceiptRequest {
+		return &ReceiptRequest{
+			Params: ReceiptParams{
+				ReceiptNum:    strconv.FormatInt(gc, 10),
+				GlobalCounter: gc,
+				DailyCounter:  dc,
+			},
+			Customer: Customer{Type: NonCustomerID},
+			Items:    []Item{item},
+			Payments: []Payment{payment},
+		}
+	}
+	sugar := NewItem("1", "Sugar", StandardVATCODE, 1, 5900, 0)
+	bread := NewItem("2", "Bread", ExemptedVATCODE, 1, 2000, 0)
+
+	var (
+		r101 = receipt(101, 1, sugar, NewPayment(CashPaymentType, 5900))
+		r102 = receipt(102, 2, bread, NewPayment(CashPaymentType, 2000))
+		r103 = receipt(103, 3, sugar, NewPayment(ElectronicPaymentType, 5900))
+		r104 = receipt(104, 4, sugar, NewPayment(ElectronicPaymentType, 5900))
+	)
+	payload := func(receipt *ReceiptRequest) []byte {
+		data, err := ReceiptBytes(privateKey, receipt.Params, receipt.Customer, receipt.Items, receipt.Payments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	ack := func(number, code int64) *Response {
+		return &Response{Number: number, Code: code}
+	}
+
+	previousGross := money.MustParse("1000.00")
+	aggregator := NewDailyAggregator(previousGross)
+	for _, receipt := range []*ReceiptRequest{r101, r102, r103} {
+		if err := aggregator.Add(receipt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := aggregator.Report(&ReportParams{ZNumber: "20230101"}, &Address{})
+
+	tests := []struct {
+		name     string
+		receipts [][]byte
+		acks     []*Response
+		want     []string
+	}{
+		{
+			name:     "matching",
+			receipts: [][]byte{payload(r103), payload(r101), payload(r102)},
+			acks:     []*Response{ack(101, SuccessCode), ack(102, SuccessCode), ack(103, SuccessCode)},
+		},
+		{
+			name:     "discrepancies",
+			receipts: [][]byte{payload(r101), payload(r102), payload(r102), payload(r104)},
+			acks: []*Response{
+				ack(101, SuccessCode), ack(102, InvalidSignatureCode), ack(104, SuccessCode), ack(105, SuccessCode),
+			},
+			want: []string{
+				"unacknowledged Receipts[GC 102]",
+				"missing_receipt Receipts",
+				"duplicate GC",
+				"gap GC",
+				"duplicate DC",
+				"gap DC",
+				"mismatch Totals.TicketsFiscal",
+				"mismatch Totals.DailyTotalAmount",
+				"mismatch Totals.Gross",
+				"mismatch VATS[E-0.00].NetAmount",
+				"mismatch Payment[CASH]",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		result, err := Reconcile(report, previousGross, tt.receipts, tt.acks)
+		if err != nil {
+			t.Fatalf("%s: Reconcile() error = %v", tt.name, err)
+		}
+
+		var got []string
+		for _, d := range result.Discrepancies {
+			got = append(got, string(d.Kind)+" "+d.Field)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: discrepancies = %v, want %v", tt.name, result.Discrepancies, tt.want)
+		}
+		if result.OK() != (len(tt.want) == 0) {
+			t.Errorf("%s: OK() = %v", tt.name, result.OK())
+		}
+	}
+
+	result, err := Reconcile(report, previousGross, [][]byte{payload(r101), payload(r104)},
+		[]*Response{ack(101, SuccessCode), ack(104, SuccessCode)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range result.Discrepancies {
+		if d.Field == "GC" && (d.Expected != "102" || d.Reported != "104") {
+			t.Errorf("GC gap = %+v, want expected 102 and reported 104", d)
+		}
+		if d.Field == "Totals.Gross" && (d.Expected != "12800.00" || d.Reported != "14800.00") {
+			t.Errorf("Gross mismatch = %+v", d)
+		}
+	}
+	if result.Expected.Params != report.Params || result.Expected.Totals.TicketsFiscal != 2 {
+		t.Errorf("Expected = %+v, want the params of the report and 2 tickets", result.Expected)
+	}
+}
@@ -31,8 +31,9 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
-	xhttp "github.com/Golang-Tanzania/tra-vfd/internal/http"
 	"github.com/Golang-Tanzania/tra-vfd/internal/models"
 )
 
@@ -114,15 +115,15 @@ func responseFormat(response *models.REGDATARESP) *RegistrationResponse {
 
 // Register send the registration for a Virtual Fiscal Device to the VFD server. The
 // registration request is signed with the private key of the certificate used to
-// authenticate the INSTANCE.
+// authenticate the INSTANCE. When the server responds with an ACKCODE other than
+// zero the response is returned together with an *AckError.
 func Register(ctx context.Context, requestURL string, privateKey *rsa.PrivateKey,
 	request *RegistrationRequest,
 ) (*RegistrationResponse, error) {
-	client := xhttp.Instance()
-	return register(ctx, client, requestURL, privateKey, request)
+	return register(ctx, defaultClient(), requestURL, privateKey, request)
 }
 
-func register(ctx context.Context, client *http.Client, requestURL string, privateKey *rsa.PrivateKey,
+func register(ctx context.Context, client *Client, requestURL string, privateKey *rsa.PrivateKey,
 	request *RegistrationRequest,
 ) (*RegistrationResponse, error) {
 	var (
@@ -157,7 +158,23 @@ func register(ctx context.Context, client *http.Client, requestURL string, priva
 		return nil, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, requestURL, bytes.NewBuffer(out))
+	response, err := withRetry(ctx, client.retry, "registration",
+		func() (*models.REGDATARESP, error) {
+			return postRegistration(ctx, client, requestURL, certSerial, out)
+		})
+	if response == nil {
+		return nil, err
+	}
+
+	// a response with an ACKCODE other than zero is returned together
+	// with an *AckError
+	return responseFormat(response), err
+}
+
+// postRegistration posts the signed registration request and decodes the response.
+func postRegistration(ctx context.Context, client *Client, requestURL, certSerial string, payload []byte,
+) (*models.REGDATARESP, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, requestURL, bytes.NewBuffer(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -165,7 +182,7 @@ func register(ctx context.Context, client *http.Client, requestURL string, priva
 	req.Header.Set("Cert-Serial", certSerial)
 	req.Header.Set("Client", RegistrationRequestClient)
 
-	resp, err := client.Do(req)
+	resp, err := client.http.Do(req)
 	if err != nil {
 		return nil, checkNetworkError(ctx, "registration", err)
 	}
@@ -177,19 +194,13 @@ func register(ctx context.Context, client *http.Client, requestURL string, priva
 		}
 	}(resp.Body)
 
-	out, err = io.ReadAll(resp.Body)
+	out, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("%v: %w", ErrRegistrationFailed, err)
 	}
 
-	if resp.StatusCode == 500 {
-		errBody := models.Error{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&errBody)
-		if err != nil {
-			return nil, fmt.Errorf("%v: %w", ErrRegistrationFailed, err)
-		}
-
-		return nil, fmt.Errorf("%w: %s", ErrRegistrationFailed, errBody.Message)
+	if err := serverError(resp.StatusCode, out); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRegistrationFailed, err)
 	}
 
 	responseBody := models.REGRESPACK{}
@@ -198,14 +209,16 @@ func register(ctx context.Context, client *http.Client, requestURL string, priva
 		return nil, fmt.Errorf("%v: %w", ErrRegistrationFailed, err)
 	}
 
-	response := &responseBody.EFDMSRESP
+	err = client.verifyServerSignature(out, "EFDMSRESP", responseBody.EFDMSSIGNATURE)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", ErrRegistrationFailed, err)
+	}
 
-	// check if the response code is equal to zero if not
-	// return an error with code and message
-	if responseCode := response.ACKCODE; responseCode != "0" {
-		responseMessage := response.ACKMSG
-		return nil, fmt.Errorf("%v response code: %s, message: %s", ErrRegistrationFailed, responseCode, responseMessage)
+	response := &responseBody.EFDMSRESP
+	code, err := strconv.ParseInt(strings.TrimSpace(response.ACKCODE), 10, 64)
+	if err != nil {
+		return response, fmt.Errorf("%v: invalid ACKCODE %q", ErrRegistrationFailed, response.ACKCODE)
 	}
 
-	return responseFormat(response), nil
+	return response, ackError("registration", ErrRegistrationFailed, code, response.ACKMSG)
 }
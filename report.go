@@ -22,19 +22,25 @@
 package vfd
 
 import (
-	"bytes"
 	"context"
 	"crypto/rsa"
 	"encoding/xml"
 	"fmt"
-	"io"
-	"net/http"
-	"regexp"
+	"strconv"
 	"strings"
 
-	xhttp "github.com/Golang-Tanzania/tra-vfd/internal/http"
-
 	"github.com/Golang-Tanzania/tra-vfd/internal/models"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+const (
+	// DefaultSIMIMSI is the SIMIMSI of Z reports submitted through the web API.
+	DefaultSIMIMSI = "WEBAPI"
+	// DefaultFirmwareVersion is the FWVERSION of Z reports.
+	DefaultFirmwareVersion = "3.0"
+	// DefaultFirmwareChecksum is the FWCHECKSUM of Z reports submitted through
+	// the web API.
+	DefaultFirmwareChecksum = "WEBAPI"
 )
 
 var ErrReportSubmitFailed = fmt.Errorf("report submit failed")
@@ -42,118 +48,95 @@ var ErrReportSubmitFailed = fmt.Errorf("report submit failed")
 type (
 	// ReportTotals contains different number of totals
 	ReportTotals struct {
-		DailyTotalAmount float64
-		Gross            float64
-		Corrections      float64
-		Discounts        float64
-		Surcharges       float64
-		TicketsVoid      int64
-		TicketsVoidTotal float64
-		TicketsFiscal    int64
-		TicketsNonFiscal int64
+		DailyTotalAmount money.Money `json:"daily_total_amount"`
+		Gross            money.Money `json:"gross"`
+		Corrections      money.Money `json:"corrections"`
+		Discounts        money.Money `json:"discounts"`
+		Surcharges       money.Money `json:"surcharges"`
+		TicketsVoid      int64       `json:"tickets_void"`
+		TicketsVoidTotal money.Money `json:"tickets_void_total"`
+		TicketsFiscal    int64       `json:"tickets_fiscal"`
+		TicketsNonFiscal int64       `json:"tickets_non_fiscal"`
 	}
 
 	Address struct {
-		Name    string
-		Street  string
-		Mobile  string
-		City    string
-		Country string
+		Name    string `json:"name"`
+		Street  string `json:"street"`
+		Mobile  string `json:"mobile"`
+		City    string `json:"city"`
+		Country string `json:"country"`
 	}
 
 	ReportParams struct {
-		Date             string
-		Time             string
-		VRN              string
-		TIN              string
-		UIN              string
-		TaxOffice        string
-		RegistrationID   string
-		ZNumber          string
-		EFDSerial        string
-		RegistrationDate string
+		Date             string `json:"date"`
+		Time             string `json:"time"`
+		VRN              string `json:"vrn"`
+		TIN              string `json:"tin"`
+		UIN              string `json:"uin"`
+		TaxOffice        string `json:"tax_office"`
+		RegistrationID   string `json:"registration_id"`
+		ZNumber          string `json:"znumber"`
+		EFDSerial        string `json:"efd_serial"`
+		RegistrationDate string `json:"registration_date"`
+	}
+
+	// ReportOptions sets the fields of the Z report that are not about the
+	// sales of the day. Empty values take their defaults: SIMIMSI, FWVERSION and
+	// FWCHECKSUM the Default constants and the HEADER lines Address.AsList.
+	// VATChangeNum and HeaderChangeNum count the changes of the VAT status and
+	// of the header since registration, see ChangeTracker. VATTable holds the
+	// rates of the VAT groups, the built-in rates of NewVATTable if nil.
+	ReportOptions struct {
+		SIMIMSI          string    `json:"simimsi,omitempty"`
+		FirmwareVersion  string    `json:"fw_version,omitempty"`
+		FirmwareChecksum string    `json:"fw_checksum,omitempty"`
+		Header           []string  `json:"header,omitempty"`
+		VATChangeNum     int64     `json:"vat_change_num,omitempty"`
+		HeaderChangeNum  int64     `json:"header_change_num,omitempty"`
+		Errors           string    `json:"errors,omitempty"`
+		VATTable         *VATTable `json:"-"`
 	}
 
 	ReportRequest struct {
-		Params  *ReportParams
-		Address *Address
-		Totals  *ReportTotals
-		VATS    []VATTOTAL
-		Payment []Payment
+		Params  *ReportParams `json:"params"`
+		Address *Address      `json:"address,omitempty"`
+		Totals  *ReportTotals `json:"totals"`
+		VATS    []VATTOTAL    `json:"vats"`
+		Payment []Payment     `json:"payments"`
+		Options ReportOptions `json:"options"`
 	}
 )
 
 // submitReport submits a report to the VFD server.
-func submitReport(ctx context.Context, client *http.Client, requestURL string, headers *RequestHeaders,
+func submitReport(ctx context.Context, client *Client, requestURL string, headers *RequestHeaders,
 	privateKey *rsa.PrivateKey,
 	report *ReportRequest,
 ) (*Response, error) {
-	var (
-		certSerial  = headers.CertSerial
-		bearerToken = headers.BearerToken
-	)
-
 	newContext, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	payload, err := ReportBytes(
+	payload, err := ReportBytesWithOptions(
 		privateKey, report.Params, *report.Address, report.VATS,
-		report.Payment, *report.Totals)
+		report.Payment, *report.Totals, report.Options)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate the report payload: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(newContext, http.MethodPost, requestURL, bytes.NewBuffer(payload))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", ContentTypeXML)
-	req.Header.Set("Routing-Key", SubmitReportRoutingKey)
-	req.Header.Set("Cert-Serial", encodeBase64String(certSerial))
-	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", bearerToken))
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, checkNetworkError(newContext, "submit report", err)
-	}
-	defer resp.Body.Close()
-
-	out, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("%v : %w", ErrReportSubmitFailed, err)
-	}
-
-	if resp.StatusCode == http.StatusInternalServerError {
-		errBody := models.Error{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&errBody)
+	return withRetry(newContext, client.retry, "submit report", func() (*Response, error) {
+		result, err := postPayload(newContext, client, requestURL, headers,
+			SubmitReportRoutingKey, payload, "submit report")
 		if err != nil {
-			return nil, fmt.Errorf("%v : %w", ErrReportSubmitFailed, err)
+			return nil, err
 		}
 
-		return nil, fmt.Errorf("registration error: %s", errBody.Message)
-	}
-
-	response := models.ReportAckEFDMS{}
-	err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&response)
-	if err != nil {
-		return nil, fmt.Errorf("%v : %w", ErrReportSubmitFailed, err)
-	}
-
-	return &Response{
-		Number:  response.ZACK.ZNUMBER,
-		Date:    response.ZACK.DATE,
-		Time:    response.ZACK.TIME,
-		Code:    response.ZACK.ACKCODE,
-		Message: response.ZACK.ACKMSG,
-	}, nil
+		return client.decodeReportAck(result)
+	})
 }
 
 func SubmitReport(ctx context.Context, url string, headers *RequestHeaders, privateKey *rsa.PrivateKey,
 	report *ReportRequest,
 ) (*Response, error) {
-	client := xhttp.Instance()
-	return submitReport(ctx, client, url, headers, privateKey, report)
+	return submitReport(ctx, defaultClient(), url, headers, privateKey, report)
 }
 
 func (lines *Address) AsList() []string {
@@ -165,74 +148,52 @@ func (lines *Address) AsList() []string {
 	}
 }
 
-// sumVatTotals
-func sumVatTotals(vats []VATTOTAL) models.VATTOTALS {
-	vatTotalMap := map[string]struct {
-		NetAmount float64
-		TaxAmount float64
-	}{
-		"A-18.00": {0, 0},
-		"B-0.00":  {0, 0},
-		"C-0.00":  {0, 0},
-		"D-0.00":  {0, 0},
-		"E-0.00":  {0, 0},
+// sumVatTotals sums the VAT totals by group. All the five groups are listed,
+// with the rates in effect on date, followed by the groups of vats with other
+// rates, for example a rate that has changed during the day.
+func sumVatTotals(vats []VATTOTAL, table *VATTable, date string) models.VATTOTALS {
+	var (
+		sums  = make(map[string]*models.VATTOTAL)
+		rates []string
+	)
+	total := func(rate string) *models.VATTOTAL {
+		if _, ok := sums[rate]; !ok {
+			sums[rate] = &models.VATTOTAL{VATRATE: rate}
+			rates = append(rates, rate)
+		}
+		return sums[rate]
 	}
 
+	for _, vat := range vatCategories {
+		total(table.ReportTaxRateID(vat.Code, date))
+	}
 	for _, vat := range vats {
-		rate := fmt.Sprintf("%s-%.2f", vat.ID, vat.Rate)
-		vatTotalMap[rate] = struct {
-			NetAmount float64
-			TaxAmount float64
-		}{
-			vatTotalMap[rate].NetAmount + vat.NetAmount,
-			vatTotalMap[rate].TaxAmount + vat.TaxAmount,
-		}
+		sum := total(reportTaxRateID(vat.ID, vat.Rate))
+		sum.NETTAMOUNT = sum.NETTAMOUNT.Add(vat.NetAmount)
+		sum.TAXAMOUNT = sum.TAXAMOUNT.Add(vat.TaxAmount)
 	}
 
-	return models.VATTOTALS{
-		VATTOTAL: []*models.VATTOTAL{
-			{
-				VATRATE:    "A-18.00",
-				NETTAMOUNT: fmt.Sprintf("%.2f", vatTotalMap["A-18.00"].NetAmount),
-				TAXAMOUNT:  fmt.Sprintf("%.2f", vatTotalMap["A-18.00"].TaxAmount),
-			},
-			{
-				VATRATE:    "B-0.00",
-				NETTAMOUNT: fmt.Sprintf("%.2f", vatTotalMap["B-0.00"].NetAmount),
-				TAXAMOUNT:  fmt.Sprintf("%.2f", vatTotalMap["B-0.00"].TaxAmount),
-			},
-			{
-				VATRATE:    "C-0.00",
-				NETTAMOUNT: fmt.Sprintf("%.2f", vatTotalMap["C-0.00"].NetAmount),
-				TAXAMOUNT:  fmt.Sprintf("%.2f", vatTotalMap["C-0.00"].TaxAmount),
-			},
-			{
-				VATRATE:    "D-0.00",
-				NETTAMOUNT: fmt.Sprintf("%.2f", vatTotalMap["D-0.00"].NetAmount),
-				TAXAMOUNT:  fmt.Sprintf("%.2f", vatTotalMap["D-0.00"].TaxAmount),
-			},
-			{
-				VATRATE:    "E-0.00",
-				NETTAMOUNT: fmt.Sprintf("%.2f", vatTotalMap["E-0.00"].NetAmount),
-				TAXAMOUNT:  fmt.Sprintf("%.2f", vatTotalMap["E-0.00"].TaxAmount),
-			},
-		},
+	list := make([]*models.VATTOTAL, len(rates))
+	for i, rate := range rates {
+		list[i] = sums[rate]
 	}
+
+	return models.VATTOTALS{VATTOTAL: list}
 }
 
 // sumPayments sums all payments
 func sumPayments(payments []Payment) models.PAYMENTS {
-	paymentMap := map[string]float64{
-		"CASH":    0.0,
-		"CHEQUE":  0.0,
-		"CCARD":   0.0,
-		"EMONEY":  0.0,
-		"INVOICE": 0.0,
+	paymentMap := map[string]money.Money{
+		"CASH":    money.Zero,
+		"CHEQUE":  money.Zero,
+		"CCARD":   money.Zero,
+		"EMONEY":  money.Zero,
+		"INVOICE": money.Zero,
 	}
 
 	for _, p := range payments {
 		pType := string(p.Type)
-		paymentMap[pType] += p.Amount
+		paymentMap[pType] = paymentMap[pType].Add(p.Amount)
 	}
 
 	// paymentList contains a list of payments and the order
@@ -240,25 +201,25 @@ func sumPayments(payments []Payment) models.PAYMENTS {
 	paymentsList := make([]*models.PAYMENT, 5)
 	paymentsList[0] = &models.PAYMENT{
 		PMTTYPE:   "CASH",
-		PMTAMOUNT: fmt.Sprintf("%.2f", paymentMap["CASH"]),
+		PMTAMOUNT: paymentMap["CASH"],
 	}
 	paymentsList[1] = &models.PAYMENT{
 		PMTTYPE:   "CHEQUE",
-		PMTAMOUNT: fmt.Sprintf("%.2f", paymentMap["CHEQUE"]),
+		PMTAMOUNT: paymentMap["CHEQUE"],
 	}
 	paymentsList[2] = &models.PAYMENT{
 		PMTTYPE:   "CCARD",
-		PMTAMOUNT: fmt.Sprintf("%.2f", paymentMap["CCARD"]),
+		PMTAMOUNT: paymentMap["CCARD"],
 	}
 
 	paymentsList[3] = &models.PAYMENT{
 		PMTTYPE:   "EMONEY",
-		PMTAMOUNT: fmt.Sprintf("%.2f", paymentMap["EMONEY"]),
+		PMTAMOUNT: paymentMap["EMONEY"],
 	}
 
 	paymentsList[4] = &models.PAYMENT{
 		PMTTYPE:   "INVOICE",
-		PMTAMOUNT: fmt.Sprintf("%.2f", paymentMap["INVOICE"]),
+		PMTAMOUNT: paymentMap["INVOICE"],
 	}
 
 	return models.PAYMENTS{
@@ -266,18 +227,36 @@ func sumPayments(payments []Payment) models.PAYMENTS {
 	}
 }
 
-func generateZReport(params *ReportParams, address Address, vats []VATTOTAL, payments []Payment, totals ReportTotals) *models.ZREPORT {
-	const (
-		SIMIMSI       = "WEBAPI"
-		FWVERSION     = "3.0"
-		FWCHECKSUM    = "WEBAPI"
-		VATCHANGENUM  = "0"
-		HEADCHANGENUM = "0"
-		ERRORS        = ""
-	)
+// header returns the HEADER lines of the Z report, opts.Header if set and the
+// lines of the address otherwise.
+func (opts ReportOptions) header(address Address) []string {
+	if len(opts.Header) > 0 {
+		return opts.Header
+	}
+	return address.AsList()
+}
+
+// withDefaults returns the options with the empty values set to their defaults.
+func (opts ReportOptions) withDefaults() ReportOptions {
+	if opts.SIMIMSI == "" {
+		opts.SIMIMSI = DefaultSIMIMSI
+	}
+	if opts.FirmwareVersion == "" {
+		opts.FirmwareVersion = DefaultFirmwareVersion
+	}
+	if opts.FirmwareChecksum == "" {
+		opts.FirmwareChecksum = DefaultFirmwareChecksum
+	}
+	return opts
+}
+
+func generateZReport(params *ReportParams, address Address, vats []VATTOTAL, payments []Payment, totals ReportTotals,
+	opts ReportOptions,
+) *models.ZREPORT {
+	opts = opts.withDefaults()
 
 	PAYMENTS := sumPayments(payments)
-	VATTOTALS := sumVatTotals(vats)
+	VATTOTALS := sumVatTotals(vats, opts.VATTable.orDefault(), params.Date)
 
 	TT := models.REPORTTOTALS{
 		DAILYTOTALAMOUNT: totals.DailyTotalAmount,
@@ -299,7 +278,7 @@ func generateZReport(params *ReportParams, address Address, vats []VATTOTAL, pay
 			Text string   `xml:",chardata"`
 			LINE []string `xml:"LINE"`
 		}{
-			LINE: address.AsList(),
+			LINE: opts.header(address),
 		},
 		VRN:              params.VRN,
 		TIN:              params.TIN,
@@ -309,7 +288,7 @@ func generateZReport(params *ReportParams, address Address, vats []VATTOTAL, pay
 		EFDSERIAL:        params.EFDSerial,
 		REGISTRATIONDATE: params.RegistrationDate,
 		USER:             params.UIN,
-		SIMIMSI:          SIMIMSI,
+		SIMIMSI:          opts.SIMIMSI,
 		TOTALS:           TT,
 		VATTOTALS:        VATTOTALS,
 		PAYMENTS:         PAYMENTS,
@@ -318,32 +297,38 @@ func generateZReport(params *ReportParams, address Address, vats []VATTOTAL, pay
 			VATCHANGENUM  string `xml:"VATCHANGENUM"`
 			HEADCHANGENUM string `xml:"HEADCHANGENUM"`
 		}{
-			VATCHANGENUM:  VATCHANGENUM,
-			HEADCHANGENUM: HEADCHANGENUM,
+			VATCHANGENUM:  strconv.FormatInt(opts.VATChangeNum, 10),
+			HEADCHANGENUM: strconv.FormatInt(opts.HeaderChangeNum, 10),
 		},
-		ERRORS:     ERRORS,
-		FWVERSION:  FWVERSION,
-		FWCHECKSUM: FWCHECKSUM,
+		ERRORS:     opts.Errors,
+		FWVERSION:  opts.FirmwareVersion,
+		FWCHECKSUM: opts.FirmwareChecksum,
 	}
 
-	// report.RoundOff()
-
 	return report
 }
 
-// ReportBytes returns the bytes of the report payload. It calls xml.Marshal on the report.
-// then replace all the occurrences of <PAYMENT>, </PAYMENT>, <VATTOTAL>, </VATTOTAL> with empty string ""
-// and then add the xml.Header to the beginning of the payload.
+// ReportBytes returns the bytes of the report payload. It calls xml.Marshal on the report,
+// signs it and then add the xml.Header to the beginning of the payload. PAYMENTS and
+// VATTOTALS are marshalled without the PAYMENT and VATTOTAL wrappers as expected by
+// the VFD server. The default ReportOptions are used.
 func ReportBytes(privateKey *rsa.PrivateKey, params *ReportParams, address Address,
 	vats []VATTOTAL, payments []Payment,
 	totals ReportTotals,
 ) ([]byte, error) {
-	zReport := generateZReport(params, address, vats, payments, totals)
-	payload, err := xml.Marshal(zReport)
+	return ReportBytesWithOptions(privateKey, params, address, vats, payments, totals, ReportOptions{})
+}
+
+// ReportBytesWithOptions is like ReportBytes with the header fields set from opts.
+func ReportBytesWithOptions(privateKey *rsa.PrivateKey, params *ReportParams, address Address,
+	vats []VATTOTAL, payments []Payment,
+	totals ReportTotals, opts ReportOptions,
+) ([]byte, error) {
+	payload, err := reportPayload(params, address, vats, payments, totals, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal the report: %w", err)
+		return nil, err
 	}
-	payloadString := formatReportXmlPayload(payload, totals, vats, payments)
+	payloadString := string(payload)
 	signedPayload, err := SignPayload(privateKey, []byte(payloadString))
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign the payload: %w", err)
@@ -355,20 +340,14 @@ func ReportBytes(privateKey *rsa.PrivateKey, params *ReportParams, address Addre
 	return []byte(report), nil
 }
 
-func formatReportXmlPayload(payload []byte, totals ReportTotals, vats []VATTOTAL, payments []Payment) string {
-	replaceList := []string{"<PAYMENT>", "", "</PAYMENT>", "", "<VATTOTAL>", "", "</VATTOTAL>", ""}
-	replacer := strings.NewReplacer(replaceList...)
-	payloadString := replacer.Replace(string(payload))
-
-	var (
-		regexDailyAmount = regexp.MustCompile(`<DAILYTOTALAMOUNT>.*</DAILYTOTALAMOUNT>`)
-		regexGrossAmount = regexp.MustCompile(`<GROSS>.*</GROSS>`)
-		dailyAmountTag   = fmt.Sprintf("<DAILYTOTALAMOUNT>%.2f</DAILYTOTALAMOUNT>", totals.DailyTotalAmount)
-		grossAmountTag   = fmt.Sprintf("<GROSS>%.2f</GROSS>", totals.Gross)
-	)
-
-	payloadString = regexDailyAmount.ReplaceAllString(payloadString, dailyAmountTag)
-	payloadString = regexGrossAmount.ReplaceAllString(payloadString, grossAmountTag)
-
-	return payloadString
+// reportPayload returns the unsigned ZREPORT element of the report.
+func reportPayload(params *ReportParams, address Address, vats []VATTOTAL, payments []Payment,
+	totals ReportTotals, opts ReportOptions,
+) ([]byte, error) {
+	zReport := generateZReport(params, address, vats, payments, totals, opts)
+	payload, err := xml.Marshal(zReport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the report: %w", err)
+	}
+	return payload, nil
 }
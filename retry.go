@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// DefaultRetryPolicy makes up to 4 attempts, waiting about 0.5s, 1s and 2s
+// between them.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+type (
+	// RetryPolicy decides how often and how fast a request to the VFD server is
+	// repeated when it fails in a way that is safe to retry, see IsRetryable and
+	// IsRetryableCode. MaxAttempts counts the first attempt, a value below 2
+	// disables retries. The delay after attempt n is InitialBackoff multiplied
+	// by Multiplier n-1 times, capped at MaxBackoff and then moved randomly by
+	// up to Jitter (a fraction between 0 and 1) in either direction.
+	// OnAttempt, if set, is called after every attempt.
+	RetryPolicy struct {
+		MaxAttempts    int
+		InitialBackoff time.Duration
+		MaxBackoff     time.Duration
+		Multiplier     float64
+		Jitter         float64
+		OnAttempt      func(Attempt)
+	}
+
+	// Attempt describes a finished attempt of a request. Err is the error of
+	// the attempt and Code the ACK code when Err is an *AckError. Retry tells
+	// if another attempt follows after Delay.
+	Attempt struct {
+		Operation string
+		Number    int
+		Code      int64
+		Err       error
+		Retry     bool
+		Delay     time.Duration
+	}
+)
+
+// IsRetryable reports whether a request that failed with err can be sent again:
+// network errors and 5xx responses from the VFD server are, anything else is not.
+// Errors caused by the caller's context being done are not retryable either.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var statusErr *StatusError
+	return IsNetworkError(err) || errors.As(err, &statusErr)
+}
+
+// IsRetryableCode reports whether a request acknowledged with the given ACK code
+// can be sent again. Only UnhandledException is, signature, TIN, approval,
+// serial, header and certificate errors will fail the same way every time.
+func IsRetryableCode(code int64) bool {
+	return code == UnhandledException
+}
+
+// delay returns the time to wait after the given attempt.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		delay *= multiplier
+		if p.MaxBackoff > 0 && delay >= float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1) //nolint:gosec
+	}
+
+	return time.Duration(delay)
+}
+
+// withRetry calls do until it succeeds, fails in a way that is not retryable or
+// the policy runs out of attempts.
+func withRetry[T any](ctx context.Context, policy RetryPolicy, operation string,
+	do func() (T, error),
+) (T, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := do()
+
+		info := Attempt{Operation: operation, Number: attempt, Err: err}
+		retryable := IsRetryable(err)
+		var ackErr *AckError
+		if errors.As(err, &ackErr) {
+			info.Code = ackErr.Code
+			retryable = IsRetryableCode(ackErr.Code)
+		}
+
+		info.Retry = retryable && attempt < policy.MaxAttempts && ctx.Err() == nil
+		if info.Retry {
+			info.Delay = policy.delay(attempt)
+		}
+		if policy.OnAttempt != nil {
+			policy.OnAttempt(info)
+		}
+		if !info.Retry {
+			return result, err
+		}
+
+		timer := time.NewTimer(info.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_RetryPolicy(t *testing.T) {
+	t.Parallel()
+	ack := func(code int64) string {
+		return fmt.Sprintf(`<EFDMS><RCTACK><RCTNUM>100</RCTNUM><DATE>2023-01-01</DATE><TIME>08:00:00</TIME>`+
+			`<ACKCODE>%d</ACKCODE><ACKMSG>%s</ACKMSG></RCTACK><EFDMSSIGNATURE>x</EFDMSSIGNATURE></EFDMS>`,
+			code, ParseErrorCode(code))
+	}
+
+	tests := []struct {
+		name         string
+		responses    []func(w http.ResponseWriter)
+		wantAttempts int
+		wantCode     int64
+		wantErr      bool
+	}{
+		{
+			name: "5xx then success",
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) },
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+				func(w http.ResponseWriter) { _, _ = w.Write([]byte(ack(SuccessCode))) },
+			},
+			wantAttempts: 3,
+			wantCode:     SuccessCode,
+		},
+		{
+			name: "unhandled exception is retried until attempts run out",
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { _, _ = w.Write([]byte(ack(UnhandledException))) },
+			},
+			wantAttempts: 3,
+			wantCode:     UnhandledException,
+			wantErr:      true,
+		},
+		{
+			name: "invalid signature is never retried",
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { _, _ = w.Write([]byte(ack(InvalidSignatureCode))) },
+			},
+			wantAttempts: 1,
+			wantCode:     InvalidSignatureCode,
+			wantErr:      true,
+		},
+		{
+			name: "client errors are not retried",
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusUnauthorized) },
+			},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var requests int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt64(&requests, 1))
+				tt.responses[min(n, len(tt.responses))-1](w)
+			}))
+			defer server.Close()
+
+			var attempts []Attempt
+			policy := RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+				Multiplier:     2,
+				Jitter:         0.5,
+				OnAttempt:      func(a Attempt) { attempts = append(attempts, a) },
+			}
+			client := NewClient(WithHttpClient(server.Client()), WithRetryPolicy(policy))
+
+			response, err := client.SubmitPayload(context.Background(), server.URL,
+				&RequestHeaders{BearerToken: "token"}, SubmitReceiptAction, []byte("<EFDMS></EFDMS>"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SubmitPayload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if response != nil && response.Code != tt.wantCode {
+				t.Errorf("SubmitPayload() code = %d, want %d", response.Code, tt.wantCode)
+			}
+			if len(attempts) != tt.wantAttempts || int(atomic.LoadInt64(&requests)) != tt.wantAttempts {
+				t.Fatalf("attempts = %d, requests = %d, want %d", len(attempts), requests, tt.wantAttempts)
+			}
+			for i, attempt := range attempts {
+				last := i == len(attempts)-1
+				if attempt.Number != i+1 || attempt.Retry == last || (attempt.Delay > 0) == last {
+					t.Errorf("attempt %d = %+v", i+1, attempt)
+				}
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "network error", err: &NetworkError{Err: errors.New("connection reset"), Message: "upload"}, want: true},
+		{name: "caller canceled", err: &NetworkError{Err: context.Canceled, Message: "upload"}, want: false},
+		{name: "server error", err: fmt.Errorf("%w: %w", ErrReceiptUploadFailed, &StatusError{StatusCode: 503}), want: true},
+		{name: "unauthorized", err: ErrUnauthorized, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for code := SuccessCode; code <= InvalidCertificate; code++ {
+		if got, want := IsRetryableCode(code), code == UnhandledException; got != want {
+			t.Errorf("IsRetryableCode(%d) = %v, want %v", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Golang-Tanzania/tra-vfd/internal/models"
+)
+
+// ErrUnauthorized is returned when the VFD server rejects the bearer token,
+// even after re-authenticating.
+var ErrUnauthorized = errors.New("unauthorized")
+
+type (
+	// TokenRefresher is implemented by token sources that can be forced to fetch
+	// a new token, *TokenManager is one of them. When the VFD server rejects a
+	// token taken from such a source, the request is sent once more with a
+	// freshly fetched token.
+	TokenRefresher interface {
+		Refresh(ctx context.Context) (*TokenResponse, error)
+	}
+
+	// exchange is the raw result of posting a signed payload to the VFD server.
+	exchange struct {
+		statusCode      int
+		body            []byte
+		reauthenticated bool
+	}
+)
+
+// isAuthFailure reports whether the VFD server rejected the bearer token.
+func isAuthFailure(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// tokenRejected reports whether the VFD server rejected the bearer token, with
+// an error status or with one of the ACK codes set by WithTokenAckCodes.
+func (c *Client) tokenRejected(result *exchange) bool {
+	if isAuthFailure(result.statusCode) {
+		return true
+	}
+	if len(c.tokenCodes) == 0 || result.statusCode != http.StatusOK {
+		return false
+	}
+
+	code, ok := ackCode(result.body)
+	return ok && slices.Contains(c.tokenCodes, code)
+}
+
+// ackCode returns the content of the first ACKCODE element of an
+// acknowledgement, before its signature is verified.
+func ackCode(body []byte) (int64, bool) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, false
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "ACKCODE" {
+			continue
+		}
+
+		var content string
+		if err := decoder.DecodeElement(&content, &start); err != nil {
+			return 0, false
+		}
+		code, err := strconv.ParseInt(strings.TrimSpace(content), 10, 64)
+		return code, err == nil
+	}
+}
+
+// postPayload posts an already signed payload to the VFD server. If the server
+// rejects the token and headers.TokenSource is a TokenRefresher, a new token is
+// fetched and the same payload is posted exactly once more.
+func postPayload(ctx context.Context, client *Client, requestURL string, headers *RequestHeaders,
+	routingKey string, payload []byte, operation string,
+) (*exchange, error) {
+	token, err := bearerToken(ctx, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := doPost(ctx, client.http, requestURL, headers.CertSerial, token, routingKey, payload, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	refresher, ok := headers.TokenSource.(TokenRefresher)
+	if !client.tokenRejected(result) || headers.BearerToken != "" || !ok {
+		return result, nil
+	}
+
+	fresh, err := refresher.Refresh(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: re-authentication failed: %w", operation, err)
+	}
+
+	result, err = doPost(ctx, client.http, requestURL, headers.CertSerial, fresh.AccessToken, routingKey, payload,
+		operation)
+	if err != nil {
+		return nil, err
+	}
+	result.reauthenticated = true
+
+	return result, nil
+}
+
+func doPost(ctx context.Context, client *http.Client, requestURL, certSerial, token, routingKey string,
+	payload []byte, operation string,
+) (*exchange, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, requestURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", ContentTypeXML)
+	if routingKey != "" {
+		req.Header.Set("Routing-Key", routingKey)
+	}
+	req.Header.Set("Cert-Serial", encodeBase64String(certSerial))
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", token))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, checkNetworkError(ctx, operation, err)
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: could not close response body %v", operation, err)
+		}
+	}(resp.Body)
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, checkNetworkError(ctx, operation, err)
+	}
+
+	return &exchange{
+		statusCode: resp.StatusCode,
+		body:       out,
+	}, nil
+}
+
+// decodeReceiptAck decodes the RCTACK returned after a receipt upload.
+func (c *Client) decodeReceiptAck(result *exchange) (*Response, error) {
+	if err := checkStatus(result, ErrReceiptUploadFailed); err != nil {
+		return nil, err
+	}
+
+	response := models.RCTACKEFDMS{}
+	err := xml.NewDecoder(bytes.NewBuffer(result.body)).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
+	}
+
+	err = c.verifyServerSignature(result.body, "RCTACK", response.EFDMSSIGNATURE)
+	if err != nil {
+		return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
+	}
+
+	ack := &Response{
+		Number:          response.RCTACK.RCTNUM,
+		Date:            response.RCTACK.DATE,
+		Time:            response.RCTACK.TIME,
+		Code:            response.RCTACK.ACKCODE,
+		Message:         response.RCTACK.ACKMSG,
+		Reauthenticated: result.reauthenticated,
+	}
+
+	return ack, ackError("receipt upload", ErrReceiptUploadFailed, ack.Code, ack.Message)
+}
+
+// decodeReportAck decodes the ZACK returned after a Z report submission.
+func (c *Client) decodeReportAck(result *exchange) (*Response, error) {
+	if err := checkStatus(result, ErrReportSubmitFailed); err != nil {
+		return nil, err
+	}
+
+	response := models.ReportAckEFDMS{}
+	err := xml.NewDecoder(bytes.NewBuffer(result.body)).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("%v : %w", ErrReportSubmitFailed, err)
+	}
+
+	err = c.verifyServerSignature(result.body, "ZACK", response.EFDMSSIGNATURE)
+	if err != nil {
+		return nil, fmt.Errorf("%v : %w", ErrReportSubmitFailed, err)
+	}
+
+	ack := &Response{
+		Number:          response.ZACK.ZNUMBER,
+		Date:            response.ZACK.DATE,
+		Time:            response.ZACK.TIME,
+		Code:            response.ZACK.ACKCODE,
+		Message:         response.ZACK.ACKMSG,
+		Reauthenticated: result.reauthenticated,
+	}
+
+	return ack, ackError("submit report", ErrReportSubmitFailed, ack.Code, ack.Message)
+}
+
+// checkStatus turns the error statuses of the VFD server into errors wrapping cause.
+func checkStatus(result *exchange, cause error) error {
+	if isAuthFailure(result.statusCode) {
+		return fmt.Errorf("%w: %w: status %d", cause, ErrUnauthorized, result.statusCode)
+	}
+
+	if err := serverError(result.statusCode, result.body); err != nil {
+		return fmt.Errorf("%w: %w", cause, err)
+	}
+
+	return nil
+}
+
+// serverError returns a *StatusError for 5xx responses and nil otherwise.
+func serverError(statusCode int, body []byte) error {
+	if statusCode < http.StatusInternalServerError {
+		return nil
+	}
+
+	message := http.StatusText(statusCode)
+	errBody := models.Error{}
+	if err := xml.NewDecoder(bytes.NewBuffer(body)).Decode(&errBody); err == nil && errBody.Message != "" {
+		message = errBody.Message
+	}
+
+	return &StatusError{StatusCode: statusCode, Message: message}
+}
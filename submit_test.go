@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+func TestPostPayload_Reauthenticate(t *testing.T) {
+	t.Parallel()
+	var (
+		mu       sync.Mutex
+		bodies   [][]byte
+		accepted = "bearer token-2"
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+
+		if r.Header.Get("Authorization") != accepted {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><EFDMS><RCTACK><RCTNUM>100</RCTNUM>` +
+			`<DATE>2023-01-01</DATE><TIME>08:00:00</TIME><ACKCODE>0</ACKCODE><ACKMSG>Success</ACKMSG></RCTACK>` +
+			`<EFDMSSIGNATURE>c2lnbmF0dXJl</EFDMSSIGNATURE></EFDMS>`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		headers        func() *RequestHeaders
+		wantErr        error
+		wantRequests   int
+		wantReauthFlag bool
+	}{
+		{
+			name: "token manager is refreshed once",
+			headers: func() *RequestHeaders {
+				var calls int64
+				manager := NewTokenManager("", &TokenRequest{}, WithTokenFetcher(countingFetcher(&calls, 3600)))
+				return &RequestHeaders{TokenSource: manager}
+			},
+			wantRequests:   2,
+			wantReauthFlag: true,
+		},
+		{
+			name: "static token is not retried",
+			headers: func() *RequestHeaders {
+				return &RequestHeaders{BearerToken: "token-1"}
+			},
+			wantErr:      ErrUnauthorized,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		mu.Lock()
+		bodies = nil
+		mu.Unlock()
+
+		payload := []byte("<EFDMS><RCT></RCT><EFDMSSIGNATURE>x</EFDMSSIGNATURE></EFDMS>")
+		result, err := postPayload(context.Background(), &Client{http: server.Client()}, server.URL, tt.headers(),
+			SubmitReceiptRoutingKey, payload, "receipt upload")
+		if err != nil {
+			t.Fatalf("%s: postPayload() error = %v", tt.name, err)
+		}
+
+		response, err := defaultClient().decodeReceiptAck(result)
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: decodeReceiptAck() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && response.Reauthenticated != tt.wantReauthFlag {
+			t.Errorf("%s: Reauthenticated = %v, want %v", tt.name, response.Reauthenticated, tt.wantReauthFlag)
+		}
+
+		mu.Lock()
+		if len(bodies) != tt.wantRequests {
+			t.Errorf("%s: server received %d requests, want %d", tt.name, len(bodies), tt.wantRequests)
+		}
+		for _, body := range bodies {
+			if !bytes.Equal(body, payload) {
+				t.Errorf("%s: resent payload differs from the original", tt.name)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func TestClient_VerifyServerSignature(t *testing.T) {
+	t.Parallel()
+	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate server key: %v", err)
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate client key: %v", err)
+	}
+
+	ack := []byte(`<RCTACK><RCTNUM>100</RCTNUM><DATE>2023-01-01</DATE><TIME>08:00:00</TIME>` +
+		`<ACKCODE>0</ACKCODE><ACKMSG>Success</ACKMSG></RCTACK>`)
+	signature, err := Sign(serverKey, ack)
+	if err != nil {
+		t.Fatalf("could not sign ack: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr error
+	}{
+		{
+			name: "valid signature",
+			body: fmt.Sprintf("<EFDMS>%s<EFDMSSIGNATURE>%s</EFDMSSIGNATURE></EFDMS>", ack, encodeBase64Bytes(signature)),
+		},
+		{
+			name: "tampered response",
+			body: fmt.Sprintf("<EFDMS>%s<EFDMSSIGNATURE>%s</EFDMSSIGNATURE></EFDMS>",
+				bytes.Replace(ack, []byte("100"), []byte("101"), 1), encodeBase64Bytes(signature)),
+			wantErr: ErrInvalidServerSignature,
+		},
+		{
+			name:    "missing signature",
+			body:    fmt.Sprintf("<EFDMS>%s</EFDMS>", ack),
+			wantErr: ErrInvalidServerSignature,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := NewClient(WithHttpClient(server.Client()), WithServerPublicKey(&serverKey.PublicKey))
+			receipt := &ReceiptRequest{
+				Params: ReceiptParams{
+					Date: "2023-01-01", Time: "08:00:00", TIN: "100553997", RegistrationID: "TZ0100553997",
+					EFDSerial: "10TZ101807", DailyCounter: 1, GlobalCounter: 100,
+				},
+				Customer: Customer{Type: NonCustomerID},
+				Items:    []Item{{ID: "1", Description: "Item 1", TaxCode: TaxableItemCode, Quantity: 1, UnitPrice: money.FromFloat(1000)}},
+			}
+			_, err := client.SubmitReceipt(context.Background(), server.URL,
+				&RequestHeaders{BearerToken: "token"}, clientKey, receipt)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("SubmitReceipt() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeAck_AckError(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		decode func(*exchange) (*Response, error)
+		body   string
+		want   error
+		cause  error
+	}{
+		{
+			name:   "receipt with invalid signature",
+			decode: defaultClient().decodeReceiptAck,
+			body:   `<EFDMS><RCTACK><RCTNUM>100</RCTNUM><ACKCODE>1</ACKCODE><ACKMSG>Invalid Signature</ACKMSG></RCTACK></EFDMS>`,
+			want:   ErrInvalidSignature,
+			cause:  ErrReceiptUploadFailed,
+		},
+		{
+			name:   "report with invalid TIN",
+			decode: defaultClient().decodeReportAck,
+			body:   `<EFDMS><ZACK><ZNUMBER>20230101</ZNUMBER><ACKCODE>3</ACKCODE><ACKMSG>Invalid TIN</ACKMSG></ZACK></EFDMS>`,
+			want:   ErrInvalidTIN,
+			cause:  ErrReportSubmitFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		response, err := tt.decode(&exchange{statusCode: http.StatusOK, body: []byte(tt.body)})
+		if !errors.Is(err, tt.want) || !errors.Is(err, tt.cause) {
+			t.Errorf("%s: error = %v, want %v wrapping %v", tt.name, err, tt.want, tt.cause)
+		}
+		if errors.Is(err, ErrInvalidSerial) {
+			t.Errorf("%s: error %v matches %v", tt.name, err, ErrInvalidSerial)
+		}
+
+		var ackErr *AckError
+		if !errors.As(err, &ackErr) || ackErr.Operation == "" || ackErr.Message == "" {
+			t.Errorf("%s: error = %#v, want an *AckError with operation and message", tt.name, err)
+		}
+		if response == nil || response.Code != tt.want.(*AckError).Code {
+			t.Errorf("%s: response = %+v, want it returned with the error", tt.name, response)
+		}
+	}
+}
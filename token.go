@@ -35,6 +35,10 @@ import (
 	xhttp "github.com/Golang-Tanzania/tra-vfd/internal/http"
 )
 
+// PasswordGrantType is the grant_type used with the USERNAME and PASSWORD
+// returned at registration.
+const PasswordGrantType = "password"
+
 // ErrFetchToken is the error returned when the token request fails.
 // It is a wrapper for the underlying error.
 var ErrFetchToken = errors.New("fetch token failed")
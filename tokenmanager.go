@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultTokenExpiryLeeway is how long before the actual expiry a cached token
+// is considered stale and a new one is fetched.
+const DefaultTokenExpiryLeeway = 5 * time.Minute
+
+// ErrEmptyAccessToken is returned when the token endpoint responds successfully
+// but without an access token.
+var ErrEmptyAccessToken = errors.New("empty access token")
+
+type (
+	// TokenSource supplies a valid bearer token for requests to the VFD server.
+	TokenSource interface {
+		Token(ctx context.Context) (*TokenResponse, error)
+	}
+
+	// TokenManager is a TokenSource that caches the token returned by the VFD server
+	// and fetches a new one shortly before the cached token expires. It is safe
+	// for concurrent use, only one fetch is in flight at any time and callers
+	// waiting for it return early when their context is done.
+	// When a TokenStore is configured the manager loads a still valid token from
+	// it on first use and saves every newly fetched token to it. A token that can
+	// not be loaded or was issued to another user is ignored and a new one is
+	// fetched.
+	TokenManager struct {
+		mu      sync.Mutex
+		url     string
+		request *TokenRequest
+		fetch   FetchTokenFunc
+		leeway  time.Duration
+		now     func() time.Time
+		store   TokenStore
+		onError func(error)
+		loaded  bool
+		current *StoredToken
+		flight  *tokenFetch
+	}
+
+	// tokenFetch is a fetch in flight, done is closed once token or err is set.
+	tokenFetch struct {
+		done  chan struct{}
+		token *TokenResponse
+		err   error
+	}
+
+	// TokenManagerOption configures a TokenManager.
+	TokenManagerOption func(*TokenManager)
+)
+
+// WithTokenFetcher sets the function used to fetch new tokens. By default,
+// the package level FetchToken is used. Client.FetchToken can be passed here
+// to reuse the http client of a Client.
+func WithTokenFetcher(fetch FetchTokenFunc) TokenManagerOption {
+	return func(m *TokenManager) {
+		if fetch != nil {
+			m.fetch = fetch
+		}
+	}
+}
+
+// WithExpiryLeeway sets how long before expiry the token is refreshed.
+func WithExpiryLeeway(leeway time.Duration) TokenManagerOption {
+	return func(m *TokenManager) {
+		if leeway >= 0 {
+			m.leeway = leeway
+		}
+	}
+}
+
+// WithTokenStore sets the TokenStore used to persist tokens.
+func WithTokenStore(store TokenStore) TokenManagerOption {
+	return func(m *TokenManager) {
+		m.store = store
+	}
+}
+
+// WithTokenStoreErrorHandler sets a function that is called with the errors of
+// the TokenStore. These errors do not fail Token, a token that can not be loaded
+// is fetched again and a token that can not be saved is still returned. The
+// handler is called from the goroutine that fetches the token.
+func WithTokenStoreErrorHandler(handler func(error)) TokenManagerOption {
+	return func(m *TokenManager) {
+		m.onError = handler
+	}
+}
+
+// WithClock sets the function used to read the current time. It is mostly
+// useful in tests.
+func WithClock(now func() time.Time) TokenManagerOption {
+	return func(m *TokenManager) {
+		if now != nil {
+			m.now = now
+		}
+	}
+}
+
+// NewTokenManager creates a TokenManager that fetches tokens from url using
+// the credentials in request.
+func NewTokenManager(url string, request *TokenRequest, options ...TokenManagerOption) *TokenManager {
+	m := &TokenManager{
+		url:     url,
+		request: request,
+		fetch:   FetchToken,
+		leeway:  DefaultTokenExpiryLeeway,
+		now:     time.Now,
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Token returns the cached token if it is still valid, otherwise it fetches
+// a new one from the VFD server.
+func (m *TokenManager) Token(ctx context.Context) (*TokenResponse, error) {
+	m.mu.Lock()
+	if !m.loaded {
+		m.load(ctx)
+		m.loaded = true
+	}
+
+	if m.current.Valid(m.now(), m.leeway) {
+		token := m.current.Token
+		m.mu.Unlock()
+		return token, nil
+	}
+
+	flight := m.refresh(ctx)
+	m.mu.Unlock()
+	return flight.wait(ctx)
+}
+
+// AccessToken is a convenience wrapper around Token that returns only the
+// access token string.
+func (m *TokenManager) AccessToken(ctx context.Context) (string, error) {
+	token, err := m.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// Refresh fetches a new token regardless of the state of the cached one.
+func (m *TokenManager) Refresh(ctx context.Context) (*TokenResponse, error) {
+	m.mu.Lock()
+	flight := m.refresh(ctx)
+	m.mu.Unlock()
+	return flight.wait(ctx)
+}
+
+// Invalidate drops the cached token so that the next call to Token fetches
+// a new one.
+func (m *TokenManager) Invalidate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current = nil
+}
+
+// ExpiresAt returns the time the cached token expires. It returns the zero
+// time when there is no cached token.
+func (m *TokenManager) ExpiresAt() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current == nil {
+		return time.Time{}
+	}
+	return m.current.ExpiresAt()
+}
+
+// load reads the saved token from the store if there is one and it was issued
+// to the user of the manager. Callers must hold m.mu.
+func (m *TokenManager) load(ctx context.Context) {
+	if m.store == nil {
+		return
+	}
+
+	stored, err := m.store.LoadToken(ctx)
+	if err != nil {
+		if !errors.Is(err, ErrTokenNotFound) {
+			m.reportError(fmt.Errorf("could not load token: %w", err))
+		}
+		return
+	}
+
+	if stored.Username != m.request.Username {
+		return
+	}
+
+	m.current = stored
+}
+
+// refresh returns the fetch in flight or starts a new one. The fetch is not
+// cancelled with ctx since other callers may be waiting for it, the http client
+// timeout bounds it instead. Callers must hold m.mu.
+func (m *TokenManager) refresh(ctx context.Context) *tokenFetch {
+	if m.flight != nil {
+		return m.flight
+	}
+
+	flight := &tokenFetch{done: make(chan struct{})}
+	m.flight = flight
+	go func() {
+		defer close(flight.done)
+		flight.token, flight.err = m.fetchToken(context.WithoutCancel(ctx))
+	}()
+
+	return flight
+}
+
+// fetchToken fetches a new token, caches it and saves it to the store.
+func (m *TokenManager) fetchToken(ctx context.Context) (*TokenResponse, error) {
+	obtainedAt := m.now()
+	token, err := m.fetch(ctx, m.url, m.request)
+	if err == nil && token.AccessToken == "" {
+		err = fmt.Errorf("%w: %w", ErrFetchToken, ErrEmptyAccessToken)
+	}
+
+	m.mu.Lock()
+	m.flight = nil
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	current := &StoredToken{
+		Token:      token,
+		ObtainedAt: obtainedAt,
+		Username:   m.request.Username,
+	}
+	m.current = current
+	m.mu.Unlock()
+
+	// the token is usable even if it could not be persisted
+	if m.store != nil {
+		if err := m.store.SaveToken(ctx, current); err != nil {
+			m.reportError(fmt.Errorf("could not save token: %w", err))
+		}
+	}
+
+	return token, nil
+}
+
+// wait blocks until the fetch is done or ctx is done.
+func (f *tokenFetch) wait(ctx context.Context) (*TokenResponse, error) {
+	select {
+	case <-f.done:
+		return f.token, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reportError passes err to the handler set with WithTokenStoreErrorHandler.
+func (m *TokenManager) reportError(err error) {
+	if m.onError != nil {
+		m.onError(err)
+	}
+}
+
+// bearerToken returns the token to be used in the Authorization header. A static
+// RequestHeaders.BearerToken takes precedence over RequestHeaders.TokenSource.
+func bearerToken(ctx context.Context, headers *RequestHeaders) (string, error) {
+	if headers.BearerToken != "" || headers.TokenSource == nil {
+		return headers.BearerToken, nil
+	}
+
+	token, err := headers.TokenSource.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return token.AccessToken, nil
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFetcher returns a FetchTokenFunc that issues a new token on every call
+// and records the number of calls.
+func countingFetcher(calls *int64, expiresIn int64) FetchTokenFunc {
+	return func(ctx context.Context, url string, request *TokenRequest) (*TokenResponse, error) {
+		n := atomic.AddInt64(calls, 1)
+		return &TokenResponse{
+			AccessToken: fmt.Sprintf("token-%d", n),
+			TokenType:   "bearer",
+			ExpiresIn:   expiresIn,
+		}, nil
+	}
+}
+
+func TestTokenManager_Token(t *testing.T) {
+	t.Parallel()
+	var (
+		calls int64
+		now   = time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+	)
+
+	manager := NewTokenManager("", &TokenRequest{},
+		WithTokenFetcher(countingFetcher(&calls, 3600)),
+		WithExpiryLeeway(time.Minute),
+		WithClock(func() time.Time { return now }),
+	)
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		want    string
+	}{
+		{name: "first call fetches", advance: 0, want: "token-1"},
+		{name: "cached token is reused", advance: 30 * time.Minute, want: "token-1"},
+		{name: "token within leeway is refreshed", advance: 29*time.Minute + 30*time.Second, want: "token-2"},
+		{name: "refreshed token is reused", advance: time.Minute, want: "token-2"},
+	}
+
+	for _, tt := range tests {
+		now = now.Add(tt.advance)
+		got, err := manager.AccessToken(context.Background())
+		if err != nil {
+			t.Fatalf("%s: AccessToken() error = %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: AccessToken() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	manager.Invalidate()
+	got, err := manager.AccessToken(context.Background())
+	if err != nil {
+		t.Fatalf("AccessToken() after Invalidate error = %v", err)
+	}
+	if got != "token-3" {
+		t.Errorf("AccessToken() after Invalidate = %s, want token-3", got)
+	}
+}
+
+func TestTokenManager_Concurrent(t *testing.T) {
+	t.Parallel()
+	var calls int64
+	manager := NewTokenManager("", &TokenRequest{},
+		WithTokenFetcher(countingFetcher(&calls, 3600)))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := manager.Token(context.Background()); err != nil {
+				t.Errorf("Token() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected exactly one fetch, got %d", calls)
+	}
+}
+
+func TestTokenManager_WaitCancelled(t *testing.T) {
+	t.Parallel()
+	var (
+		calls   int64
+		release = make(chan struct{})
+		fetch   = countingFetcher(&calls, 3600)
+	)
+
+	manager := NewTokenManager("", &TokenRequest{},
+		WithTokenFetcher(func(ctx context.Context, url string, request *TokenRequest) (*TokenResponse, error) {
+			<-release
+			return fetch(ctx, url, request)
+		}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := manager.Token(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Token() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the fetch is still in flight, it must not block the other methods
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.Invalidate()
+		_ = manager.ExpiresAt()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Invalidate and ExpiresAt are blocked by the fetch in flight")
+	}
+
+	close(release)
+	got, err := manager.AccessToken(context.Background())
+	if err != nil {
+		t.Fatalf("AccessToken() error = %v", err)
+	}
+	if got != "token-1" || atomic.LoadInt64(&calls) != 1 {
+		t.Errorf("AccessToken() = %s after %d fetches, want the token of the fetch in flight", got, calls)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	t.Parallel()
+	var calls int64
+	source := NewTokenManager("", &TokenRequest{}, WithTokenFetcher(countingFetcher(&calls, 3600)))
+
+	tests := []struct {
+		name    string
+		headers *RequestHeaders
+		want    string
+	}{
+		{name: "static token", headers: &RequestHeaders{BearerToken: "static", TokenSource: source}, want: "static"},
+		{name: "token source", headers: &RequestHeaders{TokenSource: source}, want: "token-1"},
+		{name: "no token", headers: &RequestHeaders{}, want: ""},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bearerToken(context.Background(), tt.headers)
+			if err != nil {
+				t.Fatalf("bearerToken() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("bearerToken() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Golang-Tanzania/tra-vfd/internal/fileutil"
+)
+
+// ErrTokenNotFound is returned by a TokenStore when no token has been saved.
+var ErrTokenNotFound = errors.New("token not found")
+
+type (
+	// StoredToken is a TokenResponse together with the time it was obtained. The
+	// time is needed to work out when the token expires since the VFD server only
+	// returns the lifetime of the token in seconds. Username is the user the token
+	// was issued to, a saved token is only reused for the same user.
+	StoredToken struct {
+		Token      *TokenResponse `json:"token"`
+		ObtainedAt time.Time      `json:"obtained_at"`
+		Username   string         `json:"username"`
+	}
+
+	// TokenStore persists tokens so that they can be reused across restarts.
+	// LoadToken returns ErrTokenNotFound when there is nothing saved.
+	TokenStore interface {
+		LoadToken(ctx context.Context) (*StoredToken, error)
+		SaveToken(ctx context.Context, token *StoredToken) error
+	}
+
+	// MemoryTokenStore is a TokenStore that keeps the token in memory.
+	MemoryTokenStore struct {
+		mu    sync.RWMutex
+		token *StoredToken
+	}
+
+	// FileTokenStore is a TokenStore that saves the token as JSON in a file. If
+	// Key is set the content is encrypted with AES-GCM, in that case the key must
+	// be 16, 24 or 32 bytes long.
+	FileTokenStore struct {
+		Path string
+		Key  []byte
+	}
+)
+
+// ExpiresAt returns the time the token expires.
+func (s *StoredToken) ExpiresAt() time.Time {
+	if s.Token == nil {
+		return s.ObtainedAt
+	}
+	return s.ObtainedAt.Add(time.Duration(s.Token.ExpiresIn) * time.Second)
+}
+
+// Valid reports whether the token can still be used at the given time. The
+// token is considered expired leeway before its actual expiry.
+func (s *StoredToken) Valid(now time.Time, leeway time.Duration) bool {
+	if s == nil || s.Token == nil || s.Token.AccessToken == "" {
+		return false
+	}
+	return now.Add(leeway).Before(s.ExpiresAt())
+}
+
+// NewMemoryTokenStore creates an empty MemoryTokenStore.
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{}
+}
+
+func (m *MemoryTokenStore) LoadToken(_ context.Context) (*StoredToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.token == nil {
+		return nil, ErrTokenNotFound
+	}
+	token := *m.token
+	return &token, nil
+}
+
+func (m *MemoryTokenStore) SaveToken(_ context.Context, token *StoredToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	saved := *token
+	m.token = &saved
+	return nil
+}
+
+// NewFileTokenStore creates a FileTokenStore that saves tokens in path. Pass a
+// nil key to store the token unencrypted.
+func NewFileTokenStore(path string, key []byte) *FileTokenStore {
+	return &FileTokenStore{
+		Path: path,
+		Key:  key,
+	}
+}
+
+func (f *FileTokenStore) LoadToken(_ context.Context) (*StoredToken, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, fmt.Errorf("could not read token file: %w", err)
+	}
+
+	if len(f.Key) > 0 {
+		ciphertext, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("could not decode token file: %w", err)
+		}
+		data, err = decrypt(f.Key, ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt token file: %w", err)
+		}
+	}
+
+	token := new(StoredToken)
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("could not decode token file: %w", err)
+	}
+
+	return token, nil
+}
+
+func (f *FileTokenStore) SaveToken(_ context.Context, token *StoredToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("could not encode token: %w", err)
+	}
+
+	if len(f.Key) > 0 {
+		ciphertext, err := encrypt(f.Key, data)
+		if err != nil {
+			return fmt.Errorf("could not encrypt token: %w", err)
+		}
+		data = []byte(base64.StdEncoding.EncodeToString(ciphertext))
+	}
+
+	return fileutil.WriteAtomic(f.Path, data, 0o600)
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenStores(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+
+	tests := []struct {
+		name  string
+		store TokenStore
+	}{
+		{name: "memory", store: NewMemoryTokenStore()},
+		{name: "file", store: NewFileTokenStore(filepath.Join(dir, "plain.json"), nil)},
+		{name: "encrypted file", store: NewFileTokenStore(filepath.Join(dir, "secret.json"), key)},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if _, err := tt.store.LoadToken(ctx); !errors.Is(err, ErrTokenNotFound) {
+				t.Fatalf("LoadToken() on empty store error = %v, want ErrTokenNotFound", err)
+			}
+
+			want := &StoredToken{
+				Token: &TokenResponse{
+					AccessToken: "secret-token",
+					TokenType:   "bearer",
+					ExpiresIn:   3600,
+				},
+				ObtainedAt: time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC),
+			}
+			if err := tt.store.SaveToken(ctx, want); err != nil {
+				t.Fatalf("SaveToken() error = %v", err)
+			}
+
+			got, err := tt.store.LoadToken(ctx)
+			if err != nil {
+				t.Fatalf("LoadToken() error = %v", err)
+			}
+			if got.Token.AccessToken != want.Token.AccessToken || !got.ObtainedAt.Equal(want.ObtainedAt) {
+				t.Errorf("LoadToken() = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "secret.json"))
+	if err != nil {
+		t.Fatalf("could not read encrypted token file: %v", err)
+	}
+	if bytes.Contains(data, []byte("secret-token")) {
+		t.Errorf("encrypted token file contains the plain access token")
+	}
+}
+
+func TestTokenManager_Store(t *testing.T) {
+	t.Parallel()
+	var (
+		calls int64
+		now   = time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+		store = NewMemoryTokenStore()
+	)
+
+	err := store.SaveToken(context.Background(), &StoredToken{
+		Token:      &TokenResponse{AccessToken: "saved", ExpiresIn: 3600},
+		ObtainedAt: now.Add(-30 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("SaveToken() error = %v", err)
+	}
+
+	manager := NewTokenManager("", &TokenRequest{},
+		WithTokenFetcher(countingFetcher(&calls, 3600)),
+		WithTokenStore(store),
+		WithClock(func() time.Time { return now }),
+	)
+
+	got, err := manager.AccessToken(context.Background())
+	if err != nil {
+		t.Fatalf("AccessToken() error = %v", err)
+	}
+	if got != "saved" || calls != 0 {
+		t.Fatalf("AccessToken() = %s after %d fetches, want the saved token without fetching", got, calls)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := manager.AccessToken(context.Background()); err != nil {
+		t.Fatalf("AccessToken() error = %v", err)
+	}
+
+	stored, err := store.LoadToken(context.Background())
+	if err != nil {
+		t.Fatalf("LoadToken() error = %v", err)
+	}
+	if stored.Token.AccessToken != "token-1" || !stored.ObtainedAt.Equal(now) {
+		t.Errorf("store was not updated with the refreshed token: %+v", stored)
+	}
+}
+
+func TestTokenManager_StoreFallback(t *testing.T) {
+	t.Parallel()
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+		now = time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+	)
+
+	corrupt := NewFileTokenStore(filepath.Join(dir, "corrupt.json"), nil)
+	if err := os.WriteFile(corrupt.Path, []byte(`{"token":`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	undecryptable := NewFileTokenStore(filepath.Join(dir, "secret.json"), bytes.Repeat([]byte{7}, 32))
+	if err := os.WriteFile(undecryptable.Path, []byte("bm90IGVuY3J5cHRlZA=="), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	otherUser := NewMemoryTokenStore()
+	err := otherUser.SaveToken(ctx, &StoredToken{
+		Token:      &TokenResponse{AccessToken: "saved", ExpiresIn: 3600},
+		ObtainedAt: now,
+		Username:   "other",
+	})
+	if err != nil {
+		t.Fatalf("SaveToken() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		store     TokenStore
+		wantError bool
+	}{
+		{name: "corrupt file", store: corrupt, wantError: true},
+		{name: "undecryptable file", store: undecryptable, wantError: true},
+		{name: "token of another user", store: otherUser, wantError: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				calls    int64
+				reported []error
+			)
+			manager := NewTokenManager("", &TokenRequest{Username: "user"},
+				WithTokenFetcher(countingFetcher(&calls, 3600)),
+				WithTokenStore(tt.store),
+				WithTokenStoreErrorHandler(func(err error) { reported = append(reported, err) }),
+				WithClock(func() time.Time { return now }),
+			)
+
+			for i := 0; i < 2; i++ {
+				got, err := manager.AccessToken(ctx)
+				if err != nil {
+					t.Fatalf("AccessToken() error = %v", err)
+				}
+				if got != "token-1" {
+					t.Fatalf("AccessToken() = %s, want a fetched token", got)
+				}
+			}
+			if (len(reported) > 0) != tt.wantError {
+				t.Errorf("store errors = %v, want errors %v", reported, tt.wantError)
+			}
+
+			stored, err := tt.store.LoadToken(ctx)
+			if err != nil {
+				t.Fatalf("LoadToken() error = %v", err)
+			}
+			if stored.Token.AccessToken != "token-1" || stored.Username != "user" {
+				t.Errorf("store was not replaced with the fetched token: %+v", stored)
+			}
+		})
+	}
+}
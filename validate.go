@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+const (
+	// ValidationLenient rejects receipts with violations of SeverityError only.
+	ValidationLenient ValidationMode = iota
+	// ValidationStrict rejects receipts with any violation, warnings included.
+	ValidationStrict
+	// ValidationDisabled does not validate receipts before submitting them.
+	ValidationDisabled
+
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+var (
+	tinPattern    = regexp.MustCompile(`^[0-9]{9}$`)
+	nidaPattern   = regexp.MustCompile(`^[0-9]{20}$`)
+	mobilePattern = regexp.MustCompile(`^[0-9]{10,12}$`)
+)
+
+type (
+	// ValidationMode decides which violations stop a receipt from being submitted.
+	ValidationMode int
+
+	// Severity tells how serious a Violation is. Receipts with errors are
+	// rejected by the VFD server, warnings point at values that are likely
+	// wrong but are accepted.
+	Severity string
+
+	// Violation is a single problem found in a ReceiptRequest. Field is the path
+	// of the offending value, for example Items[0].Quantity.
+	Violation struct {
+		Field    string   `json:"field"`
+		Message  string   `json:"message"`
+		Severity Severity `json:"severity"`
+	}
+
+	// Violations is the list of problems found by ReceiptRequest.Validate.
+	Violations []Violation
+
+	// ValidationError is returned when a receipt is rejected before submission.
+	ValidationError struct {
+		Violations Violations
+	}
+)
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s (%s)", v.Field, v.Message, v.Severity)
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.String()
+	}
+	return fmt.Sprintf("invalid receipt: %s", strings.Join(messages, "; "))
+}
+
+// Err returns a *ValidationError holding the violations that reject a receipt
+// under the given mode, or nil if there are none.
+func (v Violations) Err(mode ValidationMode) error {
+	var blocking Violations
+	for _, violation := range v {
+		switch mode {
+		case ValidationDisabled:
+			continue
+		case ValidationLenient:
+			if violation.Severity == SeverityError {
+				blocking = append(blocking, violation)
+			}
+		default:
+			blocking = append(blocking, violation)
+		}
+	}
+
+	if len(blocking) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Violations: blocking}
+}
+
+// Validate checks the receipt for values the VFD server is known to reject
+// and returns every violation found. It returns nil if the receipt is valid.
+func (r *ReceiptRequest) Validate() Violations {
+	var v Violations
+	add := func(severity Severity, field, format string, args ...any) {
+		v = append(v, Violation{
+			Field:    field,
+			Message:  fmt.Sprintf(format, args...),
+			Severity: severity,
+		})
+	}
+
+	validateParams(r.Params, add)
+	validateCustomer(r.Customer, add)
+
+	if len(r.Items) == 0 {
+		add(SeverityError, "Items", "at least one item is required")
+	}
+
+	// computable is false when an item amount overflows, the total can not be
+	// worked out then
+	computable := true
+	for i, item := range r.Items {
+		field := fmt.Sprintf("Items[%d]", i)
+		if item.ID == "" {
+			add(SeverityWarning, field+".ID", "item id is empty")
+		}
+		if strings.TrimSpace(item.Description) == "" {
+			add(SeverityWarning, field+".Description", "item description is empty")
+		}
+		if item.Quantity <= 0 {
+			add(SeverityError, field+".Quantity", "quantity must be greater than zero, got %v", item.Quantity)
+		}
+		if item.UnitPrice.IsNegative() {
+			add(SeverityError, field+".UnitPrice", "unit price must not be negative, got %s", item.UnitPrice)
+		}
+		if item.Discount.IsNegative() {
+			add(SeverityError, field+".Discount", "discount must not be negative, got %s", item.Discount)
+		}
+		amount, err := item.UnitPrice.Mul(item.Quantity)
+		if err != nil {
+			add(SeverityError, field+".Quantity", "item amount can not be computed: %v", err)
+			computable = false
+		} else if item.Discount.Cmp(amount) > 0 {
+			add(SeverityError, field+".Discount", "discount %s is more than the item amount %s",
+				item.Discount, amount)
+		}
+		if !item.TaxCode.Valid() {
+			add(SeverityError, field+".TaxCode", "unknown tax code %d, allowed values are 1 through 5", item.TaxCode)
+		}
+	}
+
+	if len(r.Payments) == 0 {
+		add(SeverityWarning, "Payments", "no payment given")
+	}
+
+	var paid money.Money
+	for i, payment := range r.Payments {
+		field := fmt.Sprintf("Payments[%d]", i)
+		switch payment.Type {
+		case CashPaymentType, ChequePaymentType, CreditCardPaymentType, ElectronicPaymentType, InvoicePaymentType:
+		default:
+			add(SeverityError, field+".Type", "unknown payment type %q", payment.Type)
+		}
+		if payment.Amount.IsNegative() {
+			add(SeverityError, field+".Amount", "payment amount must not be negative, got %s", payment.Amount)
+		}
+		paid = paid.Add(payment.Amount)
+	}
+
+	if computable && len(r.Items) > 0 && len(r.Payments) > 0 {
+		total := ProcessItemsForDate(r.Items, r.Params.Date, r.Options).TOTALS.TOTALTAXINCL
+		if paid.Cmp(total) != 0 {
+			add(SeverityError, "Payments", "payments add up to %s but the receipt total is %s", paid, total)
+		}
+	}
+
+	return v
+}
+
+func validateParams(params ReceiptParams, add func(Severity, string, string, ...any)) {
+	if !tinPattern.MatchString(params.TIN) {
+		add(SeverityError, "Params.TIN", "TIN must be 9 digits without dashes, got %q", params.TIN)
+	}
+	if params.RegistrationID == "" {
+		add(SeverityError, "Params.RegistrationID", "registration id is required")
+	}
+	if params.EFDSerial == "" {
+		add(SeverityError, "Params.EFDSerial", "EFD serial is required")
+	}
+	if _, err := time.Parse(DateFormat, params.Date); err != nil {
+		add(SeverityError, "Params.Date", "date must be in YYYY-MM-DD format, got %q", params.Date)
+	}
+	if _, err := time.Parse(TimeFormat, params.Time); err != nil {
+		add(SeverityError, "Params.Time", "time must be in HH:MM:SS format, got %q", params.Time)
+	}
+	if params.GlobalCounter <= 0 {
+		add(SeverityError, "Params.GlobalCounter", "global counter must be greater than zero")
+	}
+	if params.DailyCounter <= 0 {
+		add(SeverityError, "Params.DailyCounter", "daily counter must be greater than zero")
+	}
+	if params.ZNum == "" {
+		add(SeverityWarning, "Params.ZNum", "ZNUM is empty")
+	}
+	if params.ReceiptVNum == "" {
+		add(SeverityWarning, "Params.ReceiptVNum", "RCTVNUM is empty")
+	}
+}
+
+func validateCustomer(customer Customer, add func(Severity, string, string, ...any)) {
+	if customer.Type < TINCustomerID || customer.Type > MeterNumberCustomerID {
+		add(SeverityError, "Customer.Type", "unknown customer id type %d, allowed values are 1 through 7", customer.Type)
+		return
+	}
+
+	if customer.Type != NonCustomerID && strings.TrimSpace(customer.ID) == "" {
+		add(SeverityError, "Customer.ID", "customer id is required for id type %d", customer.Type)
+	}
+
+	switch customer.Type {
+	case TINCustomerID:
+		if !tinPattern.MatchString(customer.ID) {
+			add(SeverityError, "Customer.ID", "TIN must be 9 digits without dashes, got %q", customer.ID)
+		}
+	case NIDACustomerID:
+		if !nidaPattern.MatchString(customer.ID) {
+			add(SeverityError, "Customer.ID", "NIDA number must be 20 digits, got %q", customer.ID)
+		}
+	}
+
+	if customer.Mobile != "" && !mobilePattern.MatchString(customer.Mobile) {
+		add(SeverityWarning, "Customer.Mobile", "mobile number should be 10 to 12 digits, got %q", customer.Mobile)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd_test
+
+import (
+	"errors"
+	"testing"
+
+	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+func validReceipt() *vfd.ReceiptRequest {
+	return &vfd.ReceiptRequest{
+		Params: vfd.ReceiptParams{
+			Date:           "2023-01-01",
+			Time:           "08:00:00",
+			TIN:            "100553997",
+			RegistrationID: "TZ0100553997",
+			EFDSerial:      "10TZ101807",
+			ReceiptNum:     "101",
+			DailyCounter:   1,
+			GlobalCounter:  101,
+			ZNum:           "20230101",
+			ReceiptVNum:    "55B8C5101",
+		},
+		Customer: vfd.Customer{
+			Type:   vfd.TINCustomerID,
+			ID:     "100553998",
+			Name:   "John Doe",
+			Mobile: "255765992153",
+		},
+		Items: []vfd.Item{
+			vfd.NewItem("1", "Item 1", vfd.TaxableItemCode, 2, 5000, 1000),
+		},
+		Payments: []vfd.Payment{
+			vfd.NewPayment(vfd.CashPaymentType, 9000),
+		},
+	}
+}
+
+func TestReceiptRequest_Validate(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		modify      func(r *vfd.ReceiptRequest)
+		wantField   string
+		wantLenient bool
+	}{
+		{
+			name:   "valid receipt",
+			modify: func(r *vfd.ReceiptRequest) {},
+		},
+		{
+			name:        "no items",
+			modify:      func(r *vfd.ReceiptRequest) { r.Items = nil },
+			wantField:   "Items",
+			wantLenient: true,
+		},
+		{
+			name:        "negative quantity",
+			modify:      func(r *vfd.ReceiptRequest) { r.Items[0].Quantity = -1 },
+			wantField:   "Items[0].Quantity",
+			wantLenient: true,
+		},
+		{
+			name:        "unknown tax code",
+			modify:      func(r *vfd.ReceiptRequest) { r.Items[0].TaxCode = 9 },
+			wantField:   "Items[0].TaxCode",
+			wantLenient: true,
+		},
+		{
+			name:        "TIN with dashes",
+			modify:      func(r *vfd.ReceiptRequest) { r.Customer.ID = "100-553-998" },
+			wantField:   "Customer.ID",
+			wantLenient: true,
+		},
+		{
+			name: "short NIDA number",
+			modify: func(r *vfd.ReceiptRequest) {
+				r.Customer.Type = vfd.NIDACustomerID
+				r.Customer.ID = "516221638383907151"
+			},
+			wantField:   "Customer.ID",
+			wantLenient: true,
+		},
+		{
+			name:        "item amount out of range",
+			modify:      func(r *vfd.ReceiptRequest) { r.Items[0].Quantity = 1e300 },
+			wantField:   "Items[0].Quantity",
+			wantLenient: true,
+		},
+		{
+			name:        "payments do not add up",
+			modify:      func(r *vfd.ReceiptRequest) { r.Payments[0].Amount = money.MustParse("8999.99") },
+			wantField:   "Payments",
+			wantLenient: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			receipt := validReceipt()
+			tt.modify(receipt)
+			violations := receipt.Validate()
+
+			if tt.wantField == "" {
+				if len(violations) != 0 {
+					t.Fatalf("Validate() = %v, want no violations", violations)
+				}
+				return
+			}
+
+			found := false
+			for _, v := range violations {
+				found = found || v.Field == tt.wantField
+			}
+			if !found {
+				t.Errorf("Validate() = %v, want a violation of %s", violations, tt.wantField)
+			}
+
+			var validationErr *vfd.ValidationError
+			if err := violations.Err(vfd.ValidationStrict); !errors.As(err, &validationErr) {
+				t.Errorf("Err(ValidationStrict) = %v, want a *ValidationError", err)
+			}
+			if err := violations.Err(vfd.ValidationLenient); (err != nil) != tt.wantLenient {
+				t.Errorf("Err(ValidationLenient) = %v, want error: %v", err, tt.wantLenient)
+			}
+			if err := violations.Err(vfd.ValidationDisabled); err != nil {
+				t.Errorf("Err(ValidationDisabled) = %v, want nil", err)
+			}
+		})
+	}
+}
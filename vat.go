@@ -22,8 +22,16 @@
 package vfd
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
 )
 
 const (
@@ -49,15 +57,57 @@ const (
 )
 
 type (
+	// TaxCategory is the tax code of an Item, it decides the ValueAddedTax
+	// category the item is taxed in.
+	TaxCategory int64
+
 	ValueAddedTax struct {
 		ID         string // ID is a character that identifies the ValueAddedTax it can be A,B,C,D or E
 		Code       int64  // Code is a number that identifies the ValueAddedTax it can be 0,1,2,3 or 4
 		Name       string
 		Percentage float64
 	}
+
+	// VATRate is the percentage of the VAT category ID in effect from the date
+	// EffectiveFrom, in DateFormat. A rate without EffectiveFrom has always been
+	// in effect.
+	VATRate struct {
+		ID            string  `json:"id"`
+		Percentage    float64 `json:"percentage"`
+		EffectiveFrom string  `json:"effective_from,omitempty"`
+	}
+
+	// VATTable holds the rates of the VAT categories A to E over time, so that a
+	// receipt is always computed with the rates in effect on its date, also when
+	// it is computed again after a rate has changed. It is safe for concurrent use.
+	VATTable struct {
+		mu    sync.RWMutex
+		rates map[string][]VATRate
+	}
+)
+
+// The TaxCategory of items in each of the ValueAddedTax categories A to E.
+const (
+	StandardTaxCategory      TaxCategory = StandardVATCODE
+	SpecialTaxCategory       TaxCategory = SpecialVATCODE
+	ZeroTaxCategory          TaxCategory = ZeroVATCODE
+	SpecialReliefTaxCategory TaxCategory = SpecialReliefVATCODE
+	ExemptedTaxCategory      TaxCategory = ExemptedVATCODE
 )
 
 var (
+	// ErrInvalidVATRate is returned when a VATRate can not be added to a VATTable.
+	ErrInvalidVATRate = errors.New("invalid VAT rate")
+
+	// ErrUnknownTaxCode is returned by the strict functions for tax codes other
+	// than 1 through 5.
+	ErrUnknownTaxCode = errors.New("unknown tax code")
+)
+
+var (
+	// vatIDs lists the ValueAddedTax IDs in the order they appear in VATTOTALS
+	vatIDs = []string{StandardVATID, SpecialVATID, ZeroVATID, SpecialReliefVATID, ExemptedVATID}
+
 	standardVAT = ValueAddedTax{
 		ID:         StandardVATID,
 		Code:       StandardVATCODE,
@@ -88,23 +138,198 @@ var (
 		Name:       "Exempted ValueAddedTax",
 		Percentage: ExemptedVATRATE,
 	}
+
+	// vatCategories lists the ValueAddedTax categories in the order of vatIDs
+	vatCategories = []ValueAddedTax{standardVAT, specialVAT, zeroVAT, specialReliefVAT, exemptedVAT}
+
+	// baseVATTable holds the built-in rates, it is used when no VATTable is
+	// given and is never modified so that the same input always gives the
+	// same payload.
+	baseVATTable = NewVATTable()
 )
 
+// NewVATTable returns a VATTable with the standard rate of 18% for A and 0% for
+// the other categories, in effect since forever.
+func NewVATTable() *VATTable {
+	t := &VATTable{rates: make(map[string][]VATRate)}
+	for _, vat := range vatCategories {
+		t.rates[vat.ID] = []VATRate{{ID: vat.ID, Percentage: vat.Percentage}}
+	}
+	return t
+}
+
+// Set adds a rate to the table, replacing the rate of the same category that
+// takes effect on the same date.
+func (t *VATTable) Set(rate VATRate) error {
+	if _, ok := vatCategory(rate.ID); !ok {
+		return fmt.Errorf("%w: unknown category %q", ErrInvalidVATRate, rate.ID)
+	}
+	if rate.Percentage < 0 || rate.Percentage >= 100 {
+		return fmt.Errorf("%w: %s-%.2f", ErrInvalidVATRate, rate.ID, rate.Percentage)
+	}
+	if rate.EffectiveFrom != "" {
+		if _, err := time.Parse(DateFormat, rate.EffectiveFrom); err != nil {
+			return fmt.Errorf("%w: effective date %q: %v", ErrInvalidVATRate, rate.EffectiveFrom, err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rates := t.rates[rate.ID]
+	i := sort.Search(len(rates), func(i int) bool { return rates[i].EffectiveFrom >= rate.EffectiveFrom })
+	if i < len(rates) && rates[i].EffectiveFrom == rate.EffectiveFrom {
+		rates[i] = rate
+		return nil
+	}
+	t.rates[rate.ID] = append(rates[:i], append([]VATRate{rate}, rates[i:]...)...)
+
+	return nil
+}
+
+// LoadTaxCodes sets the rates of the categories A to D from the TAXCODES
+// returned at registration, in effect from effectiveFrom. Empty codes are
+// skipped.
+func (t *VATTable) LoadTaxCodes(codes TAXCODES, effectiveFrom string) error {
+	for _, code := range []struct{ id, value string }{
+		{StandardVATID, codes.CODEA},
+		{SpecialVATID, codes.CODEB},
+		{ZeroVATID, codes.CODEC},
+		{SpecialReliefVATID, codes.CODED},
+	} {
+		value := strings.TrimSpace(code.value)
+		if value == "" {
+			continue
+		}
+
+		percentage, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%w: CODE%s %q", ErrInvalidVATRate, code.id, code.value)
+		}
+		rate := VATRate{ID: code.id, Percentage: percentage, EffectiveFrom: effectiveFrom}
+		if err := t.Set(rate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rate returns the rate of the category id in effect on date, in DateFormat.
+// An empty date is today in TanzaniaTime.
+func (t *VATTable) Rate(id, date string) (VATRate, bool) {
+	if date == "" {
+		date = time.Now().In(TanzaniaTime).Format(DateFormat)
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	rates := t.rates[id]
+	i := sort.Search(len(rates), func(i int) bool { return rates[i].EffectiveFrom > date })
+	if i == 0 {
+		return VATRate{}, false
+	}
+	return rates[i-1], true
+}
+
+// ParseTaxCode is like the ParseTaxCode function with the rate in effect on
+// date, see Rate.
+func (t *VATTable) ParseTaxCode(code int64, date string) ValueAddedTax {
+	vat := parseTaxCategory(code)
+	if rate, ok := t.Rate(vat.ID, date); ok {
+		vat.Percentage = rate.Percentage
+	}
+	return vat
+}
+
+// ParseTaxCodeStrict is like the ParseTaxCodeStrict function with the rate in
+// effect on date.
+func (t *VATTable) ParseTaxCodeStrict(code int64, date string) (ValueAddedTax, error) {
+	if !TaxCategory(code).Valid() {
+		return ValueAddedTax{}, fmt.Errorf("%w: %d", ErrUnknownTaxCode, code)
+	}
+	return t.ParseTaxCode(code, date), nil
+}
+
+// NetAmount is like the NetAmount function with the rate in effect on date.
+func (t *VATTable) NetAmount(taxCode int64, date string, price float64) float64 {
+	vat := t.ParseTaxCode(taxCode, date)
+	return vat.NetAmount(price)
+}
+
+// SplitAmount is like the SplitAmount function with the rate in effect on date.
+func (t *VATTable) SplitAmount(taxCode int64, date string, price money.Money) (net, tax money.Money) {
+	vat := t.ParseTaxCode(taxCode, date)
+	return vat.Split(price)
+}
+
+// ReportTaxRateID is like the ReportTaxRateID function with the rate in
+// effect on date.
+func (t *VATTable) ReportTaxRateID(taxCode int64, date string) string {
+	vat := t.ParseTaxCode(taxCode, date)
+	return reportTaxRateID(vat.ID, vat.Percentage)
+}
+
+func (t *VATTable) orDefault() *VATTable {
+	if t == nil {
+		return baseVATTable
+	}
+	return t
+}
+
+// Split splits a tax inclusive amount into the net amount and the ValueAddedTax
+// charged on it. The net amount is rounded to the nearest cent and the tax is
+// what remains, so that net + tax is always equal to total.
+func (v *ValueAddedTax) Split(total money.Money) (net, tax money.Money) {
+	// the rate in hundredths of a percent, 18% is 1800. Rates outside the range
+	// VATTable accepts are not applied, so the net amount is never more than
+	// the total.
+	var basisPoints int64
+	if v.Percentage > 0 && v.Percentage < 100 {
+		basisPoints = int64(math.Round(v.Percentage * 100))
+	}
+	net = total.MustScale(10000, 10000+basisPoints)
+	return net, total.Sub(net)
+}
+
 func (v *ValueAddedTax) NetAmount(totalAmount float64) float64 {
-	rate := 1.00 + (v.Percentage / 100)
-	netAmount := totalAmount / rate
-	return math.Round(netAmount*100) / 100
+	net, _ := v.Split(money.FromFloat(totalAmount))
+	return net.Float64()
 }
 
 // Amount calculates the amount of ValueAddedTax that is charged to the buyer.
 // The answer is rounded to 2 decimal places.
 func (v *ValueAddedTax) Amount(totalAmount float64) float64 {
-	netAmount := v.NetAmount(totalAmount)
-	amount := totalAmount - netAmount
-	return math.Round(amount*100) / 100
+	_, tax := v.Split(money.FromFloat(totalAmount))
+	return tax.Float64()
 }
 
+// ParseTaxCode returns the ValueAddedTax category of a tax code with its
+// built-in rate, 18% for A and 0% for the others. Unknown codes are standard
+// rated. Use VATTable.ParseTaxCode for the rates of the VFD server.
 func ParseTaxCode(code int64) ValueAddedTax {
+	return parseTaxCategory(code)
+}
+
+// ParseTaxCodeStrict is like ParseTaxCode but returns an error wrapping
+// ErrUnknownTaxCode for codes other than 1 through 5, instead of treating
+// them as standard rated.
+func ParseTaxCodeStrict(code int64) (ValueAddedTax, error) {
+	if !TaxCategory(code).Valid() {
+		return ValueAddedTax{}, fmt.Errorf("%w: %d", ErrUnknownTaxCode, code)
+	}
+	return parseTaxCategory(code), nil
+}
+
+// Valid tells if c is one of the categories 1 through 5.
+func (c TaxCategory) Valid() bool {
+	return c >= StandardTaxCategory && c <= ExemptedTaxCategory
+}
+
+// parseTaxCategory returns the ValueAddedTax category of a tax code with its
+// built-in rate.
+func parseTaxCategory(code int64) ValueAddedTax {
 	switch code {
 	case 1:
 		return standardVAT
@@ -150,9 +375,14 @@ func NetAmount(taxCode int64, price float64) float64 {
 // The answer is rounded to 2 decimal places.
 func ValueAddedTaxAmount(taxCode int64, price float64) float64 {
 	vat := ParseTaxCode(taxCode)
-	netAmount := vat.NetAmount(price)
-	amount := price - netAmount
-	return math.Round(amount*100) / 100
+	return vat.Amount(price)
+}
+
+// SplitAmount splits a tax inclusive price of a certain ValueAddedTax category
+// into the net amount and the ValueAddedTax amount, see ValueAddedTax.Split.
+func SplitAmount(taxCode int64, price money.Money) (net, tax money.Money) {
+	vat := ParseTaxCode(taxCode)
+	return vat.Split(price)
 }
 
 // ReportTaxRateID creates a string that contains the ValueAddedTax rate and the ValueAddedTax id
@@ -161,5 +391,19 @@ func ValueAddedTaxAmount(taxCode int64, price float64) float64 {
 // used in Z Report to indicate the ValueAddedTax rate and the ValueAddedTax id.
 func ReportTaxRateID(taxCode int64) string {
 	vat := ParseTaxCode(taxCode)
-	return fmt.Sprintf("%s-%.2f", vat.ID, vat.Percentage)
+	return reportTaxRateID(vat.ID, vat.Percentage)
+}
+
+func reportTaxRateID(id string, percentage float64) string {
+	return fmt.Sprintf("%s-%.2f", id, percentage)
+}
+
+// vatCategory returns the ValueAddedTax category with the given ID, A through E.
+func vatCategory(id string) (ValueAddedTax, bool) {
+	for _, vat := range vatCategories {
+		if vat.ID == id {
+			return vat, true
+		}
+	}
+	return ValueAddedTax{}, false
 }
@@ -22,9 +22,14 @@
 package vfd_test
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
 	"testing"
 
 	vfd "github.com/Golang-Tanzania/tra-vfd"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
 )
 
 func TestNetAmountAndTaxAmount(t *testing.T) {
@@ -89,3 +94,122 @@ func TestReportTaxRateID(t *testing.T) {
 		})
 	}
 }
+
+func TestVATTable(t *testing.T) {
+	t.Parallel()
+	table := vfd.NewVATTable()
+	err := table.LoadTaxCodes(vfd.TAXCODES{CODEA: "18", CODEB: "0", CODEC: "0", CODED: "0"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Set(vfd.VATRate{ID: "A", Percentage: 16, EffectiveFrom: "2025-07-01"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		date     string
+		code     int64
+		wantRate string
+		wantNet  string
+		wantTax  string
+	}{
+		{"2025-06-30", vfd.StandardVATCODE, "A-18.00", "9830.51", "1769.49"},
+		{"2025-07-01", vfd.StandardVATCODE, "A-16.00", "10000.00", "1600.00"},
+		{"2025-07-01", vfd.ExemptedVATCODE, "E-0.00", "11600.00", "0.00"},
+	} {
+		if got := table.ReportTaxRateID(tt.code, tt.date); got != tt.wantRate {
+			t.Errorf("ReportTaxRateID(%d, %s) = %s, want %s", tt.code, tt.date, got, tt.wantRate)
+		}
+
+		item := vfd.NewItem("1", "Sugar", tt.code, 2, 5800, 0)
+		result := vfd.ProcessItemsForDate([]vfd.Item{item}, tt.date, vfd.ReceiptOptions{VATTable: table})
+		vat := result.VATTOTALS[0]
+		if vat.NETTAMOUNT.String() != tt.wantNet || vat.TAXAMOUNT.String() != tt.wantTax {
+			t.Errorf("ProcessItemsForDate(%s) = %s + %s, want %s + %s", tt.date,
+				vat.NETTAMOUNT, vat.TAXAMOUNT, tt.wantNet, tt.wantTax)
+		}
+	}
+
+	for name, err := range map[string]error{
+		"unknown category": table.Set(vfd.VATRate{ID: "F", Percentage: 10}),
+		"invalid date":     table.Set(vfd.VATRate{ID: "A", Percentage: 10, EffectiveFrom: "01/07/2025"}),
+		"invalid code":     table.LoadTaxCodes(vfd.TAXCODES{CODEA: "eighteen"}, ""),
+	} {
+		if !errors.Is(err, vfd.ErrInvalidVATRate) {
+			t.Errorf("%s: error = %v, want %v", name, err, vfd.ErrInvalidVATRate)
+		}
+	}
+
+	// a report on the day the rate changed has the new rate and the old one
+	// of the receipts issued before the change
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vats := []vfd.VATTOTAL{
+		{ID: "A", Rate: 18, NetAmount: money.MustParse("100.00"), TaxAmount: money.MustParse("18.00")},
+		{ID: "A", Rate: 16, NetAmount: money.MustParse("100.00"), TaxAmount: money.MustParse("16.00")},
+	}
+	payload, err := vfd.ReportBytesWithOptions(privateKey, &vfd.ReportParams{Date: "2025-07-01"}, vfd.Address{},
+		vats, nil, vfd.ReportTotals{}, vfd.ReportOptions{VATTable: table})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := vfd.ParseReport(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rates []string
+	for _, vat := range report.Report.VATTOTALS.VATTOTAL {
+		rates = append(rates, vat.VATRATE+"="+vat.TAXAMOUNT.String())
+	}
+	want := "[A-16.00=16.00 B-0.00=0.00 C-0.00=0.00 D-0.00=0.00 E-0.00=0.00 A-18.00=18.00]"
+	if got := fmt.Sprint(rates); got != want {
+		t.Errorf("VATTOTALS = %s, want %s", got, want)
+	}
+
+	// a table does not change the built-in rates of the package level functions
+	if got := vfd.ReportTaxRateID(vfd.StandardVATCODE); got != "A-18.00" {
+		t.Errorf("ReportTaxRateID() = %s, want the built-in A-18.00", got)
+	}
+	item := vfd.NewItem("1", "Sugar", vfd.StandardVATCODE, 2, 5800, 0)
+	if got := vfd.ProcessItemsForDate([]vfd.Item{item}, "2025-07-01", vfd.ReceiptOptions{}).VATTOTALS[0]; got.TAXAMOUNT.String() != "1769.49" {
+		t.Errorf("ProcessItemsForDate() without a table tax = %s, want 1769.49 at 18%%", got.TAXAMOUNT)
+	}
+}
+
+func TestParseTaxCodeStrict(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		code    int64
+		wantID  string
+		wantErr error
+	}{
+		{code: int64(vfd.StandardTaxCategory), wantID: vfd.StandardVATID},
+		{code: int64(vfd.ZeroTaxCategory), wantID: vfd.ZeroVATID},
+		{code: int64(vfd.ExemptedTaxCategory), wantID: vfd.ExemptedVATID},
+		{code: 0, wantErr: vfd.ErrUnknownTaxCode},
+		{code: 9, wantErr: vfd.ErrUnknownTaxCode},
+	}
+	for _, tt := range tests {
+		got, err := vfd.ParseTaxCodeStrict(tt.code)
+		if !errors.Is(err, tt.wantErr) || got.ID != tt.wantID {
+			t.Errorf("ParseTaxCodeStrict(%d) = %q, %v, want %q, %v", tt.code, got.ID, err, tt.wantID, tt.wantErr)
+		}
+	}
+
+	items := []vfd.Item{
+		vfd.NewItem("1", "Sugar", vfd.StandardVATCODE, 1, 5900, 0),
+		vfd.NewItem("2", "Bread", 9, 1, 2000, 0),
+	}
+	if _, err := vfd.ProcessItemsStrict(items[:1], "", vfd.ReceiptOptions{}); err != nil {
+		t.Errorf("ProcessItemsStrict() error = %v", err)
+	}
+	if _, err := vfd.ProcessItemsStrict(items, "", vfd.ReceiptOptions{}); !errors.Is(err, vfd.ErrUnknownTaxCode) {
+		t.Errorf("ProcessItemsStrict() error = %v, want %v", err, vfd.ErrUnknownTaxCode)
+	}
+	// the lenient functions keep taxing unknown codes at the standard rate
+	if got := vfd.ProcessItems(items).VATTOTALS; len(got) != 1 || got[0].VATRATE != vfd.StandardVATID {
+		t.Errorf("ProcessItems() VATTOTALS = %+v, want only %s", got, vfd.StandardVATID)
+	}
+}
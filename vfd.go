@@ -27,6 +27,7 @@ import (
 	"strings"
 
 	"github.com/Golang-Tanzania/tra-vfd/pkg/env"
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
 )
 
 const (
@@ -92,22 +93,25 @@ type (
 
 	// RequestHeaders represent collection of request headers during receipt or Z report
 	// sending via VFD Service.
+	// BearerToken is a static token. When it is empty the token is taken from
+	// TokenSource, which is typically a *TokenManager.
 	RequestHeaders struct {
 		CertSerial  string
 		BearerToken string
+		TokenSource TokenSource
 	}
 
 	Payment struct {
-		Type   PaymentType
-		Amount float64
+		Type   PaymentType `json:"type"`
+		Amount money.Money `json:"amount"`
 	}
 
 	// VATTOTAL represent the VAT details.
 	VATTOTAL struct {
-		ID        string
-		Rate      float64
-		TaxAmount float64
-		NetAmount float64
+		ID        string      `json:"id"`
+		Rate      float64     `json:"rate"`
+		TaxAmount money.Money `json:"tax_amount"`
+		NetAmount money.Money `json:"net_amount"`
 	}
 
 	// Response contains details returned when submitting a receipt to the VFD Service
@@ -120,12 +124,15 @@ type (
 	// is HH24:MI:SS
 	// Code (int) is the response code. 0 means success.
 	// Message (string) is the response message.
+	// Reauthenticated (bool) is true when the first attempt was rejected because
+	// of the bearer token and the payload was resent with a new token.
 	Response struct {
-		Number  int64  `json:"number,omitempty"`
-		Date    string `json:"date,omitempty"`
-		Time    string `json:"time,omitempty"`
-		Code    int64  `json:"code,omitempty"`
-		Message string `json:"message,omitempty"`
+		Number          int64  `json:"number,omitempty"`
+		Date            string `json:"date,omitempty"`
+		Time            string `json:"time,omitempty"`
+		Code            int64  `json:"code,omitempty"`
+		Message         string `json:"message,omitempty"`
+		Reauthenticated bool   `json:"reauthenticated,omitempty"`
 	}
 
 	Service interface {
@@ -165,6 +172,11 @@ func IsSuccess(code int64) bool {
 	return code == SuccessCode
 }
 
+// NewPayment creates a Payment from a float amount, rounded to the nearest cent.
+func NewPayment(paymentType PaymentType, amount float64) Payment {
+	return Payment{Type: paymentType, Amount: money.FromFloat(amount)}
+}
+
 // ParsePayment ...
 func ParsePayment(value any) PaymentType {
 	// heck if int or string
@@ -0,0 +1,345 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Golang-Tanzania/tra-vfd/internal/fileutil"
+)
+
+// DefaultZReportRetryInterval is how long ZReportScheduler.Run waits before
+// trying again after a Z report could not be submitted.
+const DefaultZReportRetryInterval = 5 * time.Minute
+
+var (
+	// ErrZReportStateNotFound is returned by a ZReportStore when nothing has been saved.
+	ErrZReportStateNotFound = errors.New("z report state not found")
+
+	// ErrZReportNotBuilt is returned when the ZReportBuilder does not return a
+	// report with params.
+	ErrZReportNotBuilt = errors.New("z report not built")
+)
+
+type (
+	// ZReportState is the persisted state of a ZReportScheduler, the ZNumber and
+	// the business day in DateFormat of the last Z report acknowledged by the
+	// VFD server.
+	ZReportState struct {
+		ZNumber string `json:"znumber"`
+		Date    string `json:"date"`
+	}
+
+	// ZReportStore persists ZReportState. LoadZReportState returns
+	// ErrZReportStateNotFound when nothing has been saved yet.
+	ZReportStore interface {
+		LoadZReportState(ctx context.Context) (*ZReportState, error)
+		SaveZReportState(ctx context.Context, state *ZReportState) error
+	}
+
+	// ZReportBuilder builds the Z report of the business day that closes at
+	// closeTime. It is called for every day, days without sales included, for
+	// which it must return a report with zero totals and the Gross carried over.
+	// A DailyAggregator without receipts builds such a report. The scheduler
+	// sets the Date, Time and ZNumber of the params.
+	ZReportBuilder func(ctx context.Context, closeTime time.Time) (*ReportRequest, error)
+
+	// ZReportSubmitFunc submits a Z report, Client.Report is one. A report is
+	// only taken as acknowledged when there is no error and the Response has
+	// the SuccessCode, any other ACK code is a failed submission.
+	ZReportSubmitFunc func(ctx context.Context, report *ReportRequest) (*Response, error)
+
+	// ZReportScheduler submits the Z report of every business day at its close
+	// time. The last acknowledged day is saved to the ZReportStore, so that after
+	// a restart or a downtime the reports of all the days missed are submitted
+	// in order before any other. It is safe for concurrent use.
+	ZReportScheduler struct {
+		mu        sync.Mutex
+		store     ZReportStore
+		build     ZReportBuilder
+		submit    ZReportSubmitFunc
+		closeTime time.Duration
+		location  *time.Location
+		firstDate string
+		retry     time.Duration
+		now       func() time.Time
+		onError   func(err error, failures int)
+	}
+
+	// ZReportSchedulerOption configures a ZReportScheduler.
+	ZReportSchedulerOption func(*ZReportScheduler)
+
+	// FileZReportStore saves the ZReportState as JSON in a file. The file is
+	// replaced atomically on every save.
+	FileZReportStore struct {
+		Path string
+	}
+)
+
+// WithCloseTime sets the local time the business day closes at, it defaults
+// to 23:59:59.
+func WithCloseTime(hour, minute, second int) ZReportSchedulerOption {
+	return func(s *ZReportScheduler) {
+		s.closeTime = time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute +
+			time.Duration(second)*time.Second
+	}
+}
+
+// WithZReportLocation sets the time zone of the close time. It defaults to
+// TanzaniaTime, which is the Africa/Dar_es_Salaam time zone.
+func WithZReportLocation(location *time.Location) ZReportSchedulerOption {
+	return func(s *ZReportScheduler) {
+		if location != nil {
+			s.location = location
+		}
+	}
+}
+
+// WithFirstReportDate sets the first business day, in DateFormat, to report
+// when nothing has been saved yet. By default it is the day the scheduler
+// first runs.
+func WithFirstReportDate(date string) ZReportSchedulerOption {
+	return func(s *ZReportScheduler) {
+		s.firstDate = date
+	}
+}
+
+// WithZReportRetryInterval sets how long Run waits before trying again after a
+// failed submission, DefaultZReportRetryInterval by default.
+func WithZReportRetryInterval(interval time.Duration) ZReportSchedulerOption {
+	return func(s *ZReportScheduler) {
+		s.retry = interval
+	}
+}
+
+// WithZReportErrorHandler sets a function that Run calls with every error of
+// SubmitDue, so that Z reports that keep failing do not go unnoticed. The
+// handler gets the number of consecutive failures so far, 1 for the first.
+func WithZReportErrorHandler(handler func(err error, failures int)) ZReportSchedulerOption {
+	return func(s *ZReportScheduler) {
+		s.onError = handler
+	}
+}
+
+// WithZReportClock replaces time.Now, it is meant for tests.
+func WithZReportClock(now func() time.Time) ZReportSchedulerOption {
+	return func(s *ZReportScheduler) {
+		s.now = now
+	}
+}
+
+// NewZReportScheduler creates a ZReportScheduler that builds the Z reports with
+// build and submits them with submit.
+func NewZReportScheduler(store ZReportStore, build ZReportBuilder, submit ZReportSubmitFunc,
+	options ...ZReportSchedulerOption,
+) *ZReportScheduler {
+	s := &ZReportScheduler{
+		store:     store,
+		build:     build,
+		submit:    submit,
+		closeTime: 24*time.Hour - time.Second,
+		location:  TanzaniaTime,
+		retry:     DefaultZReportRetryInterval,
+		now:       time.Now,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// SubmitDue submits the Z reports of the business days that have closed since
+// the last acknowledged one, oldest first, and returns how many were accepted.
+// The state is saved after every accepted report. It stops at the first report
+// that can not be built or submitted, the next call starts again from it.
+func (s *ZReportScheduler) SubmitDue(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, err := s.store.LoadZReportState(ctx)
+	if err != nil && !errors.Is(err, ErrZReportStateNotFound) {
+		return 0, fmt.Errorf("could not load z report state: %w", err)
+	}
+
+	var next time.Time
+	if state != nil && state.Date != "" {
+		last, err := time.ParseInLocation(DateFormat, state.Date, s.location)
+		if err != nil {
+			return 0, fmt.Errorf("invalid z report state date %q: %w", state.Date, err)
+		}
+		next = last.AddDate(0, 0, 1)
+	} else {
+		if next, err = s.firstDay(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	submitted := 0
+	now := s.now()
+	for day := next; !s.closesAt(day).After(now); day = day.AddDate(0, 0, 1) {
+		state, err := s.submitDay(ctx, s.closesAt(day))
+		if err != nil {
+			return submitted, err
+		}
+		if err := s.store.SaveZReportState(ctx, state); err != nil {
+			return submitted, fmt.Errorf("could not save z report state: %w", err)
+		}
+		submitted++
+	}
+
+	return submitted, nil
+}
+
+// Run submits the reports that are due, then waits for the next close time or,
+// after a failure, for the retry interval, until ctx is done. Failures are
+// passed to the handler set with WithZReportErrorHandler.
+func (s *ZReportScheduler) Run(ctx context.Context) error {
+	failures := 0
+	for {
+		wait := s.retry
+		if _, err := s.SubmitDue(ctx); err == nil {
+			failures = 0
+			wait = s.NextClose().Sub(s.now())
+		} else if ctx.Err() == nil {
+			failures++
+			if s.onError != nil {
+				s.onError(err, failures)
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Last returns the state of the last acknowledged Z report, or
+// ErrZReportStateNotFound when none has been.
+func (s *ZReportScheduler) Last(ctx context.Context) (*ZReportState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.store.LoadZReportState(ctx)
+}
+
+// NextClose returns the next close time after now.
+func (s *ZReportScheduler) NextClose() time.Time {
+	now := s.now().In(s.location)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.location)
+	if closeTime := s.closesAt(day); closeTime.After(now) {
+		return closeTime
+	}
+	return s.closesAt(day.AddDate(0, 0, 1))
+}
+
+// submitDay builds and submits the Z report of the day that closes at closeTime.
+func (s *ZReportScheduler) submitDay(ctx context.Context, closeTime time.Time) (*ZReportState, error) {
+	report, err := s.build(ctx, closeTime)
+	if err != nil {
+		return nil, fmt.Errorf("could not build the z report of %s: %w", closeTime.Format(DateFormat), err)
+	}
+	if report == nil || report.Params == nil {
+		return nil, fmt.Errorf("%w: %s", ErrZReportNotBuilt, closeTime.Format(DateFormat))
+	}
+
+	report.Params.Date = closeTime.Format(DateFormat)
+	report.Params.Time = closeTime.Format(TimeFormat)
+	report.Params.ZNumber = closeTime.Format(ZNumFormat)
+
+	response, err := s.submit(ctx, report)
+	if err == nil {
+		if response == nil {
+			err = ErrReportSubmitFailed
+		} else {
+			err = ackError("submit report", ErrReportSubmitFailed, response.Code, response.Message)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not submit the z report of %s: %w", report.Params.Date, err)
+	}
+
+	return &ZReportState{ZNumber: report.Params.ZNumber, Date: report.Params.Date}, nil
+}
+
+// firstDay returns the day to start from when nothing has been saved. Without
+// WithFirstReportDate it is today, which is saved as the day before so that a
+// restart does not move it.
+func (s *ZReportScheduler) firstDay(ctx context.Context) (time.Time, error) {
+	if s.firstDate != "" {
+		day, err := time.ParseInLocation(DateFormat, s.firstDate, s.location)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid first report date %q: %w", s.firstDate, err)
+		}
+		return day, nil
+	}
+
+	now := s.now().In(s.location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.location)
+	yesterday := today.AddDate(0, 0, -1)
+	if err := s.store.SaveZReportState(ctx, &ZReportState{Date: yesterday.Format(DateFormat)}); err != nil {
+		return time.Time{}, fmt.Errorf("could not save z report state: %w", err)
+	}
+	return today, nil
+}
+
+func (s *ZReportScheduler) closesAt(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, s.location).Add(s.closeTime)
+}
+
+// NewFileZReportStore creates a FileZReportStore that saves the state in path.
+func NewFileZReportStore(path string) *FileZReportStore {
+	return &FileZReportStore{Path: path}
+}
+
+func (f *FileZReportStore) LoadZReportState(_ context.Context) (*ZReportState, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrZReportStateNotFound
+		}
+		return nil, fmt.Errorf("could not read z report state file: %w", err)
+	}
+
+	state := new(ZReportState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not decode z report state file: %w", err)
+	}
+
+	return state, nil
+}
+
+func (f *FileZReportStore) SaveZReportState(_ context.Context, state *ZReportState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not encode z report state: %w", err)
+	}
+	return fileutil.WriteAtomic(f.Path, data, 0o600)
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2023 Golang Tanzania
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+ * of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED,
+ * INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A
+ * PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+ * HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+ * OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package vfd
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Golang-Tanzania/tra-vfd/pkg/money"
+)
+
+func TestZReportScheduler(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var (
+		now       time.Time
+		submitted []*ReportRequest
+		failWith  error
+		ackCode   int64
+	)
+	clock := func() time.Time { return now }
+	build := func(_ context.Context, closeTime time.Time) (*ReportRequest, error) {
+		// no receipts, every day is a zero-sales day
+		return NewDailyAggregator(money.MustParse("1000.00")).Report(&ReportParams{TIN: "100553997"}, &Address{}), nil
+	}
+	submit := func(_ context.Context, report *ReportRequest) (*Response, error) {
+		if failWith != nil {
+			return nil, failWith
+		}
+		if ackCode != SuccessCode {
+			return &Response{Code: ackCode, Message: ParseErrorCode(ackCode)}, nil
+		}
+		submitted = append(submitted, report)
+		return &Response{Code: SuccessCode}, nil
+	}
+	at := func(date, clock string) time.Time {
+		ts, err := time.ParseInLocation(DateFormat+" "+TimeFormat, date+" "+clock, TanzaniaTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	znumbers := func() []string {
+		var list []string
+		for _, report := range submitted {
+			list = append(list, report.Params.ZNumber)
+		}
+		submitted = nil
+		return list
+	}
+
+	store := NewFileZReportStore(filepath.Join(t.TempDir(), "zreport.json"))
+	scheduler := NewZReportScheduler(store, build, submit,
+		WithCloseTime(22, 0, 0),
+		WithFirstReportDate("2023-01-01"),
+		WithZReportClock(clock),
+	)
+
+	steps := []struct {
+		name     string
+		now      time.Time
+		failWith error
+		ackCode  int64
+		want     []string
+		wantErr  error
+		wantLast string
+	}{
+		{
+			name:     "catches up to the last closed day",
+			now:      at("2023-01-03", "10:00:00"),
+			want:     []string{"20230101", "20230102"},
+			wantLast: "20230102",
+		},
+		{
+			name:     "nothing due before the close time",
+			now:      at("2023-01-03", "21:59:59"),
+			wantLast: "20230102",
+		},
+		{
+			name:     "failed submission",
+			now:      at("2023-01-05", "23:00:00"),
+			failWith: ErrUnhandledException,
+			wantErr:  ErrUnhandledException,
+			wantLast: "20230102",
+		},
+		{
+			name:     "ack code without an error",
+			now:      at("2023-01-05", "23:00:00"),
+			ackCode:  ApprovalRequired,
+			wantErr:  ErrApprovalRequired,
+			wantLast: "20230102",
+		},
+		{
+			name:     "resumes from the failed day",
+			now:      at("2023-01-05", "23:00:00"),
+			want:     []string{"20230103", "20230104", "20230105"},
+			wantLast: "20230105",
+		},
+	}
+
+	for _, step := range steps {
+		now, failWith, ackCode = step.now, step.failWith, step.ackCode
+		count, err := scheduler.SubmitDue(ctx)
+		if !errors.Is(err, step.wantErr) {
+			t.Errorf("%s: SubmitDue() error = %v, want %v", step.name, err, step.wantErr)
+		}
+		if count != len(step.want) {
+			t.Errorf("%s: SubmitDue() = %d, want %d", step.name, count, len(step.want))
+		}
+		if got := znumbers(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: submitted %v, want %v", step.name, got, step.want)
+		}
+		last, err := scheduler.Last(ctx)
+		if err != nil || last.ZNumber != step.wantLast {
+			t.Errorf("%s: Last() = %+v, %v, want ZNumber %s", step.name, last, err, step.wantLast)
+		}
+	}
+
+	if want := at("2023-01-06", "22:00:00"); !scheduler.NextClose().Equal(want) {
+		t.Errorf("NextClose() = %v, want %v", scheduler.NextClose(), want)
+	}
+
+	// without a first report date the scheduler starts with the day it first runs
+	fresh := NewZReportScheduler(NewFileZReportStore(filepath.Join(t.TempDir(), "zreport.json")), build, submit,
+		WithZReportClock(clock))
+	now = at("2023-02-01", "08:00:00")
+	if count, err := fresh.SubmitDue(ctx); count != 0 || err != nil {
+		t.Errorf("SubmitDue() on the first day = %d, %v, want 0", count, err)
+	}
+	now = at("2023-02-02", "09:00:00")
+	if count, err := fresh.SubmitDue(ctx); count != 1 || err != nil {
+		t.Errorf("SubmitDue() after the first close = %d, %v, want 1", count, err)
+	}
+	report := submitted[0]
+	if report.Params.Date != "2023-02-01" || report.Params.Time != "23:59:59" || report.Params.ZNumber != "20230201" ||
+		report.Params.TIN != "100553997" || report.Totals.Gross != money.MustParse("1000.00") {
+		t.Errorf("zero-sales report = %+v %+v", report.Params, report.Totals)
+	}
+}
+
+func TestZReportScheduler_RunReportsErrors(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var failures []int
+	build := func(_ context.Context, closeTime time.Time) (*ReportRequest, error) {
+		return NewDailyAggregator(money.Zero).Report(&ReportParams{}, &Address{}), nil
+	}
+	submit := func(_ context.Context, report *ReportRequest) (*Response, error) {
+		return nil, ErrUnhandledException
+	}
+	now := time.Date(2023, 1, 3, 10, 0, 0, 0, TanzaniaTime)
+	scheduler := NewZReportScheduler(NewFileZReportStore(filepath.Join(t.TempDir(), "zreport.json")), build, submit,
+		WithFirstReportDate("2023-01-01"),
+		WithZReportClock(func() time.Time { return now }),
+		WithZReportRetryInterval(time.Millisecond),
+		WithZReportErrorHandler(func(err error, n int) {
+			if !errors.Is(err, ErrUnhandledException) {
+				t.Errorf("handler error = %v, want %v", err, ErrUnhandledException)
+			}
+			if failures = append(failures, n); n == 3 {
+				cancel()
+			}
+		}),
+	)
+
+	if err := scheduler.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() error = %v, want %v", err, context.Canceled)
+	}
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(failures, want) {
+		t.Errorf("handler failures = %v, want %v", failures, want)
+	}
+}